@@ -0,0 +1,320 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+var ErrTimeout = errors.New("request timed out")
+
+// Client talks to a remote Server and implements engine.Engine, so callers
+// can swap a local engine for a remote one without code changes.
+type Client struct {
+	opts options
+	pool *pool
+	// bucket is the name of the bucket the client acts on, empty for the
+	// default bucket.
+	bucket string
+}
+
+var _ engine.Engine = (*Client)(nil)
+
+// Dial connects to the server at addr. The first connection is opened
+// eagerly so an unreachable server is reported here rather than on first use.
+func Dial(addr string, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := &Client{
+		opts: o,
+		pool: newPool(addr, o.poolSize, o.dialTimeout),
+	}
+	conn, err := c.pool.get(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	c.pool.put(conn, false)
+	return c, nil
+}
+
+// Bucket returns a client of the bucket called name, which shares the
+// connections of c. Closing either closes both.
+func (c *Client) Bucket(name string) (engine.Engine, error) {
+	if name == engine.DEFAULT_BUCKET {
+		return &Client{opts: c.opts, pool: c.pool}, nil
+	}
+	err := c.call("Bucket", true, &BucketArgs{Bucket: name}, &Empty{})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{opts: c.opts, pool: c.pool, bucket: name}, nil
+}
+
+// DropBucket is not retried: a retry after a lost reply would report a
+// missing bucket for a drop that succeeded.
+func (c *Client) DropBucket(name string) error {
+	return c.call("DropBucket", false, &BucketArgs{Bucket: name}, &Empty{})
+}
+
+func (c *Client) ListBuckets() ([]string, error) {
+	reply := &KeysReply{}
+	err := c.call("ListBuckets", true, &Empty{}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Keys, nil
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.call("Put", true, &PutArgs{Bucket: c.bucket, Key: key, Value: value}, &Empty{})
+}
+
+func (c *Client) Get(key string) (string, error) {
+	reply := &ValueReply{}
+	err := c.call("Get", true, &KeyArgs{Bucket: c.bucket, Key: key}, reply)
+	if err != nil {
+		return "", err
+	}
+	return reply.Value, nil
+}
+
+func (c *Client) Has(key string) (bool, error) {
+	reply := &BoolReply{}
+	err := c.call("Has", true, &KeyArgs{Bucket: c.bucket, Key: key}, reply)
+	if err != nil {
+		return false, err
+	}
+	return reply.Ok, nil
+}
+
+func (c *Client) MultiGet(keys []string) (map[string]string, error) {
+	reply := &ValuesReply{}
+	err := c.call("MultiGet", true, &KeysArgs{Bucket: c.bucket, Keys: keys}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Values == nil {
+		// gob leaves out empty maps
+		return map[string]string{}, nil
+	}
+	return reply.Values, nil
+}
+
+// Delete is not retried: a retry after a lost reply would report a missing
+// key for a delete that actually succeeded.
+func (c *Client) Delete(key string) error {
+	return c.call("Delete", false, &KeyArgs{Bucket: c.bucket, Key: key}, &Empty{})
+}
+
+// CompareAndSwap, PutIfAbsent and DeleteIfEquals are not retried: a retry
+// after a lost reply would report a failure for a write that succeeded.
+func (c *Client) CompareAndSwap(key, old, new string) (bool, error) {
+	return c.callBool("CompareAndSwap", &SwapArgs{Bucket: c.bucket, Key: key, Old: old, New: new})
+}
+
+func (c *Client) PutIfAbsent(key, value string) (bool, error) {
+	return c.callBool("PutIfAbsent", &PutArgs{Bucket: c.bucket, Key: key, Value: value})
+}
+
+func (c *Client) DeleteIfEquals(key, value string) (bool, error) {
+	return c.callBool("DeleteIfEquals", &PutArgs{Bucket: c.bucket, Key: key, Value: value})
+}
+
+// Incr and Append are not retried, a retry after a lost reply would apply
+// them twice.
+func (c *Client) Incr(key string, delta int64) (int64, error) {
+	reply := &IntReply{}
+	err := c.call("Incr", false, &IncrArgs{Bucket: c.bucket, Key: key, Delta: delta}, reply)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Value, nil
+}
+
+func (c *Client) Append(key, suffix string) error {
+	return c.call("Append", false, &PutArgs{Bucket: c.bucket, Key: key, Value: suffix}, &Empty{})
+}
+
+func (c *Client) callBool(method string, args interface{}) (bool, error) {
+	reply := &BoolReply{}
+	err := c.call(method, false, args, reply)
+	if err != nil {
+		return false, err
+	}
+	return reply.Ok, nil
+}
+
+// PutReader sends the value in a single call: net/rpc can't stream, so the
+// value is read into memory first. The buffer grows as the value is read,
+// so a wrong size doesn't allocate more than value holds.
+func (c *Client) PutReader(key string, value io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%w: negative size %d", engine.ErrValueTooLarge, size)
+	}
+	var buf strings.Builder
+	n, err := io.Copy(&buf, io.LimitReader(value, size))
+	if err != nil {
+		return err
+	}
+	if n < size {
+		return io.ErrUnexpectedEOF
+	}
+	return c.Put(key, buf.String())
+}
+
+// GetReader fetches the whole value before returning, see PutReader.
+func (c *Client) GetReader(key string) (io.ReadCloser, error) {
+	value, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(value)), nil
+}
+
+func (c *Client) ListKeys() ([]string, error) {
+	reply := &KeysReply{}
+	err := c.call("ListKeys", true, &BucketArgs{Bucket: c.bucket}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Keys, nil
+}
+
+func (c *Client) Merge() error {
+	return c.call("Merge", false, &Empty{}, &Empty{})
+}
+
+func (c *Client) Stats() (engine.Stats, error) {
+	reply := engine.Stats{}
+	err := c.call("Stats", true, &BucketArgs{Bucket: c.bucket}, &reply)
+	if err != nil {
+		return engine.Stats{}, err
+	}
+	return reply, nil
+}
+
+func (c *Client) Sync() bool {
+	reply := &BoolReply{}
+	err := c.call("Sync", true, &Empty{}, reply)
+	if err != nil {
+		return false
+	}
+	return reply.Ok
+}
+
+// Close releases the client's connections. The remote engine stays open.
+func (c *Client) Close() bool {
+	err := c.pool.close()
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+func (c *Client) call(method string, idempotent bool, args interface{}, reply interface{}) error {
+	attempts := 1
+	if idempotent {
+		attempts += c.opts.maxRetries
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(c.opts.retryBackoff)
+		}
+		var retryable bool
+		retryable, err = c.callOnce(method, args, reply)
+		if err == nil || !retryable {
+			return err
+		}
+	}
+	return err
+}
+
+// callOnce performs a single request. retryable is true when the request
+// failed in transport, i.e. the remote engine may never have seen it.
+func (c *Client) callOnce(method string, args interface{}, reply interface{}) (retryable bool, err error) {
+	var deadline time.Time
+	if c.opts.callTimeout > 0 {
+		deadline = time.Now().Add(c.opts.callTimeout)
+	}
+	conn, err := c.pool.get(deadline)
+	if err != nil {
+		return err != errPoolClosed, err
+	}
+
+	call := conn.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-call.Done:
+	case <-timeout:
+		// the reply may still arrive later, so the connection can't be reused
+		c.pool.put(conn, true)
+		return true, ErrTimeout
+	}
+
+	if serverErr, ok := call.Error.(rpc.ServerError); ok {
+		c.pool.put(conn, false)
+		return false, decodeError(serverErr)
+	}
+	c.pool.put(conn, call.Error != nil)
+	return call.Error != nil, call.Error
+}
+
+// remoteErrors are the engine errors a client can match with errors.Is.
+// net/rpc only carries the message, and the engine reports these either
+// as-is or wrapped with detail appended, so they're recognised by prefix.
+var remoteErrors = []error{
+	engine.ErrKeyNotFound,
+	engine.ErrKeyTooLarge,
+	engine.ErrValueTooLarge,
+	engine.ErrUnsupportedVersion,
+	engine.ErrClosed,
+	engine.ErrReadOnly,
+	engine.ErrMissingKey,
+	engine.ErrWrongKey,
+	engine.ErrNotInteger,
+	engine.ErrOverflow,
+	engine.ErrSubscriberLagged,
+	engine.ErrBucketNotFound,
+	engine.ErrInvalidBucket,
+}
+
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
+
+// decodeError turns an error reported by the remote engine back into a
+// local error value.
+func decodeError(err rpc.ServerError) error {
+	msg := string(err)
+	for _, known := range remoteErrors {
+		if msg == known.Error() {
+			return known
+		}
+		if strings.HasPrefix(msg, known.Error()+":") {
+			return &remoteError{msg: msg, err: known}
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,318 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+func startServer(t *testing.T, e engine.Engine, addr string) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+func openEngine(t *testing.T) engine.Engine {
+	t.Helper()
+	e, err := engine.OpenBitcaskEngine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	_, addr := startServer(t, openEngine(t), "127.0.0.1:0")
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get("a")
+	if err != nil || got != "1" {
+		t.Fatalf("Get() = %q, %v, want %q", got, err, "1")
+	}
+	if ok, err := c.Has("b"); err != nil || !ok {
+		t.Fatalf("Has() = %v, %v, want true", ok, err)
+	}
+	values, err := c.MultiGet([]string{"a", "b", "c"})
+	if err != nil || len(values) != 2 || values["a"] != "1" || values["b"] != "2" {
+		t.Fatalf("MultiGet() = %v, %v, want a and b", values, err)
+	}
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("a"); err == nil {
+		t.Fatal("Get() of deleted key returned no error")
+	}
+	keys, err := c.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("ListKeys() = %v, want [b]", keys)
+	}
+	if !c.Sync() {
+		t.Fatal("Sync() = false")
+	}
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 1 || stats.Tombstones != 1 {
+		t.Fatalf("Stats() = %+v, want 1 key and 1 tombstone", stats)
+	}
+}
+
+func TestClientPutReader(t *testing.T) {
+	_, addr := startServer(t, openEngine(t), "127.0.0.1:0")
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.PutReader("a", strings.NewReader("value"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get("a"); err != nil || got != "value" {
+		t.Errorf("Get() = %q, %v, want %q", got, err, "value")
+	}
+	if err := c.PutReader("b", strings.NewReader("v"), -1); !errors.Is(err, engine.ErrValueTooLarge) {
+		t.Errorf("PutReader() of a negative size error = %v, want %v", err, engine.ErrValueTooLarge)
+	}
+	// a size far beyond the value isn't allocated up front
+	if err := c.PutReader("b", strings.NewReader("v"), 1<<62); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("PutReader() of a short value error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := c.Get("b"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Get() of a failed PutReader error = %v, want %v", err, engine.ErrKeyNotFound)
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	_, addr := startServer(t, openEngine(t), "127.0.0.1:0")
+	c, err := Dial(addr, WithPoolSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			if err := c.Put(key, key); err != nil {
+				errs <- err
+				return
+			}
+			v, err := c.Get(key)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if v != key {
+				errs <- fmt.Errorf("Get(%q) = %q", key, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	keys, err := c.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 32 {
+		t.Fatalf("ListKeys() returned %d keys, want 32", len(keys))
+	}
+}
+
+type slowEngine struct {
+	engine.Engine
+	delay time.Duration
+}
+
+func (e *slowEngine) Get(key string) (string, error) {
+	time.Sleep(e.delay)
+	return e.Engine.Get(key)
+}
+
+func TestClientTimeout(t *testing.T) {
+	e := &slowEngine{Engine: openEngine(t), delay: 200 * time.Millisecond}
+	_, addr := startServer(t, e, "127.0.0.1:0")
+	c, err := Dial(addr, WithCallTimeout(20*time.Millisecond), WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("a"); err != ErrTimeout {
+		t.Fatalf("Get() error = %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestClientRetryAfterServerRestart(t *testing.T) {
+	e := openEngine(t)
+	s, addr := startServer(t, e, "127.0.0.1:0")
+	c, err := Dial(addr, WithRetries(5, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pooled connection dies with the server; the next idempotent
+	// request must transparently reconnect to the new one.
+	s.Close()
+	startServer(t, e, addr)
+
+	got, err := c.Get("a")
+	if err != nil || got != "1" {
+		t.Fatalf("Get() = %q, %v, want %q", got, err, "1")
+	}
+}
+
+func TestClientRemoteErrorNotRetried(t *testing.T) {
+	_, addr := startServer(t, openEngine(t), "127.0.0.1:0")
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Get("missing")
+	if !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Fatalf("Get() error = %v, want %v", err, engine.ErrKeyNotFound)
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	_, addr := startServer(t, openEngine(t), "127.0.0.1:0")
+	c, err := Dial(addr, WithCallTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// more than one Changes call's worth of history
+	const n = CHANGES_BATCH + 10
+	for i := 0; i < n; i++ {
+		if err := c.Put(fmt.Sprint(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := c.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go func() {
+		// after a few polls have come back empty
+		time.Sleep(300 * time.Millisecond)
+		c.Delete("0")
+	}()
+	for seq := uint64(1); seq <= n+1; seq++ {
+		select {
+		case ev, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("subscription ended at %d: %v", seq, s.Err())
+			}
+			if ev.Seq != seq {
+				t.Fatalf("event %d, want %d", ev.Seq, seq)
+			}
+			if seq == n+1 && (ev.Type != engine.EVENT_DELETE || ev.Key != "0") {
+				t.Fatalf("last event = %v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d", seq)
+		}
+	}
+}
+
+func TestClientBuckets(t *testing.T) {
+	e := openEngine(t)
+	_, addr := startServer(t, e, "127.0.0.1:0")
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	users, err := c.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("a", "users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("a", "default"); err != nil {
+		t.Fatal(err)
+	}
+	local, err := e.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := local.Get("a"); err != nil || v != "users" {
+		t.Errorf("local bucket Get() = %q, %v", v, err)
+	}
+	if v, err := c.Get("a"); err != nil || v != "default" {
+		t.Errorf("default bucket Get() = %q, %v", v, err)
+	}
+	if names, err := c.ListBuckets(); err != nil || fmt.Sprint(names) != "[default users]" {
+		t.Errorf("ListBuckets() = %v, %v", names, err)
+	}
+
+	if err := c.DropBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("a"); !errors.Is(err, engine.ErrBucketNotFound) {
+		t.Errorf("Get() from a dropped bucket error = %v, want %v", err, engine.ErrBucketNotFound)
+	}
+	if _, err := c.Bucket(""); !errors.Is(err, engine.ErrInvalidBucket) {
+		t.Errorf("Bucket(\"\") error = %v, want %v", err, engine.ErrInvalidBucket)
+	}
+	users, err = c.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("a"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Get() from a recreated bucket error = %v, want %v", err, engine.ErrKeyNotFound)
+	}
+}
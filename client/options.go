@@ -0,0 +1,65 @@
+package client
+
+import "time"
+
+const (
+	DEFAULT_POOL_SIZE     = 4
+	DEFAULT_DIAL_TIMEOUT  = 5 * time.Second
+	DEFAULT_CALL_TIMEOUT  = 10 * time.Second
+	DEFAULT_MAX_RETRIES   = 2
+	DEFAULT_RETRY_BACKOFF = 50 * time.Millisecond
+)
+
+type options struct {
+	poolSize     int
+	dialTimeout  time.Duration
+	callTimeout  time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		poolSize:     DEFAULT_POOL_SIZE,
+		dialTimeout:  DEFAULT_DIAL_TIMEOUT,
+		callTimeout:  DEFAULT_CALL_TIMEOUT,
+		maxRetries:   DEFAULT_MAX_RETRIES,
+		retryBackoff: DEFAULT_RETRY_BACKOFF,
+	}
+}
+
+// WithPoolSize bounds the number of connections the client keeps open.
+func WithPoolSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.poolSize = n
+		}
+	}
+}
+
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithCallTimeout bounds a single request, including the wait for a free
+// connection. Zero disables the timeout.
+func WithCallTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.callTimeout = d
+	}
+}
+
+// WithRetries sets how many times an idempotent request is retried after a
+// transport failure. Errors returned by the remote engine are never retried.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.maxRetries = n
+		}
+		o.retryBackoff = backoff
+	}
+}
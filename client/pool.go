@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+var errPoolClosed = errors.New("client closed")
+
+// pool hands out at most size connections at a time. Idle connections are
+// reused; broken ones are dropped and redialled on demand.
+type pool struct {
+	addr        string
+	dialTimeout time.Duration
+
+	slots chan struct{}
+	idle  chan *rpc.Client
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newPool(addr string, size int, dialTimeout time.Duration) *pool {
+	return &pool{
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		slots:       make(chan struct{}, size),
+		idle:        make(chan *rpc.Client, size),
+	}
+}
+
+// get waits for a free slot until deadline (zero means no deadline) and
+// returns an idle connection or a freshly dialled one.
+func (p *pool) get(deadline time.Time) (*rpc.Client, error) {
+	if p.isClosed() {
+		return nil, errPoolClosed
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-timeout:
+		return nil, ErrTimeout
+	}
+
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, p.dialTimeout)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// put returns c to the pool. Connections that saw a transport error are
+// closed instead of being reused.
+func (p *pool) put(c *rpc.Client, broken bool) {
+	defer func() { <-p.slots }()
+	if broken || p.isClosed() {
+		_ = c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		_ = c.Close()
+	}
+}
+
+func (p *pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	var firstErr error
+	for {
+		select {
+		case c := <-p.idle:
+			err := c.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		default:
+			return firstErr
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+// serviceName is the name the engine is registered under on the rpc server.
+const serviceName = "Bitcask"
+
+// The Bucket of the arguments is the name of the bucket a call acts on,
+// empty for the default bucket.
+
+type BucketArgs struct {
+	Bucket string
+}
+
+type PutArgs struct {
+	Bucket string
+	Key    string
+	Value  string
+}
+
+type SwapArgs struct {
+	Bucket string
+	Key    string
+	Old    string
+	New    string
+}
+
+type IncrArgs struct {
+	Bucket string
+	Key    string
+	Delta  int64
+}
+
+type KeyArgs struct {
+	Bucket string
+	Key    string
+}
+
+type KeysArgs struct {
+	Bucket string
+	Keys   []string
+}
+
+type ValueReply struct {
+	Value string
+}
+
+type ValuesReply struct {
+	Values map[string]string
+}
+
+// ChangesArgs asks for up to Max events from FromSeq on, waiting up to
+// Wait for the first one.
+type ChangesArgs struct {
+	Bucket  string
+	FromSeq uint64
+	Max     int
+	Wait    time.Duration
+}
+
+type EventsReply struct {
+	Events []engine.Event
+}
+
+type KeysReply struct {
+	Keys []string
+}
+
+type IntReply struct {
+	Value int64
+}
+
+type BoolReply struct {
+	Ok bool
+}
+
+type Empty struct{}
@@ -0,0 +1,333 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+// Server exposes an engine.Engine to remote clients. The engine is not
+// closed when the server is.
+type Server struct {
+	rpcServer *rpc.Server
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+type service struct {
+	engine engine.Engine
+
+	// buckets are the handles of the buckets the clients named, kept so a
+	// dropped bucket stays dropped for them until they ask for it again.
+	mu      sync.Mutex
+	buckets map[string]engine.Engine
+}
+
+func NewServer(e engine.Engine) (*Server, error) {
+	rpcServer := rpc.NewServer()
+	err := rpcServer.RegisterName(serviceName, &service{engine: e, buckets: make(map[string]engine.Engine)})
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		rpcServer: rpcServer,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve accepts connections on l until the listener fails or the server is
+// closed. It always returns a non-nil error.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("server closed")
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return errors.New("server closed")
+			}
+			return err
+		}
+		if !s.track(conn) {
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			s.rpcServer.ServeConn(conn)
+			s.untrack(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// Close stops all listeners and drops every open connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var firstErr error
+	for l := range s.listeners {
+		err := l.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return firstErr
+}
+
+// bucket returns the engine of the bucket called name, the default bucket
+// if name is empty.
+func (s *service) bucket(name string) (engine.Engine, error) {
+	if name == "" {
+		return s.engine, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.buckets[name]; ok {
+		return e, nil
+	}
+	e, err := s.engine.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	s.buckets[name] = e
+	return e, nil
+}
+
+// Bucket opens the bucket, creating it if need be, for the calls that name
+// it from then on.
+func (s *service) Bucket(args *BucketArgs, reply *Empty) error {
+	e, err := s.engine.Bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[args.Bucket] = e
+	return nil
+}
+
+func (s *service) DropBucket(args *BucketArgs, reply *Empty) error {
+	return s.engine.DropBucket(args.Bucket)
+}
+
+func (s *service) ListBuckets(args *Empty, reply *KeysReply) error {
+	names, err := s.engine.ListBuckets()
+	if err != nil {
+		return err
+	}
+	reply.Keys = names
+	return nil
+}
+
+func (s *service) Put(args *PutArgs, reply *Empty) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	return e.Put(args.Key, args.Value)
+}
+
+func (s *service) Get(args *KeyArgs, reply *ValueReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	value, err := e.Get(args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Value = value
+	return nil
+}
+
+func (s *service) Has(args *KeyArgs, reply *BoolReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	ok, err := e.Has(args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Ok = ok
+	return nil
+}
+
+func (s *service) MultiGet(args *KeysArgs, reply *ValuesReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	values, err := e.MultiGet(args.Keys)
+	if err != nil {
+		return err
+	}
+	reply.Values = values
+	return nil
+}
+
+func (s *service) CompareAndSwap(args *SwapArgs, reply *BoolReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	ok, err := e.CompareAndSwap(args.Key, args.Old, args.New)
+	reply.Ok = ok
+	return err
+}
+
+func (s *service) PutIfAbsent(args *PutArgs, reply *BoolReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	ok, err := e.PutIfAbsent(args.Key, args.Value)
+	reply.Ok = ok
+	return err
+}
+
+func (s *service) DeleteIfEquals(args *PutArgs, reply *BoolReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	ok, err := e.DeleteIfEquals(args.Key, args.Value)
+	reply.Ok = ok
+	return err
+}
+
+func (s *service) Incr(args *IncrArgs, reply *IntReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	n, err := e.Incr(args.Key, args.Delta)
+	reply.Value = n
+	return err
+}
+
+func (s *service) Append(args *PutArgs, reply *Empty) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	return e.Append(args.Key, args.Value)
+}
+
+// Changes subscribes for the length of the call: it returns once it has
+// args.Max events, no event came for args.Wait, or, after the first event,
+// for CHANGES_LINGER.
+func (s *service) Changes(args *ChangesArgs, reply *EventsReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	sub, err := e.Subscribe(args.FromSeq)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	wait := args.Wait
+	for len(reply.Events) < args.Max {
+		timer := time.NewTimer(wait)
+		select {
+		case ev, ok := <-sub.Events():
+			timer.Stop()
+			if !ok {
+				if len(reply.Events) > 0 {
+					// the next call reports the error
+					return nil
+				}
+				return sub.Err()
+			}
+			reply.Events = append(reply.Events, ev)
+			wait = CHANGES_LINGER
+		case <-timer.C:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *service) Delete(args *KeyArgs, reply *Empty) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	return e.Delete(args.Key)
+}
+
+func (s *service) ListKeys(args *BucketArgs, reply *KeysReply) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	keys, err := e.ListKeys()
+	if err != nil {
+		return err
+	}
+	reply.Keys = keys
+	return nil
+}
+
+func (s *service) Merge(args *Empty, reply *Empty) error {
+	return s.engine.Merge()
+}
+
+func (s *service) Stats(args *BucketArgs, reply *engine.Stats) error {
+	e, err := s.bucket(args.Bucket)
+	if err != nil {
+		return err
+	}
+	stats, err := e.Stats()
+	if err != nil {
+		return err
+	}
+	*reply = stats
+	return nil
+}
+
+func (s *service) Sync(args *Empty, reply *BoolReply) error {
+	reply.Ok = s.engine.Sync()
+	return nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+const (
+	// CHANGES_BATCH is the most events a Changes call returns.
+	CHANGES_BATCH = 256
+	// CHANGES_LINGER is how long a Changes call that has events waits for
+	// more before it returns.
+	CHANGES_LINGER = 10 * time.Millisecond
+	// DEFAULT_CHANGES_WAIT is how long a Changes call waits for the first
+	// event when calls have no timeout.
+	DEFAULT_CHANGES_WAIT = time.Second
+)
+
+// Subscribe polls the server for events. Each poll waits on the server
+// for up to half the call timeout, so new writes arrive promptly. The
+// subscription ends when a poll fails after its retries.
+func (c *Client) Subscribe(fromSeq uint64) (engine.Subscription, error) {
+	wait := c.opts.callTimeout / 2
+	if wait <= 0 {
+		wait = DEFAULT_CHANGES_WAIT
+	}
+	s := &subscription{
+		events: make(chan engine.Event),
+		done:   make(chan struct{}),
+	}
+	go s.run(c, fromSeq, wait)
+	return s, nil
+}
+
+type subscription struct {
+	events    chan engine.Event
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *subscription) Events() <-chan engine.Event {
+	return s.events
+}
+
+func (s *subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *subscription) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *subscription) run(c *Client, fromSeq uint64, wait time.Duration) {
+	err := s.poll(c, fromSeq, wait)
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	close(s.events)
+}
+
+// poll delivers events until the subscription is closed, which returns
+// nil, or a call fails.
+func (s *subscription) poll(c *Client, fromSeq uint64, wait time.Duration) error {
+	for {
+		reply := &EventsReply{}
+		err := c.call("Changes", true, &ChangesArgs{Bucket: c.bucket, FromSeq: fromSeq, Max: CHANGES_BATCH, Wait: wait}, reply)
+		select {
+		case <-s.done:
+			return nil
+		default:
+		}
+		if err != nil {
+			return err
+		}
+		for _, ev := range reply.Events {
+			select {
+			case s.events <- ev:
+			case <-s.done:
+				return nil
+			}
+			fromSeq = ev.Seq + 1
+		}
+	}
+}
@@ -4,15 +4,20 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
 	"github.com/machinly/bitcask/engine"
+	"github.com/machinly/bitcask/engine/shard"
 	"github.com/machinly/bitcask/parser"
 )
 
 var (
 	flagDirName = flag.String("dir", "", "directory name")
+	flagShards  = flag.Int("shards", 0, "number of shards of a new sharded database")
+	flagReshard = flag.Int("reshard", 0, "rewrite the sharded database into this many shards and exit")
+	flagBuffer  = flag.Int("write-buffer", 0, "bytes of records to buffer before writing them out, for bulk loads")
 )
 
 func main() {
@@ -21,25 +26,50 @@ func main() {
 		_flagDirName := "./dbdata"
 		flagDirName = &_flagDirName
 	}
-	bitcask, err := engine.OpenBitcaskEngine(*flagDirName)
+	if *flagReshard > 0 {
+		err := shard.Reshard(*flagDirName, *flagReshard)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("resharded %s into %d shards\n", *flagDirName, *flagReshard)
+		return
+	}
+	var opts []engine.Option
+	if *flagBuffer > 0 {
+		opts = append(opts, engine.WithWriteBuffer(*flagBuffer, 0))
+	}
+	err := run(*flagDirName, *flagShards, opts, os.Stdin, os.Stdout)
 	if err != nil {
 		panic(err)
 	}
-	defer bitcask.Close()
+}
 
-	p := parser.NewParser(bitcask)
-	err = repl(p)
+// run opens the database in dir and evaluates the commands read from in
+// until "exit". The database is closed before run returns, which writes
+// out anything the write buffer still holds.
+func run(dir string, shards int, opts []engine.Option, in io.Reader, out io.Writer) error {
+	var bitcask engine.Engine
+	var err error
+	if shards > 0 || shard.Exists(dir) {
+		bitcask, err = shard.Open(dir, shards, opts...)
+	} else {
+		bitcask, err = engine.OpenBitcaskEngine(dir, opts...)
+	}
 	if err != nil {
-		panic(err)
+		return err
+	}
+	err = repl(parser.NewParser(bitcask), in, out)
+	if !bitcask.Close() && err == nil {
+		err = fmt.Errorf("closing %s failed", dir)
 	}
-	os.Exit(0)
+	return err
 }
 
-func repl(p parser.Parser) error {
-	stdin := bufio.NewReader(os.Stdin)
+func repl(p parser.Parser, in io.Reader, out io.Writer) error {
+	stdin := bufio.NewReader(in)
 	for {
 		// read
-		fmt.Print(">>> ")
+		fmt.Fprint(out, ">>> ")
 		line, prefix, err := stdin.ReadLine()
 		if prefix {
 			return fmt.Errorf("line too long")
@@ -57,12 +87,12 @@ func repl(p parser.Parser) error {
 
 		// print
 		if err != nil {
-			fmt.Printf("E %v\n", err)
+			fmt.Fprintf(out, "E %v\n", err)
 			continue
 		}
 
 		for _, v := range values {
-			fmt.Println(v)
+			fmt.Fprintln(out, v)
 		}
 	}
 	return nil
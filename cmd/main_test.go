@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+func TestRunFlushesWriteBuffer(t *testing.T) {
+	dir := t.TempDir()
+	opts := []engine.Option{engine.WithWriteBuffer(64*1024, time.Hour)}
+	in := strings.NewReader("put k1 v1\nput k2 v2\nexit\n")
+	if err := run(dir, 0, opts, in, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	e, err := engine.OpenBitcaskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	for key, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if v, err := e.Get(key); err != nil || v != want {
+			t.Errorf("Get(%s) after reopening = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/index"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+// Values of at least the blob threshold are written to blob files and the
+// data file only gets a small pointer record, so merging the data files
+// doesn't copy them. Blob files are compacted on their own, once enough of
+// a file is dead, by copying the live values and rewriting their pointers.
+
+// putBlob writes r to the active blob file and a pointer to it to the data
+// file. The caller holds mu.
+func (c *bitcask) putBlob(r record.Record) error {
+	buf, err := r.ToBytes()
+	if err != nil {
+		return err
+	}
+	blobFile, pos, err := c.blobs.Write(buf)
+	if err != nil {
+		return err
+	}
+	c.fileStats(blobFile).totalBytes += r.Len()
+	return c.putPointer(r, blobFile, pos)
+}
+
+// putPointer points key at blob, written to blobFile at pos. The caller
+// holds mu.
+func (c *bitcask) putPointer(blob record.Record, blobFile string, pos int64) error {
+	p, err := record.NewBlobPointerV2(blob, filepath.Base(blobFile), pos, record.WithChecksum(c.checksum))
+	if err == nil {
+		err = c.putRecord(p)
+	}
+	if err != nil {
+		// nothing refers to the blob record
+		c.fileStats(blobFile).deadBytes += blob.Len()
+		return err
+	}
+	return nil
+}
+
+// blobSet returns the keydir entry for a pointer record.
+func (c *bitcask) blobSet(set index.Set, r record.Record) (index.Set, error) {
+	ref, err := record.DecodeBlobRef(r.Value())
+	if err != nil {
+		return index.Set{}, err
+	}
+	set.Blob = &index.Blob{
+		FileId:        filepath.Join(c.blobDir, ref.File),
+		ValueSize:     ref.ValueSize,
+		ValuePosition: ref.ValuePosition,
+		Flags:         ref.Flags,
+		KeyId:         ref.KeyId,
+	}
+	return set, nil
+}
+
+// accountBlobs derives the stats of the blob files from their size and the
+// values the keydir points at, so opening doesn't read the blob files.
+func (c *bitcask) accountBlobs() error {
+	live := make(map[string]int64)
+	for bucket, kd := range c.keydirs {
+		err := c.liveBlobs(live, bucket, kd)
+		if err != nil {
+			return err
+		}
+	}
+	err := c.liveBlobs(live, 0, c.index)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, fileName := range c.dbFile.FileList() {
+		exists[fileName] = true
+	}
+	for _, fileName := range c.blobs.FileList() {
+		size, err := c.blobs.Size(fileName)
+		if err != nil {
+			return err
+		}
+		c.files[fileName] = &fileStats{totalBytes: size, deadBytes: size - live[fileName]}
+		exists[fileName] = true
+	}
+	for fileName := range live {
+		if !exists[fileName] {
+			return &ErrCorruptRecord{File: fileName, Reason: "referenced blob file is missing"}
+		}
+	}
+	// replaying dead pointers may have accounted blob files merged long ago
+	for fileName := range c.files {
+		if !exists[fileName] {
+			delete(c.files, fileName)
+		}
+	}
+	return nil
+}
+
+// liveBlobs adds up the blob record bytes the keydir of bucket points at,
+// by blob file.
+func (c *bitcask) liveBlobs(live map[string]int64, bucket uint32, kd index.Index) error {
+	return kd.Range(func(key string, set *index.Set) bool {
+		if set.Blob != nil {
+			live[set.Blob.FileId] += blobRecordSize(bucket, key, *set)
+		}
+		return true
+	})
+}
+
+// sealedBlobFiles returns the sealed blob files whose dead ratio reaches
+// the policy's BlobDeadRatio. The caller holds mu.
+func (c *bitcask) sealedBlobFiles() []string {
+	current := c.blobs.CurrentFile()
+	if current == "" {
+		// blob files are read-only without a blob threshold
+		return nil
+	}
+	files := make([]string, 0)
+	for _, fileName := range c.blobs.FileList() {
+		stats, ok := c.files[fileName]
+		if fileName == current || !ok || stats.deadBytes == 0 {
+			continue
+		}
+		if stats.deadRatio() >= c.mergePolicy.blobDeadRatio() {
+			files = append(files, fileName)
+		}
+	}
+	return files
+}
+
+func (c *bitcask) needsBlobMerge() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return false
+	}
+	return len(c.sealedBlobFiles()) > 0
+}
+
+// mergeBlobs compacts the blob files returned by sealedBlobFiles. The
+// caller holds mergeMu.
+func (c *bitcask) mergeBlobs(limiter *rateLimiter) error {
+	c.mu.RLock()
+	files := c.sealedBlobFiles()
+	c.mu.RUnlock()
+	if len(files) == 0 {
+		return nil
+	}
+	for _, fileName := range files {
+		err := c.mergeBlobFile(fileName, limiter)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the copies and their pointers must be durable before the originals go
+	err := c.blobs.Sync()
+	if err != nil {
+		return err
+	}
+	err = c.dbFile.Sync()
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		err := c.blobs.Remove(fileName)
+		if err != nil {
+			return err
+		}
+		delete(c.files, fileName)
+	}
+	return nil
+}
+
+// mergeBlobFile copies the live values of fileName to the active blob file
+// and points the keydir at the copies. Values are streamed without holding
+// mu; a value overwritten in the meantime leaves its copy as garbage.
+func (c *bitcask) mergeBlobFile(fileName string, limiter *rateLimiter) error {
+	return c.blobs.ReadAll(fileName, func(pos int64, reader io.Reader) error {
+		h, err := record.ParseHeader(reader)
+		if err != nil {
+			return record.WithLocation(err, fileName, pos)
+		}
+		r := h.Record()
+		if !limiter.wait(r.Len(), c.stop) {
+			return errMergeAborted
+		}
+		valuePos := pos + r.ValueRelativePosition()
+		c.mu.RLock()
+		live, err := c.blobLive(r.Bucket(), r.Key(), fileName, valuePos)
+		c.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if !live {
+			return h.Skip()
+		}
+
+		var newFile string
+		var newPos int64
+		if c.needsReencryption(r) {
+			r, err = h.ReadRecord()
+			if err == nil {
+				r, err = c.reencrypt(r)
+			}
+			var buf []byte
+			if err == nil {
+				buf, err = r.ToBytes()
+			}
+			if err == nil {
+				newFile, newPos, err = c.blobs.Write(buf)
+			}
+		} else {
+			newFile, newPos, err = c.blobs.WriteStream(func(w dbfile.StreamWriter) error {
+				return h.CopyTo(w)
+			})
+		}
+		if err != nil {
+			return record.WithLocation(err, fileName, pos)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			return ErrClosed
+		}
+		c.fileStats(newFile).totalBytes += r.Len()
+		live, err = c.blobLive(r.Bucket(), r.Key(), fileName, valuePos)
+		if err != nil {
+			return err
+		}
+		if !live {
+			c.fileStats(newFile).deadBytes += r.Len()
+			return nil
+		}
+		return c.putPointer(r, newFile, newPos)
+	})
+}
+
+// blobLive reports whether the keydir entry of key in bucket points at the
+// blob value at valuePos in fileName. The caller holds mu.
+func (c *bitcask) blobLive(bucket uint32, key, fileName string, valuePos int64) (bool, error) {
+	set, err := c.lookup(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	return set != nil && set.Blob != nil && set.Blob.FileId == fileName && set.Blob.ValuePosition == valuePos, nil
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func blobFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func largeValue(i int) string {
+	return strings.Repeat(fmt.Sprintf("large-%d ", i), 1024)
+}
+
+func TestBlobSeparation(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithBlobThreshold(1024))
+	if err := e.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := e.Put(fmt.Sprintf("large-%d", i), largeValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	streamed := largeValue(9)
+	if err := e.PutReader("streamed", strings.NewReader(streamed), int64(len(streamed))); err != nil {
+		t.Fatal(err)
+	}
+	check := func(e Engine) {
+		t.Helper()
+		if v, err := e.Get("small"); err != nil || v != "value" {
+			t.Errorf("Get(small) = %q, %v", v, err)
+		}
+		for i := 0; i < 3; i++ {
+			if v, err := e.Get(fmt.Sprintf("large-%d", i)); err != nil || v != largeValue(i) {
+				t.Errorf("Get(large-%d) = %d bytes, %v", i, len(v), err)
+			}
+		}
+		r, err := e.GetReader("streamed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if got, err := io.ReadAll(r); err != nil || string(got) != streamed {
+			t.Errorf("GetReader(streamed) read %d bytes, %v", len(got), err)
+		}
+	}
+	check(e)
+
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ActiveFileSize > 1024 {
+		t.Errorf("data file holds %d bytes, want only pointers", stats.ActiveFileSize)
+	}
+	if len(stats.BlobFiles) != 1 || stats.BlobFiles[0].LiveBytes < int64(4*len(streamed)) {
+		t.Errorf("blob files = %+v", stats.BlobFiles)
+	}
+	e.Close()
+
+	// blob values stay readable without the option
+	e = openTestEngine(t, dir)
+	check(e)
+	reopened, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalFileStats(reopened.BlobFiles, stats.BlobFiles) {
+		t.Errorf("blob files after reopen = %+v, want %+v", reopened.BlobFiles, stats.BlobFiles)
+	}
+}
+
+func equalFileStats(a, b []FileStats) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBlobMerge(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithBlobThreshold(1024))
+	for i := 0; i < 4; i++ {
+		if err := e.Put(fmt.Sprintf("large-%d", i), largeValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	blobs := blobFiles(t, dir)
+	if len(blobs) != 1 {
+		t.Fatalf("blob files = %v", blobs)
+	}
+	sealed, err := os.ReadFile(blobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// churning small keys merges the data files but leaves the blobs alone
+	e = openTestEngine(t, dir, WithBlobThreshold(1024))
+	for i := 0; i < 20; i++ {
+		if err := e.Put("small", fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(blobs[0]); err != nil || !bytes.Equal(data, sealed) {
+		t.Fatalf("sealed blob file changed by merge: %v", err)
+	}
+
+	// once most of the blob file is dead it is compacted
+	if err := e.Delete("large-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("large-1", "now small"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("large-2", largeValue(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobs[0]); !os.IsNotExist(err) {
+		t.Fatalf("compacted blob file still exists: %v", err)
+	}
+	check := func(e Engine) {
+		t.Helper()
+		want := map[string]string{"large-1": "now small", "large-2": largeValue(20), "large-3": largeValue(3), "small": "value-19"}
+		for key, value := range want {
+			if v, err := e.Get(key); err != nil || v != value {
+				t.Errorf("Get(%s) = %d bytes, %v", key, len(v), err)
+			}
+		}
+		if _, err := e.Get("large-0"); err != ErrKeyNotFound {
+			t.Errorf("Get(large-0) error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+	check(e)
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range stats.BlobFiles {
+		if fs.DeadBytes != 0 {
+			t.Errorf("%s: dead bytes after merge = %d", fs.Name, fs.DeadBytes)
+		}
+	}
+	e.Close()
+	check(openTestEngine(t, dir))
+}
+
+func TestBlobEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: make([]byte, 32)}}
+	e := openTestEngine(t, dir, WithBlobThreshold(1024), WithEncryption(keys))
+	for i := 0; i < 2; i++ {
+		if err := e.Put(fmt.Sprintf("large-%d", i), largeValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+
+	keys.keys[2] = []byte(strings.Repeat("k", 32))
+	keys.current = 2
+	e = openTestEngine(t, dir, WithBlobThreshold(1024), WithEncryption(keys), WithMergePolicy(MergePolicy{BlobDeadRatio: 0.4}))
+	if err := e.Delete("large-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	set, err := e.(*bitcask).index.Get("large-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Blob == nil || set.Blob.KeyId != 2 {
+		t.Fatalf("blob after merge = %+v, want encrypted under key 2", set.Blob)
+	}
+	e.Close()
+
+	delete(keys.keys, 1)
+	e = openTestEngine(t, dir, WithEncryption(keys))
+	if v, err := e.Get("large-1"); err != nil || v != largeValue(1) {
+		t.Errorf("Get(large-1) = %d bytes, %v", len(v), err)
+	}
+}
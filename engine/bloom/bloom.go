@@ -0,0 +1,145 @@
+// Package bloom implements a Bloom filter over string keys, with a stable
+// hash so filters can be persisted.
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+)
+
+var ErrCorruptFilter = errors.New("corrupt bloom filter")
+
+var magic = []byte("BLM1")
+
+// Filter answers whether a key may have been added. It has no false
+// negatives, and false positives at about the rate it was created with
+// until more than its capacity of keys are added.
+//
+// Add must not run concurrently with other methods; MayContain may.
+type Filter struct {
+	bits     []uint64
+	k        uint32
+	capacity uint64
+	count    uint64
+	rate     float64
+}
+
+// New returns a filter sized for capacity keys at a false positive rate of
+// rate.
+func New(capacity uint64, rate float64) *Filter {
+	if capacity == 0 {
+		capacity = 1
+	}
+	// m = -n ln(p) / ln(2)^2 bits and k = m/n ln(2) hashes
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	words := (m + 63) / 64
+	k := uint32(math.Round(float64(words*64) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Filter{
+		bits:     make([]uint64, words),
+		k:        k,
+		capacity: capacity,
+		rate:     rate,
+	}
+}
+
+// hash returns two independent 64 bit hashes of key: FNV-1a, and the
+// murmur3 finaliser of it.
+func hash(key string) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	g := h
+	g ^= g >> 33
+	g *= 0xff51afd7ed558ccd
+	g ^= g >> 33
+	g *= 0xc4ceb9fe1a85ec53
+	g ^= g >> 33
+	return h, g | 1
+}
+
+func (f *Filter) Add(key string) {
+	h, g := hash(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.k; i++ {
+		bit := (h + uint64(i)*g) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+// MayContain reports false if key was certainly never added.
+func (f *Filter) MayContain(key string) bool {
+	h, g := hash(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.k; i++ {
+		bit := (h + uint64(i)*g) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Full reports whether more keys than the filter's capacity were added.
+func (f *Filter) Full() bool {
+	return f.count > f.capacity
+}
+
+// Size returns the size of the filter's bit array in bytes.
+func (f *Filter) Size() int64 {
+	return int64(len(f.bits)) * 8
+}
+
+// Rate returns the false positive rate the filter was created with.
+func (f *Filter) Rate() float64 {
+	return f.rate
+}
+
+// | magic 4 | k 4 | capacity 8 | count 8 | rate 8 | words 8 | bits | crc 4 |
+const headerSize = 4 + 4 + 8 + 8 + 8 + 8
+
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, headerSize+len(f.bits)*8+4)
+	copy(buf, magic)
+	binary.BigEndian.PutUint32(buf[4:], f.k)
+	binary.BigEndian.PutUint64(buf[8:], f.capacity)
+	binary.BigEndian.PutUint64(buf[16:], f.count)
+	binary.BigEndian.PutUint64(buf[24:], math.Float64bits(f.rate))
+	binary.BigEndian.PutUint64(buf[32:], uint64(len(f.bits)))
+	for i, word := range f.bits {
+		binary.BigEndian.PutUint64(buf[headerSize+i*8:], word)
+	}
+	end := len(buf) - 4
+	binary.BigEndian.PutUint32(buf[end:], crc32.ChecksumIEEE(buf[:end]))
+	return buf, nil
+}
+
+func (f *Filter) UnmarshalBinary(buf []byte) error {
+	if len(buf) < headerSize+4 || string(buf[:4]) != string(magic) {
+		return ErrCorruptFilter
+	}
+	words := binary.BigEndian.Uint64(buf[32:])
+	if words == 0 || uint64(len(buf)-headerSize-4)/8 != words || uint64(len(buf)-headerSize-4)%8 != 0 {
+		return ErrCorruptFilter
+	}
+	end := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:end]) != binary.BigEndian.Uint32(buf[end:]) {
+		return ErrCorruptFilter
+	}
+	f.k = binary.BigEndian.Uint32(buf[4:])
+	f.capacity = binary.BigEndian.Uint64(buf[8:])
+	f.count = binary.BigEndian.Uint64(buf[16:])
+	f.rate = math.Float64frombits(binary.BigEndian.Uint64(buf[24:]))
+	f.bits = make([]uint64, words)
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(buf[headerSize+i*8:])
+	}
+	return nil
+}
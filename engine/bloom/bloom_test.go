@@ -0,0 +1,65 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.01, 0.001} {
+		f := New(10000, rate)
+		for i := 0; i < 10000; i++ {
+			f.Add("key-" + strconv.Itoa(i))
+		}
+		if f.Full() {
+			t.Errorf("filter full at capacity")
+		}
+		for i := 0; i < 10000; i++ {
+			if !f.MayContain("key-" + strconv.Itoa(i)) {
+				t.Fatalf("false negative for key-%d", i)
+			}
+		}
+		positives := 0
+		const lookups = 100000
+		for i := 0; i < lookups; i++ {
+			if f.MayContain("missing-" + strconv.Itoa(i)) {
+				positives++
+			}
+		}
+		if got := float64(positives) / lookups; got > 1.5*rate {
+			t.Errorf("false positive rate = %f, want about %f", got, rate)
+		}
+		f.Add("one more")
+		if !f.Full() {
+			t.Errorf("filter not full past capacity")
+		}
+	}
+}
+
+func TestFilterMarshal(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := 0; i < 500; i++ {
+		f.Add(strconv.Itoa(i))
+	}
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g Filter
+	if err := g.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if !g.MayContain(strconv.Itoa(i)) {
+			t.Fatalf("unmarshalled filter lost %d", i)
+		}
+	}
+	if g.Rate() != f.Rate() || g.count != f.count || g.capacity != f.capacity || g.k != f.k {
+		t.Errorf("unmarshalled filter = %+v, want %+v", g, *f)
+	}
+
+	buf[len(buf)/2] ^= 1
+	if err := g.UnmarshalBinary(buf); err != ErrCorruptFilter {
+		t.Errorf("UnmarshalBinary() of a damaged filter error = %v, want %v", err, ErrCorruptFilter)
+	}
+}
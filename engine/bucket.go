@@ -0,0 +1,381 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/machinly/bitcask/engine/index"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+// Buckets are namespaces within one database. Each has its own keydir and
+// its records carry its id, while the data files, the sequence numbers and
+// merging are shared. The engine itself is the default bucket, which has
+// id 0 and whose records carry no id, so databases written before buckets
+// existed are all default bucket.
+//
+// The names are kept in the catalog, a bucket of its own with a record per
+// bucket id. A catalog record is never deleted, only overwritten to drop
+// its bucket, so ids aren't reused while records of a dropped bucket may
+// still be in the files. With a disk index, the named buckets and the
+// catalog each have an index file of their own, see newKeydir.
+
+const (
+	// DEFAULT_BUCKET is the name of the bucket the engine itself is.
+	DEFAULT_BUCKET = "default"
+	// MAX_BUCKET_NAME_SIZE bounds the length of a bucket name.
+	MAX_BUCKET_NAME_SIZE = 255
+)
+
+// catalogBucket is the id of the catalog, whose keys are the bucket ids in
+// decimal and whose values are bucketEntry in JSON.
+const catalogBucket = math.MaxUint32
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrInvalidBucket  = errors.New("invalid bucket name")
+)
+
+type bucketEntry struct {
+	Name    string
+	Dropped bool `json:",omitempty"`
+}
+
+// bucket is a handle on a bucket. The Engine methods of bitcask are those
+// of its default bucket.
+type bucket struct {
+	c    *bitcask
+	id   uint32
+	name string
+}
+
+var _ Engine = (*bucket)(nil)
+
+// Bucket returns the bucket called name, creating it if it doesn't exist.
+// The bucket shares the engine's files: Merge, Sync and Close act on the
+// whole database, whichever bucket they are called on. DEFAULT_BUCKET is
+// the engine itself.
+func (c *bitcask) Bucket(name string) (Engine, error) {
+	if name == DEFAULT_BUCKET {
+		return c, nil
+	}
+	if name == "" || len(name) > MAX_BUCKET_NAME_SIZE {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidBucket, name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if id, ok := c.buckets[name]; ok {
+		return &bucket{c: c, id: id, name: name}, nil
+	}
+	if c.readOnly || c.replica {
+		return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	if c.lastBucket+1 == catalogBucket {
+		return nil, fmt.Errorf("%w: %s: no bucket ids left", ErrInvalidBucket, name)
+	}
+	id := c.lastBucket + 1
+	err := c.writeCatalog(id, bucketEntry{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{c: c, id: id, name: name}, nil
+}
+
+// DropBucket deletes the bucket called name and all its keys at once. The
+// space they take is reclaimed by merges.
+func (c *bitcask) DropBucket(name string) error {
+	if name == DEFAULT_BUCKET {
+		return fmt.Errorf("%w: %s can't be dropped", ErrInvalidBucket, name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	id, ok := c.buckets[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	return c.writeCatalog(id, bucketEntry{Name: name, Dropped: true})
+}
+
+// ListBuckets returns the names of the buckets, the default one included,
+// in order.
+func (c *bitcask) ListBuckets() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	names := []string{DEFAULT_BUCKET}
+	for name := range c.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+// writeCatalog writes the catalog record of bucket id. The caller holds
+// mu.
+func (c *bitcask) writeCatalog(id uint32, entry bucketEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	opts, err := c.recordOptions(catalogBucket)
+	if err != nil {
+		return err
+	}
+	r, err := record.NewRecordV2(c.seq+1, strconv.FormatUint(uint64(id), 10), string(value), opts...)
+	if err != nil {
+		return err
+	}
+	return c.putRecord(r)
+}
+
+// resetBuckets empties the catalog and the keydirs of the named buckets,
+// removing their index files. The caller holds mu.
+func (c *bitcask) resetBuckets() error {
+	err := closeKeydirs(c.keydirs, nil)
+	if err != nil {
+		return err
+	}
+	if c.diskIndex {
+		files, err := filepath.Glob(filepath.Join(c.blobDir, BUCKET_INDEX_PREFIX+"*"))
+		if err != nil {
+			return err
+		}
+		for _, fileName := range files {
+			err = os.Remove(fileName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	kd, err := c.newKeydir(catalogBucket)
+	if err != nil {
+		return err
+	}
+	c.keydirs = map[uint32]index.Index{catalogBucket: kd}
+	c.catalog = make(map[uint32]bucketEntry)
+	c.buckets = make(map[string]uint32)
+	c.lastBucket = 0
+	return nil
+}
+
+// keydir returns the keydir of bucket, nil if there is none. The caller
+// holds mu.
+func (c *bitcask) keydir(bucket uint32) index.Index {
+	if bucket == 0 {
+		return c.index
+	}
+	return c.keydirs[bucket]
+}
+
+// applyCatalog registers or drops the bucket of a catalog record that was
+// just added to the catalog's keydir. The caller holds mu.
+func (c *bitcask) applyCatalog(r record.Record) error {
+	invalid := &ErrCorruptRecord{Reason: "invalid bucket catalog entry"}
+	id, err := strconv.ParseUint(r.Key(), 10, 32)
+	if err != nil || id == 0 || id == catalogBucket {
+		return invalid
+	}
+	value, err := r.DecodeValue(c.keyring())
+	if err != nil {
+		return err
+	}
+	var entry bucketEntry
+	if json.Unmarshal([]byte(value), &entry) != nil || entry.Name == "" {
+		return invalid
+	}
+	bucket := uint32(id)
+	c.catalog[bucket] = entry
+	if bucket > c.lastBucket {
+		c.lastBucket = bucket
+	}
+	current, ok := c.buckets[entry.Name]
+	if entry.Dropped {
+		// a merge may have copied the record after that of a newer bucket
+		// of the same name
+		if ok && current == bucket {
+			delete(c.buckets, entry.Name)
+		}
+		c.dropKeydir(bucket)
+		return nil
+	}
+	if !ok || current < bucket {
+		c.buckets[entry.Name] = bucket
+	}
+	if c.keydirs[bucket] == nil {
+		kd, err := c.newKeydir(bucket)
+		if err != nil {
+			return err
+		}
+		c.keydirs[bucket] = kd
+	}
+	return nil
+}
+
+// dropKeydir forgets the keys of bucket, accounting their records as
+// garbage, and ends its subscriptions. The caller holds mu.
+func (c *bitcask) dropKeydir(bucket uint32) {
+	kd := c.keydirs[bucket]
+	if kd == nil {
+		return
+	}
+	delete(c.keydirs, bucket)
+	_ = kd.Range(func(key string, set *index.Set) bool {
+		c.markDead(bucket, key, *set, nil)
+		c.cache.remove(cacheKey(bucket, key))
+		return true
+	})
+	if p, ok := kd.(index.Persistent); ok {
+		// a leftover file is removed by the next replay
+		_ = p.Close()
+		_ = os.Remove(c.keydirFile(bucket))
+	}
+	for s := range c.subscribers {
+		if s.bucket == bucket {
+			c.unsubscribe(s, fmt.Errorf("%w: %s", ErrBucketNotFound, c.catalog[bucket].Name))
+		}
+	}
+}
+
+// dropOrphans drops the keydirs of buckets the catalog doesn't name, which
+// replaying the files can leave when a record is damaged. The caller holds
+// mu.
+func (c *bitcask) dropOrphans() {
+	for bucket := range c.keydirs {
+		if _, ok := c.catalog[bucket]; !ok && bucket != catalogBucket {
+			c.dropKeydir(bucket)
+		}
+	}
+}
+
+// cacheKey returns the value cache key of key in bucket. It is key itself
+// for most keys of the default bucket, and otherwise starts with a zero
+// byte and the bucket id, which a plain key doesn't.
+func cacheKey(bucket uint32, key string) string {
+	if bucket == 0 && (key == "" || key[0] != 0) {
+		return key
+	}
+	var buf [1 + binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(buf[1:], uint64(bucket))
+	return string(buf[:1+n]) + key
+}
+
+// checkOpen fails once the engine is closed or the bucket dropped. The
+// caller holds mu.
+func (b *bucket) checkOpen() error {
+	if b.c.closed {
+		return ErrClosed
+	}
+	if b.c.keydir(b.id) == nil {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, b.name)
+	}
+	return nil
+}
+
+// checkWritable is checkOpen for writes. The caller holds mu.
+func (b *bucket) checkWritable() error {
+	err := b.c.checkWritable()
+	if err != nil {
+		return err
+	}
+	return b.checkOpen()
+}
+
+func (b *bucket) Bucket(name string) (Engine, error) {
+	return b.c.Bucket(name)
+}
+
+func (b *bucket) DropBucket(name string) error {
+	return b.c.DropBucket(name)
+}
+
+func (b *bucket) ListBuckets() ([]string, error) {
+	return b.c.ListBuckets()
+}
+
+func (b *bucket) Merge() error {
+	return b.c.Merge()
+}
+
+func (b *bucket) Sync() bool {
+	return b.c.Sync()
+}
+
+func (b *bucket) Close() bool {
+	return b.c.Close()
+}
+
+func (c *bitcask) Put(key, value string) error {
+	return c.defaultBucket.Put(key, value)
+}
+
+func (c *bitcask) Get(key string) (string, error) {
+	return c.defaultBucket.Get(key)
+}
+
+func (c *bitcask) Delete(key string) error {
+	return c.defaultBucket.Delete(key)
+}
+
+func (c *bitcask) PutReader(key string, value io.Reader, size int64) error {
+	return c.defaultBucket.PutReader(key, value, size)
+}
+
+func (c *bitcask) GetReader(key string) (io.ReadCloser, error) {
+	return c.defaultBucket.GetReader(key)
+}
+
+func (c *bitcask) Has(key string) (bool, error) {
+	return c.defaultBucket.Has(key)
+}
+
+func (c *bitcask) MultiGet(keys []string) (map[string]string, error) {
+	return c.defaultBucket.MultiGet(keys)
+}
+
+func (c *bitcask) CompareAndSwap(key, old, new string) (bool, error) {
+	return c.defaultBucket.CompareAndSwap(key, old, new)
+}
+
+func (c *bitcask) PutIfAbsent(key, value string) (bool, error) {
+	return c.defaultBucket.PutIfAbsent(key, value)
+}
+
+func (c *bitcask) DeleteIfEquals(key, value string) (bool, error) {
+	return c.defaultBucket.DeleteIfEquals(key, value)
+}
+
+func (c *bitcask) Incr(key string, delta int64) (int64, error) {
+	return c.defaultBucket.Incr(key, delta)
+}
+
+func (c *bitcask) Append(key, suffix string) error {
+	return c.defaultBucket.Append(key, suffix)
+}
+
+func (c *bitcask) Subscribe(fromSeq uint64) (Subscription, error) {
+	return c.defaultBucket.Subscribe(fromSeq)
+}
+
+func (c *bitcask) ListKeys() ([]string, error) {
+	return c.defaultBucket.ListKeys()
+}
+
+func (c *bitcask) Stats() (Stats, error) {
+	return c.defaultBucket.Stats()
+}
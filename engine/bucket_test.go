@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/machinly/bitcask/engine/record"
+)
+
+func openTestBucket(t *testing.T, e Engine, name string) Engine {
+	t.Helper()
+	b, err := e.Bucket(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBucket(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithValueCache(1<<20), WithBlobThreshold(64))
+	users := openTestBucket(t, e, "users")
+	blob := strings.Repeat("b", 100)
+	for _, err := range []error{
+		e.Put("a", "default"),
+		users.Put("a", "users"),
+		users.Put("blob", blob),
+		users.Put("gone", "1"),
+		users.Delete("gone"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := users.Incr("n", 2); err != nil || n != 2 {
+		t.Errorf("bucket Incr() = %d, %v", n, err)
+	}
+	check := func(e, users Engine) {
+		t.Helper()
+		for _, tt := range []struct {
+			e     Engine
+			key   string
+			value string
+		}{{e, "a", "default"}, {users, "a", "users"}, {users, "blob", blob}, {users, "n", "2"}} {
+			if v, err := tt.e.Get(tt.key); err != nil || v != tt.value {
+				t.Errorf("Get(%q) = %q, %v, want %q", tt.key, v, err, tt.value)
+			}
+		}
+		if _, err := users.Get("gone"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get() of a deleted key error = %v", err)
+		}
+		if _, err := e.Get("n"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get() of another bucket's key error = %v", err)
+		}
+		if keys, _ := users.ListKeys(); len(keys) != 3 {
+			t.Errorf("bucket ListKeys() = %v", keys)
+		}
+		if stats, _ := e.Stats(); stats.Keys != 1 {
+			t.Errorf("default bucket Stats().Keys = %d, want 1", stats.Keys)
+		}
+		if names, _ := e.ListBuckets(); !reflect.DeepEqual(names, []string{DEFAULT_BUCKET, "users"}) {
+			t.Errorf("ListBuckets() = %v", names)
+		}
+	}
+	check(e, users)
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	check(e, openTestBucket(t, e, "users"))
+	e.Close()
+	e = openTestEngine(t, dir, WithReadOnly())
+	check(e, openTestBucket(t, e, "users"))
+	if _, err := e.Bucket("new"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("read-only Bucket() of a new bucket error = %v, want %v", err, ErrBucketNotFound)
+	}
+	if d, err := e.Bucket(DEFAULT_BUCKET); err != nil || d != e {
+		t.Errorf("Bucket(DEFAULT_BUCKET) = %v, %v, want the engine", d, err)
+	}
+	if _, err := e.Bucket(""); !errors.Is(err, ErrInvalidBucket) {
+		t.Errorf("Bucket(\"\") error = %v, want %v", err, ErrInvalidBucket)
+	}
+}
+
+func TestDropBucket(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	users := openTestBucket(t, e, "users")
+	for i := 0; i < 10; i++ {
+		if err := users.Put(fmt.Sprint(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := users.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvents(t, s, 10)
+
+	if err := e.DropBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("1"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Get() from a dropped bucket error = %v, want %v", err, ErrBucketNotFound)
+	}
+	if err := users.Put("1", "v"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Put() to a dropped bucket error = %v, want %v", err, ErrBucketNotFound)
+	}
+	for range s.Events() {
+	}
+	if !errors.Is(s.Err(), ErrBucketNotFound) {
+		t.Errorf("subscription Err() after the drop = %v, want %v", s.Err(), ErrBucketNotFound)
+	}
+	if err := e.DropBucket("users"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("DropBucket() again error = %v, want %v", err, ErrBucketNotFound)
+	}
+	if err := e.DropBucket(DEFAULT_BUCKET); !errors.Is(err, ErrInvalidBucket) {
+		t.Errorf("DropBucket(DEFAULT_BUCKET) error = %v, want %v", err, ErrInvalidBucket)
+	}
+
+	// a bucket of the same name starts empty
+	users = openTestBucket(t, e, "users")
+	if keys, _ := users.ListKeys(); len(keys) != 0 {
+		t.Errorf("ListKeys() of a recreated bucket = %v", keys)
+	}
+	if err := users.Put("new", "v"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	bc := e.(*bitcask)
+	sealed := bc.dbFile.FileList()[0]
+	if ratio := bc.files[sealed].deadRatio(); ratio < 0.5 {
+		t.Errorf("dead ratio with a dropped bucket = %v", ratio)
+	}
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if dead := bc.files[bc.dbFile.CurrentFile()].deadBytes; dead != 0 {
+		t.Errorf("dead bytes after merge = %d, want 0", dead)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	users = openTestBucket(t, e, "users")
+	if keys, _ := users.ListKeys(); !reflect.DeepEqual(keys, []string{"new"}) {
+		t.Errorf("ListKeys() after merge = %v", keys)
+	}
+	if v, err := e.Get("a"); err != nil || v != "1" {
+		t.Errorf("default bucket Get() after merge = %q, %v", v, err)
+	}
+}
+
+func TestCatalogCorruptSize(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	openTestBucket(t, e, "users")
+	e.Close()
+
+	// a catalog record, which replaying reads whole, announcing a value
+	// far larger than the file
+	buf := make([]byte, 4*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, math.MaxUint32)
+	n += binary.PutUvarint(buf[n:], 100)
+	n += binary.PutVarint(buf[n:], 0)
+	n += binary.PutUvarint(buf[n:], 1)
+	n += binary.PutUvarint(buf[n:], 1<<62)
+	rec := append([]byte{record.V2_VERSION, 0, 0, 0, 0, record.V2_BUCKET}, buf[:n]...)
+	rec = append(rec, "1{}"...)
+	files := dataFiles(t, dir)
+	f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := OpenBitcaskEngine(dir); !errors.Is(err, &ErrCorruptRecord{}) {
+		t.Errorf("OpenBitcaskEngine() error = %v, want corrupt record", err)
+	}
+}
+
+func TestBucketReplication(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	_, addr := startLeader(t, e, "127.0.0.1:0")
+	f := openTestFollower(t, t.TempDir(), addr)
+	users := openTestBucket(t, e, "users")
+	if err := users.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, f, 2)
+	replica := openTestBucket(t, f, "users")
+	if v, err := replica.Get("a"); err != nil || v != "1" {
+		t.Errorf("follower bucket Get() = %q, %v", v, err)
+	}
+	if err := e.DropBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, f, 3)
+	if _, err := replica.Get("a"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("follower Get() from a dropped bucket error = %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	CACHE_SHARDS = 16
+	// CACHE_ENTRY_OVERHEAD approximates the memory of a cache entry besides
+	// its key and value: the list element, the entry and the map slot.
+	CACHE_ENTRY_OVERHEAD = 48 + 48 + 32
+)
+
+// valueCache is a sharded LRU cache of values, bounded in bytes. The engine
+// invalidates a key whenever its keydir entry changes, under mu, so a value
+// inserted by a Get, which holds mu for reading, is never stale. A nil
+// *valueCache caches nothing.
+type valueCache struct {
+	hits   int64
+	misses int64
+	shards [CACHE_SHARDS]cacheShard
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // of *cacheEntry, most recently used at the front
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key   string
+	value string
+}
+
+func newValueCache(capacity int64) *valueCache {
+	c := &valueCache{}
+	for i := range c.shards {
+		c.shards[i] = cacheShard{
+			capacity: capacity / CACHE_SHARDS,
+			lru:      list.New(),
+			entries:  make(map[string]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *valueCache) shard(key string) *cacheShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &c.shards[h.Sum32()%CACHE_SHARDS]
+}
+
+func entrySize(key, value string) int64 {
+	return int64(len(key)+len(value)) + CACHE_ENTRY_OVERHEAD
+}
+
+func (c *valueCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return "", false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// put caches value, evicting the least recently used entries of its shard
+// to make room. Values larger than a shard are not cached.
+func (c *valueCache) put(key, value string) {
+	if c == nil {
+		return
+	}
+	s := c.shard(key)
+	size := entrySize(key, value)
+	if size > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, value: value})
+	s.size += size
+	for s.size > s.capacity {
+		s.removeLocked(s.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *cacheShard) removeLocked(key string) {
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry := s.lru.Remove(e).(*cacheEntry)
+	delete(s.entries, key)
+	s.size -= entrySize(entry.key, entry.value)
+}
+
+// stats returns the capacity, current size, hits and misses of the cache.
+func (c *valueCache) stats() (capacity, size, hits, misses int64) {
+	if c == nil {
+		return 0, 0, 0, 0
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		capacity += s.capacity
+		size += s.size
+		s.mu.Unlock()
+	}
+	return capacity, size, atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
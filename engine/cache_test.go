@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	c := newValueCache(CACHE_SHARDS * (CACHE_ENTRY_OVERHEAD + 100))
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 50))
+	}
+	capacity, size, _, _ := c.stats()
+	if size > capacity {
+		t.Errorf("cache size %d exceeds capacity %d", size, capacity)
+	}
+	if _, ok := c.get("key-999"); !ok {
+		t.Error("most recent entry was evicted")
+	}
+	if _, ok := c.get("key-0"); ok {
+		t.Error("oldest entry was not evicted")
+	}
+	c.put("huge", strings.Repeat("v", 1000))
+	if _, ok := c.get("huge"); ok {
+		t.Error("entry larger than a shard was cached")
+	}
+	c.remove("key-999")
+	if _, ok := c.get("key-999"); ok {
+		t.Error("removed entry is still cached")
+	}
+	if _, _, hits, misses := c.stats(); hits != 1 || misses != 3 {
+		t.Errorf("hits, misses = %d, %d, want 1, 3", hits, misses)
+	}
+
+	var disabled *valueCache
+	disabled.put("a", "1")
+	if _, ok := disabled.get("a"); ok {
+		t.Error("nil cache returned a value")
+	}
+}
+
+func TestEngineValueCache(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbage(t, dir)
+	e := openTestEngine(t, dir, WithValueCache(1<<20))
+	get := func(key, want string) {
+		t.Helper()
+		if v, err := e.Get(key); err != nil || v != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+	get("key-0", "value-0-4")
+	get("key-0", "value-0-4")
+	if err := e.Put("key-0", "new"); err != nil {
+		t.Fatal(err)
+	}
+	get("key-0", "new")
+	get("key-1", "value-1-4")
+	if err := e.Delete("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get("key-1"); err != ErrKeyNotFound {
+		t.Fatalf("Get(key-1) after Delete error = %v", err)
+	}
+	get("key-2", "value-2-4")
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	// merge moved the value and dropped the cached copy
+	get("key-2", "value-2-4")
+
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHits != 1 || stats.CacheMisses != 5 || stats.CacheBytes == 0 {
+		t.Errorf("cache stats = %d hits, %d misses, %d bytes", stats.CacheHits, stats.CacheMisses, stats.CacheBytes)
+	}
+}
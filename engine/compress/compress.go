@@ -0,0 +1,85 @@
+// Package compress implements the value codecs a record can be stored
+// with.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type Codec byte
+
+const (
+	// None stores values as they are.
+	None Codec = 0
+	// Snappy is a fast LZ77 codec using the snappy block format.
+	Snappy Codec = 1
+	// Deflate trades speed for ratio, compressing at flate.BestCompression.
+	Deflate Codec = 2
+)
+
+var (
+	ErrUnknownCodec = errors.New("unknown compression codec")
+	ErrCorrupt      = errors.New("corrupt compressed data")
+)
+
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Deflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+func Encode(c Codec, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case Snappy:
+		return snappyEncode(src), nil
+	case Deflate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(src)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, c)
+	}
+}
+
+func Decode(c Codec, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case Snappy:
+		return snappyDecode(src)
+	case Deflate:
+		r := flate.NewReader(bytes.NewReader(src))
+		defer r.Close()
+		dst, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return dst, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, c)
+	}
+}
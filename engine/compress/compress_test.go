@@ -0,0 +1,84 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func testInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 70000)
+	rnd.Read(random)
+	json := strings.Repeat(`{"id":12345,"name":"bitcask","tags":["kv","log"],"active":true},`, 2000)
+	return map[string][]byte{
+		"empty":      {},
+		"tiny":       []byte("ab"),
+		"random":     random,
+		"repeated":   bytes.Repeat([]byte{'a'}, 100000),
+		"json":       []byte(json),
+		"short runs": []byte("abcdabcdabcdXabcdabcdYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYY"),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{None, Snappy, Deflate} {
+		for name, input := range testInputs() {
+			t.Run(codec.String()+"/"+name, func(t *testing.T) {
+				encoded, err := Encode(codec, input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := Decode(codec, encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded, input) {
+					t.Fatalf("Decode(Encode()) differs from input")
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	json := testInputs()["json"]
+	for _, codec := range []Codec{Snappy, Deflate} {
+		encoded, err := Encode(codec, json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ratio := float64(len(json)) / float64(len(encoded)); ratio < 5 {
+			t.Errorf("%s ratio on json = %.1f, want >= 5", codec, ratio)
+		}
+	}
+}
+
+func TestSnappyCorrupt(t *testing.T) {
+	valid := snappyEncode([]byte("abcdabcdabcdabcdabcd"))
+	tests := map[string][]byte{
+		"empty":           {},
+		"truncated":       valid[:len(valid)-1],
+		"length mismatch": append([]byte{50}, valid[1:]...),
+		"offset too far":  {8, 0x01 | 4<<2, 0xFF},
+		"literal overrun": {4, 10 << 2, 'a'},
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Decode(Snappy, input); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Decode() error = %v, want %v", err, ErrCorrupt)
+			}
+		})
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	if _, err := Encode(Codec(9), nil); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Encode() error = %v, want %v", err, ErrUnknownCodec)
+	}
+	if _, err := Decode(Codec(9), nil); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrUnknownCodec)
+	}
+}
@@ -0,0 +1,194 @@
+package compress
+
+import (
+	"encoding/binary"
+)
+
+// Snappy block format: the uvarint length of the decoded data followed by
+// a sequence of elements. The low two bits of an element's tag byte select
+// its kind:
+//
+//	00 literal, length-1 in the upper six bits, or 60-63 for a 1-4 byte
+//	   little-endian length-1 following the tag
+//	01 copy, length-4 in bits 2-4 and offset bits 8-10 in bits 5-7,
+//	   followed by the low byte of the offset
+//	10 copy, length-1 in the upper six bits, followed by a 2 byte offset
+//	11 copy, length-1 in the upper six bits, followed by a 4 byte offset
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+
+	snappyMinMatch  = 4
+	snappyHashBits  = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyHashBits)
+}
+
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6+8)
+	n := binary.PutUvarint(dst, uint64(len(src)))
+	dst = dst[:n]
+
+	if len(src) < snappyMinMatch {
+		return emitLiteral(dst, src)
+	}
+
+	var table [1 << snappyHashBits]int32
+	for i := range table {
+		table[i] = -1
+	}
+	lit := 0
+	i := 0
+	for i+snappyMinMatch <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := snappyHash(cur)
+		candidate := int(table[h])
+		table[h] = int32(i)
+		if candidate < 0 || i-candidate > snappyMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+
+		dst = emitLiteral(dst, src[lit:i])
+		length := snappyMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = emitCopy(dst, i-candidate, length)
+		i += length
+		lit = i
+	}
+	return emitLiteral(dst, src[lit:])
+}
+
+func emitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2)|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func emitCopy(dst []byte, offset, length int) []byte {
+	// long matches are split into copies of at most 64 bytes, keeping the
+	// last piece at least 4 bytes so it can still use the short form
+	for length >= 68 {
+		dst = append(dst, 63<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 4 && length < 12 && offset < 2048 {
+		return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|tagCopy1, byte(offset))
+	}
+	return append(dst, byte(length-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	dLen, n := binary.Uvarint(src)
+	if n <= 0 || dLen > uint64(len(src))*255 {
+		return nil, ErrCorrupt
+	}
+	src = src[n:]
+	dst := make([]byte, 0, dLen)
+
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 0x03 {
+		case tagLiteral:
+			length := int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrCorrupt
+				}
+				length = 0
+				for j := extra - 1; j >= 0; j-- {
+					length = length<<8 | int(src[j])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || length > len(src) || uint64(len(dst)+length) > dLen {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case tagCopy1:
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			length := 4 + int(tag>>2)&0x07
+			offset := int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+			var err error
+			dst, err = appendCopy(dst, offset, length, dLen)
+			if err != nil {
+				return nil, err
+			}
+		case tagCopy2:
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+			var err error
+			dst, err = appendCopy(dst, offset, length, dLen)
+			if err != nil {
+				return nil, err
+			}
+		case tagCopy4:
+			if len(src) < 5 {
+				return nil, ErrCorrupt
+			}
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+			var err error
+			dst, err = appendCopy(dst, offset, length, dLen)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if uint64(len(dst)) != dLen {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// appendCopy appends length bytes starting offset bytes back. The ranges
+// may overlap, which repeats the copied bytes.
+func appendCopy(dst []byte, offset, length int, dLen uint64) ([]byte, error) {
+	if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > dLen {
+		return nil, ErrCorrupt
+	}
+	start := len(dst) - offset
+	for j := 0; j < length; j++ {
+		dst = append(dst, dst[start+j])
+	}
+	return dst, nil
+}
@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"github.com/machinly/bitcask/engine/index"
+)
+
+// CompareAndSwap sets key to new if its value is old, and reports whether
+// it did. A missing key is never swapped.
+func (b *bucket) CompareAndSwap(key, old, new string) (bool, error) {
+	c := b.c
+	err := c.checkSize(key, int64(len(new)))
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return false, err
+	}
+	set, value, err := c.current(b.id, key)
+	if err != nil || set == nil || value != old {
+		return false, err
+	}
+	return true, c.put(b.id, key, new)
+}
+
+// PutIfAbsent sets key to value unless it exists, and reports whether it
+// did.
+func (b *bucket) PutIfAbsent(key, value string) (bool, error) {
+	c := b.c
+	err := c.checkSize(key, int64(len(value)))
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return false, err
+	}
+	_, err = c.find(b.id, key)
+	if err != ErrKeyNotFound {
+		return false, err
+	}
+	return true, c.put(b.id, key, value)
+}
+
+// DeleteIfEquals deletes key if its value is value, and reports whether it
+// did.
+func (b *bucket) DeleteIfEquals(key, value string) (bool, error) {
+	c := b.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return false, err
+	}
+	set, current, err := c.current(b.id, key)
+	if err != nil || set == nil || current != value {
+		return false, err
+	}
+	return true, c.delete(b.id, key, set)
+}
+
+// current returns the keydir entry and the value of key in bucket, a nil
+// entry if key doesn't exist. The caller holds mu.
+func (c *bitcask) current(bucket uint32, key string) (*index.Set, string, error) {
+	set, err := c.find(bucket, key)
+	if err == ErrKeyNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if value, ok := c.cache.get(cacheKey(bucket, key)); ok {
+		return set, value, nil
+	}
+	value, err := c.readValue(bucket, key, c.valueOf(*set))
+	if err != nil {
+		return nil, "", err
+	}
+	return set, value, nil
+}
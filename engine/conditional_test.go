@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	if ok, err := e.CompareAndSwap("a", "", "1"); err != nil || ok {
+		t.Errorf("CompareAndSwap() of a missing key = %v, %v, want false", ok, err)
+	}
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := e.CompareAndSwap("a", "2", "3"); err != nil || ok {
+		t.Errorf("CompareAndSwap() with the wrong value = %v, %v, want false", ok, err)
+	}
+	if ok, err := e.CompareAndSwap("a", "1", "2"); err != nil || !ok {
+		t.Errorf("CompareAndSwap() = %v, %v, want true", ok, err)
+	}
+	if v, err := e.Get("a"); err != nil || v != "2" {
+		t.Errorf("Get() = %q, %v, want %q", v, err, "2")
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if ok, err := e.PutIfAbsent("a", ""); err != nil || !ok {
+		t.Fatalf("PutIfAbsent() of an empty value = %v, %v, want true", ok, err)
+	}
+	if err := e.Put("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := e.CompareAndSwap("b", "1", ""); err != nil || !ok {
+		t.Fatalf("CompareAndSwap() to an empty value = %v, %v, want true", ok, err)
+	}
+	check := func(e Engine) {
+		t.Helper()
+		for _, key := range []string{"a", "b"} {
+			if v, err := e.Get(key); err != nil || v != "" {
+				t.Errorf("Get(%s) = %q, %v, want an empty value", key, v, err)
+			}
+		}
+		if ok, err := e.PutIfAbsent("a", "1"); err != nil || ok {
+			t.Errorf("PutIfAbsent() over an empty value = %v, %v, want false", ok, err)
+		}
+	}
+	check(e)
+	e.Close()
+	check(openTestEngine(t, dir))
+}
+
+func TestCompareAndSwapContention(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithValueCache(1<<20))
+	if err := e.Put("counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+	const workers, increments = 16, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				v, err := e.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(v)
+				ok, err := e.CompareAndSwap("counter", v, strconv.Itoa(n+1))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := e.Get("counter"); err != nil || v != strconv.Itoa(workers*increments) {
+		t.Errorf("counter = %q, %v, want %d", v, err, workers*increments)
+	}
+}
+
+func TestConditionalContention(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	const workers, keys = 16, 100
+	var puts, deletes int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for k := 0; k < keys; k++ {
+				key := "key-" + strconv.Itoa(k)
+				ok, err := e.PutIfAbsent(key, strconv.Itoa(w))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					atomic.AddInt64(&puts, 1)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if puts != keys {
+		t.Fatalf("%d PutIfAbsent calls succeeded, want %d", puts, keys)
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < keys; k++ {
+				key := "key-" + strconv.Itoa(k)
+				v, err := e.Get(key)
+				if err == ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ok, err := e.DeleteIfEquals(key, v)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					atomic.AddInt64(&deletes, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if deletes != keys {
+		t.Fatalf("%d DeleteIfEquals calls succeeded, want %d", deletes, keys)
+	}
+	if ok, err := e.DeleteIfEquals("key-0", "0"); err != nil || ok {
+		t.Errorf("DeleteIfEquals() of a deleted key = %v, %v, want false", ok, err)
+	}
+	if keys, err := e.ListKeys(); err != nil || len(keys) != 0 {
+		t.Errorf("ListKeys() = %v, %v, want none", keys, err)
+	}
+}
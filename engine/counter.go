@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Incr adds delta to the counter stored under key and returns the new
+// value. A missing key counts from zero.
+//
+// Counters are ordinary values holding the integer in decimal ASCII exactly
+// as strconv.FormatInt writes it: a minus sign only for negatives, no plus
+// sign and no padding. Get returns a counter as is and Put can set one.
+// Incr on a value in any other format, such as "+7" or "007", fails with
+// ErrNotInteger, and one that would leave the int64 range with
+// ErrOverflow.
+func (b *bucket) Incr(key string, delta int64) (int64, error) {
+	c := b.c
+	err := c.checkSize(key, 0)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return 0, err
+	}
+	set, value, err := c.current(b.id, key)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	if set != nil {
+		n, err = strconv.ParseInt(value, 10, 64)
+		// ParseInt also takes a plus sign and leading zeros
+		if err != nil || strconv.FormatInt(n, 10) != value {
+			return 0, fmt.Errorf("%w: %.20q", ErrNotInteger, value)
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: %d%+d", ErrOverflow, n, delta)
+	}
+	n += delta
+	return n, c.put(b.id, key, strconv.FormatInt(n, 10))
+}
+
+// Append adds suffix to the end of the value of key, creating it if it is
+// missing. The whole value is rewritten, so appending to a large value
+// costs as much as writing it.
+func (b *bucket) Append(key, suffix string) error {
+	c := b.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	_, value, err := c.current(b.id, key)
+	if err != nil {
+		return err
+	}
+	err = c.checkSize(key, int64(len(value)+len(suffix)))
+	if err != nil {
+		return err
+	}
+	return c.put(b.id, key, value+suffix)
+}
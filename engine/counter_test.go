@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIncr(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	for _, step := range []struct {
+		delta int64
+		want  int64
+	}{{1, 1}, {41, 42}, {-50, -8}} {
+		n, err := e.Incr("counter", step.delta)
+		if err != nil || n != step.want {
+			t.Fatalf("Incr(%d) = %d, %v, want %d", step.delta, n, err, step.want)
+		}
+	}
+	if v, err := e.Get("counter"); err != nil || v != "-8" {
+		t.Errorf("Get() = %q, %v, want %q", v, err, "-8")
+	}
+
+	for _, value := range []string{"abc", "+7", "007", "-0", " 7"} {
+		if err := e.Put("text", value); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Incr("text", 1); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("Incr() of %q error = %v, want %v", value, err, ErrNotInteger)
+		}
+		if v, err := e.Get("text"); err != nil || v != value {
+			t.Errorf("Get() after a failed Incr() = %q, %v, want %q", v, err, value)
+		}
+	}
+	if err := e.Put("max", strconv.FormatInt(math.MaxInt64, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Incr("max", 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Incr() past MaxInt64 error = %v, want %v", err, ErrOverflow)
+	}
+	if n, err := e.Incr("max", math.MinInt64); err != nil || n != -1 {
+		t.Errorf("Incr(MinInt64) = %d, %v, want -1", n, err)
+	}
+}
+
+func TestIncrContention(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithValueCache(1<<20))
+	const workers, increments = 16, 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if _, err := e.Incr("counter", 1); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := e.Append("log", "x"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := e.Get("counter"); err != nil || v != strconv.Itoa(workers*increments) {
+		t.Errorf("counter = %q, %v, want %d", v, err, workers*increments)
+	}
+	if v, err := e.Get("log"); err != nil || len(v) != workers*increments {
+		t.Errorf("log is %d bytes, %v, want %d", len(v), err, workers*increments)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithMaxValueSize(8))
+	if err := e.Append("a", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Append("a", "def"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := e.Get("a"); err != nil || v != "abcdef" {
+		t.Errorf("Get() = %q, %v, want %q", v, err, "abcdef")
+	}
+	if err := e.Append("a", "ghi"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Append() past the size limit error = %v, want %v", err, ErrValueTooLarge)
+	}
+}
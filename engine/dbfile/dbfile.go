@@ -1,19 +1,34 @@
 package dbfile
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	MAX_FILE_SIZE = 100 * 1024 * 1024 // 100MB
+	MAX_FILE_SIZE      = 100 * 1024 * 1024 // 100MB
+	STREAM_BUFFER_SIZE = 64 * 1024         // 64KB
+)
+
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrClosed       = errors.New("db file closed")
+	ErrReadOnly     = errors.New("db file is read-only")
+	ErrNotReplica   = errors.New("db file is not a replica")
 )
 
 type DBFile interface {
 	Write(p []byte) (fileName string, startPos int64, err error)
+	WriteStream(write func(w StreamWriter) error) (fileName string, startPos int64, err error)
 	Read(fileName string, offset int64, p []byte) (n int, err error)
 	ReadAll(fileName string, readFunc func(int64, io.Reader) error) (err error)
 	Close() error
@@ -21,62 +36,252 @@ type DBFile interface {
 	FileList() []string
 	CurrentFile() string
 	Remove(fileName string) error
+	Replicate(name string, offset int64, p []byte) (fileName string, err error)
+	Truncate(fileName string, size int64) error
+	Size(fileName string) (int64, error)
+	OpenFiles() int
+}
+
+// naming is how the files of a DBFile are named: prefix, id, extension.
+type naming struct {
+	prefix string
+	ext    string
 }
 
+var (
+	dataFiles = naming{prefix: "data-", ext: ".db"}
+	blobFiles = naming{prefix: "blob-", ext: ".blob"}
+)
+
 type dbFile struct {
-	fileMap     map[string]*os.File
+	naming naming
+	mu     sync.RWMutex
+	// files holds the absolute names of all files, sealed and active.
+	files   map[string]struct{}
+	handles *handleCache
+	// mapped holds the sealed files that are memory-mapped for reading.
+	mapped      map[string][]byte
 	currentFile *os.File
-	dir         string
+	// size is the size of the active file, buffered writes included.
+	size       int64
+	lastFileId int64
+	// buf holds writes to the end of the active file that haven't been
+	// written to it yet, at most bufSize bytes and for at most flushDelay.
+	buf        []byte
+	bufSize    int
+	flushDelay time.Duration
+	flushTimer *time.Timer
+	dir        string
+	closed     bool
+	// replica is set for a DBFile whose files are written by Replicate.
+	replica bool
+}
+
+func OpenDBFile(dir string, opts ...Option) (DBFile, error) {
+	return open(dir, dataFiles, opts)
+}
+
+// OpenReadOnlyDBFile opens the data files in dir without creating an active
+// file. Write on the result returns ErrReadOnly and the directory is never
+// modified.
+func OpenReadOnlyDBFile(dir string, opts ...Option) (DBFile, error) {
+	return openReadOnly(dir, dataFiles, opts)
+}
+
+// OpenReplicaDBFile opens the data files in dir as a copy of another
+// DBFile's. Like a read-only DBFile it has no active file, but Replicate and
+// Remove bring the files up to date with the original.
+func OpenReplicaDBFile(dir string, opts ...Option) (DBFile, error) {
+	return openReplica(dir, dataFiles, opts)
+}
+
+// OpenBlobFile opens the blob files in dir, which hold values kept apart
+// from the data files. They are managed like data files but named
+// blob-<id>.blob.
+func OpenBlobFile(dir string, opts ...Option) (DBFile, error) {
+	return open(dir, blobFiles, opts)
+}
+
+// OpenReadOnlyBlobFile is OpenReadOnlyDBFile for blob files.
+func OpenReadOnlyBlobFile(dir string, opts ...Option) (DBFile, error) {
+	return openReadOnly(dir, blobFiles, opts)
 }
 
-func OpenDBFile(dir string) (DBFile, error) {
-	newDbFileName := fmt.Sprintf("data-%d.db", time.Now().Unix())
-	currentFile, err := openWriteFile(dir, newDbFileName)
+// OpenReplicaBlobFile is OpenReplicaDBFile for blob files.
+func OpenReplicaBlobFile(dir string, opts ...Option) (DBFile, error) {
+	return openReplica(dir, blobFiles, opts)
+}
+
+func newDBFile(dir string, n naming, opts []Option) *dbFile {
+	o := options{maxOpenFiles: DEFAULT_MAX_OPEN_FILES}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &dbFile{
+		naming:     n,
+		handles:    newHandleCache(o.maxOpenFiles),
+		mapped:     make(map[string][]byte),
+		dir:        dir,
+		bufSize:    o.writeBuffer,
+		flushDelay: o.flushDelay,
+	}
+}
+
+func open(dir string, n naming, opts []Option) (DBFile, error) {
+	lastFileId, err := n.lastFileId(dir)
 	if err != nil {
 		return nil, err
 	}
-	fileMap, err := openReadFiles(dir, newDbFileName)
+	db := newDBFile(dir, n, opts)
+	db.lastFileId = lastFileId
+	newDbFileName := db.nextFileName()
+	db.currentFile, db.size, err = openWriteFile(dir, newDbFileName)
 	if err != nil {
 		return nil, err
 	}
-	return &dbFile{
-		fileMap:     fileMap,
-		currentFile: currentFile,
-		dir:         dir,
-	}, nil
+	db.files, err = listFiles(dir, n, newDbFileName, true)
+	if err != nil {
+		return nil, err
+	}
+	for fileName := range db.files {
+		if fileName != db.currentFile.Name() {
+			db.mapFile(fileName)
+		}
+	}
+	return db, nil
+}
+
+func openReadOnly(dir string, n naming, opts []Option) (DBFile, error) {
+	db := newDBFile(dir, n, opts)
+	var err error
+	db.files, err = listFiles(dir, n, "", false)
+	if err != nil {
+		return nil, err
+	}
+	for fileName := range db.files {
+		db.mapFile(fileName)
+	}
+	return db, nil
 }
 
-func openReadFiles(dirName, newDbFileName string) (map[string]*os.File, error) {
-	files := make(map[string]*os.File)
-	filepaths, err := filepath.Glob(dirName + "/*.db")
+func openReplica(dir string, n naming, opts []Option) (DBFile, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(abs, 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openReadOnly(abs, n, opts)
+	if err != nil {
+		return nil, err
+	}
+	db.(*dbFile).replica = true
+	return db, nil
+}
+
+// mapFile memory-maps a sealed file so reads from it need no syscall. The
+// mapping outlives the file handle, so mapped files don't count against
+// the open file limit. Files that can't be mapped are read with pread
+// instead. The caller holds db.mu or has the db to itself.
+func (db *dbFile) mapFile(fileName string) {
+	if !mmapSupported {
+		return
+	}
+	f, err := openReadFile(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.Size() == 0 || int64(int(stat.Size())) != stat.Size() {
+		return
+	}
+	data, err := mmap(f, int(stat.Size()))
+	if err != nil {
+		return
+	}
+	db.mapped[fileName] = data
+}
+
+// nextFileName names a new file. Ids are the creation time in seconds,
+// bumped when needed so that every file gets a distinct, increasing id.
+func (db *dbFile) nextFileName() string {
+	id := time.Now().Unix()
+	if id <= db.lastFileId {
+		id = db.lastFileId + 1
+	}
+	db.lastFileId = id
+	return fmt.Sprintf("%s%d%s", db.naming.prefix, id, db.naming.ext)
+}
+
+// fileId extracts the id from a file name, or returns false if the name
+// doesn't follow n.
+func (n naming) fileId(fileName string) (int64, bool) {
+	base := filepath.Base(fileName)
+	if !strings.HasPrefix(base, n.prefix) || !strings.HasSuffix(base, n.ext) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(base, n.prefix), n.ext), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// FileId returns the id in the name of a data or blob file. Ids increase
+// with the age of the files.
+func FileId(fileName string) (int64, bool) {
+	if id, ok := dataFiles.fileId(fileName); ok {
+		return id, true
+	}
+	return blobFiles.fileId(fileName)
+}
+
+func (n naming) glob(dirName string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dirName, "*"+n.ext))
+}
+
+func (n naming) lastFileId(dirName string) (int64, error) {
+	filepaths, err := n.glob(dirName)
+	if err != nil {
+		return 0, err
+	}
+	last := int64(0)
+	for _, fp := range filepaths {
+		if id, ok := n.fileId(fp); ok && id > last {
+			last = id
+		}
+	}
+	return last, nil
+}
+
+// listFiles returns the absolute names of the files in dirName. Files are
+// opened lazily, see handleCache.
+func listFiles(dirName string, n naming, newDbFileName string, removeEmpty bool) (map[string]struct{}, error) {
+	files := make(map[string]struct{})
+	filepaths, err := n.glob(dirName)
 	if err != nil {
 		return nil, err
 	}
 	for _, fp := range filepaths {
-		file, err := openReadFile(fp)
-		stat, err := file.Stat()
+		abs, err := filepath.Abs(fp)
 		if err != nil {
 			return nil, err
 		}
-		if stat.Size() == 0 && stat.Name() != newDbFileName {
-			err := file.Close()
-			if err != nil {
-				return nil, err
-			}
-			err = os.Remove(file.Name())
+		stat, err := os.Stat(abs)
+		if err != nil {
+			return nil, err
+		}
+		if removeEmpty && stat.Size() == 0 && stat.Name() != newDbFileName {
+			err = os.Remove(abs)
 			if err != nil {
 				return nil, err
 			}
 			continue
 		}
-		if err != nil {
-			return nil, err
-		}
-		files[file.Name()] = file
-	}
-
-	if err != nil {
-		return nil, err
+		files[abs] = struct{}{}
 	}
 	return files, nil
 }
@@ -93,110 +298,297 @@ func openReadFile(fp string) (*os.File, error) {
 	return file, nil
 }
 
-func openWriteFile(dirName string, fileId string) (*os.File, error) {
+// openWriteFile opens a file for appending and returns its size.
+func openWriteFile(dirName string, fileId string) (*os.File, int64, error) {
 	abs, err := filepath.Abs(dirName)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	err = os.MkdirAll(abs, 0755)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	file, err := os.OpenFile(filepath.Join(abs, fileId), os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	_, err = file.Seek(0, 2)
+	size, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
-		return nil, err
+		_ = file.Close()
+		return nil, 0, err
 	}
-
-	return file, nil
+	return file, size, nil
 }
 
+// Write appends p to the active file. With a write buffer, p may only be
+// written to the file by a later Write, Sync or Close, or once the flush
+// delay is up; Read sees it either way.
 func (db *dbFile) Write(p []byte) (fileName string, startPos int64, err error) {
-	stat, err := db.currentFile.Stat()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ret, err := db.activeFile()
 	if err != nil {
 		return "", 0, err
 	}
-	ret := stat.Size()
-	if ret > MAX_FILE_SIZE {
-		newDbFileName := fmt.Sprintf("data-%d.db", time.Now().Unix())
-		err := db.currentFile.Close()
+	if db.bufSize <= 0 {
+		err = db.writeFile(p)
 		if err != nil {
 			return "", 0, err
 		}
-
-		db.currentFile, err = openWriteFile(db.dir, newDbFileName)
+		return db.currentFile.Name(), ret, nil
+	}
+	db.buf = append(db.buf, p...)
+	db.size += int64(len(p))
+	if len(db.buf) >= db.bufSize {
+		err = db.flush()
 		if err != nil {
+			// p is still buffered and the next flush retries it, but the
+			// caller mustn't point at it
+			db.buf = db.buf[:len(db.buf)-len(p)]
+			db.size -= int64(len(p))
 			return "", 0, err
 		}
-		ret = 0
+	} else if db.flushTimer == nil {
+		db.flushTimer = time.AfterFunc(db.flushDelay, db.flushLater)
+	}
+	return db.currentFile.Name(), ret, nil
+}
 
-		file, err := openReadFile(filepath.Join(db.dir, newDbFileName))
-		if err != nil {
-			return "", 0, err
+// writeFile writes p at the end of the active file in one syscall. A
+// partial write is cut off again, so the file ends at db.size either way.
+// The caller holds db.mu.
+func (db *dbFile) writeFile(p []byte) error {
+	_, err := db.currentFile.Write(p)
+	if err != nil {
+		if terr := db.currentFile.Truncate(db.size); terr != nil {
+			return terr
 		}
-		db.fileMap[file.Name()] = file
+		if _, serr := db.currentFile.Seek(db.size, io.SeekStart); serr != nil {
+			return serr
+		}
+		return err
+	}
+	db.size += int64(len(p))
+	return nil
+}
+
+// flush writes the buffered writes to the active file. The caller holds
+// db.mu.
+func (db *dbFile) flush() error {
+	if len(db.buf) == 0 {
+		return nil
+	}
+	n := int64(len(db.buf))
+	db.size -= n
+	err := db.writeFile(db.buf)
+	if err != nil {
+		db.size += n
+		return err
+	}
+	db.buf = db.buf[:0]
+	if db.flushTimer != nil {
+		db.flushTimer.Stop()
+		db.flushTimer = nil
+	}
+	return nil
+}
+
+// flushLater flushes the write buffer once the flush delay is up. An error
+// is left to the next flush, which retries the same bytes.
+func (db *dbFile) flushLater() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.flushTimer = nil
+	if db.closed || db.currentFile == nil {
+		return
+	}
+	_ = db.flush()
+}
+
+// flushed returns the size of the active file on disk. The caller holds
+// db.mu.
+func (db *dbFile) flushed() int64 {
+	return db.size - int64(len(db.buf))
+}
+
+// StreamWriter receives the bytes of a WriteStream entry. WriteAt offsets
+// are relative to the start of the entry and may only cover bytes that
+// were already written.
+type StreamWriter interface {
+	io.Writer
+	io.WriterAt
+}
+
+// WriteStream appends the entry produced by write, holding at most
+// STREAM_BUFFER_SIZE of it in memory. If write fails, the partial entry is
+// cut off again.
+func (db *dbFile) WriteStream(write func(w StreamWriter) error) (fileName string, startPos int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ret, err := db.activeFile()
+	if err != nil {
+		return "", 0, err
+	}
+	err = db.flush()
+	if err != nil {
+		return "", 0, err
+	}
+	w := &streamWriter{
+		file:  db.currentFile,
+		buf:   bufio.NewWriterSize(db.currentFile, STREAM_BUFFER_SIZE),
+		start: ret,
+	}
+	err = write(w)
+	if err == nil {
+		err = w.buf.Flush()
 	}
-	_, err = db.currentFile.Write(p)
 	if err != nil {
+		// drop the partial entry so the next write starts where it did
+		if terr := db.currentFile.Truncate(ret); terr != nil {
+			return "", 0, terr
+		}
+		if _, serr := db.currentFile.Seek(ret, io.SeekStart); serr != nil {
+			return "", 0, serr
+		}
 		return "", 0, err
 	}
-	return db.currentFile.Name(), ret, err
+	db.size = ret + w.n
+	return db.currentFile.Name(), ret, nil
 }
 
-func writeFile(f *os.File, p []byte) (int, error) {
-	return f.Write(p)
+type streamWriter struct {
+	file  *os.File
+	buf   *bufio.Writer
+	start int64
+	n     int64
 }
 
-func (db *dbFile) Read(fileName string, offset int64, p []byte) (n int, err error) {
-	if f, ok := db.fileMap[fileName]; ok {
-		seek, err := f.Seek(offset, 0)
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *streamWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > w.n {
+		return 0, fmt.Errorf("stream: write at %d past written data", off)
+	}
+	err := w.buf.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return w.file.WriteAt(p, w.start+off)
+}
+
+// activeFile returns the write offset in the active file, starting a new
+// file first if it is full. The caller holds db.mu.
+func (db *dbFile) activeFile() (int64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.currentFile == nil {
+		return 0, ErrReadOnly
+	}
+	if db.size > MAX_FILE_SIZE {
+		err := db.flush()
 		if err != nil {
 			return 0, err
 		}
-		if seek != offset {
-			return 0, fmt.Errorf("seek error")
+		sealed := db.currentFile.Name()
+		newDbFileName := db.nextFileName()
+		err = db.currentFile.Close()
+		if err != nil {
+			return 0, err
 		}
-		n, err = f.Read(p)
+		db.mapFile(sealed)
+
+		db.currentFile, db.size, err = openWriteFile(db.dir, newDbFileName)
 		if err != nil {
 			return 0, err
 		}
-		return n, nil
+		db.files[db.currentFile.Name()] = struct{}{}
+	}
+	return db.size, nil
+}
+
+func (db *dbFile) Read(fileName string, offset int64, p []byte) (n int, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	// the mapping only covers the file as it was when sealed; anything else
+	// falls through to pread, which reports short reads
+	if data, ok := db.mapped[fileName]; ok && offset >= 0 && offset+int64(len(p)) <= int64(len(data)) {
+		return copy(p, data[offset:]), nil
+	}
+	if _, ok := db.files[fileName]; !ok {
+		return 0, fmt.Errorf("%w: %s", ErrFileNotFound, fileName)
+	}
+	// the tail of the active file may still be in the write buffer, in
+	// which case only the head of p is read from the file
+	var buffered []byte
+	if len(db.buf) > 0 && fileName == db.currentFile.Name() && offset+int64(len(p)) > db.flushed() {
+		if offset < 0 || offset+int64(len(p)) > db.size {
+			return 0, io.EOF
+		}
+		if offset >= db.flushed() {
+			return copy(p, db.buf[offset-db.flushed():]), nil
+		}
+		p, buffered = p[:db.flushed()-offset], p[db.flushed()-offset:]
 	}
-	return 0, fmt.Errorf("file not found")
+	h, err := db.handles.acquire(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer db.handles.release(h)
+	// ReadAt does not move the shared file offset, so concurrent readers
+	// of the same file do not race each other.
+	n, err = h.file.ReadAt(p, offset)
+	if err != nil {
+		return 0, err
+	}
+	return n + copy(buffered, db.buf), nil
 }
 
+// ReadAll calls readFunc with the offset of each record in fileName and a
+// reader positioned there; readFunc must consume exactly one record. The
+// file's current size is read once up front, so records appended while
+// ReadAll runs are not visited.
 func (db *dbFile) ReadAll(fileName string, readFunc func(int64, io.Reader) error) (err error) {
-	if f, ok := db.fileMap[fileName]; ok {
-		ret, err := f.Seek(0, 0)
-		stats, err := f.Stat()
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	if _, ok := db.files[fileName]; !ok {
+		db.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrFileNotFound, fileName)
+	}
+	if db.currentFile != nil && fileName == db.currentFile.Name() {
+		err = db.flush()
 		if err != nil {
+			db.mu.Unlock()
 			return err
 		}
-		for stats.Size() > ret {
-			if err != nil {
-				return err
-			}
-			err = readFunc(ret, f)
-			if err != nil {
-				return err
-			}
-			ret, err = f.Seek(0, 1)
-		}
-		return nil
 	}
-	return fmt.Errorf("file not found")
-}
+	// the reference keeps the handle open until we are done, even if the
+	// file is evicted or removed meanwhile
+	h, err := db.handles.acquire(fileName)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer db.handles.release(h)
+	f := h.file
 
-func (db *dbFile) Close() error {
-	err := db.currentFile.Close()
+	stats, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	for _, file := range db.fileMap {
-		err := file.Close()
+	reader := &countingReader{reader: bufio.NewReader(io.NewSectionReader(f, 0, stats.Size()))}
+	for stats.Size() > reader.n {
+		err = readFunc(reader.n, reader)
 		if err != nil {
 			return err
 		}
@@ -204,31 +596,245 @@ func (db *dbFile) Close() error {
 	return nil
 }
 
+// countingReader is a buffered reader that knows how many bytes its user
+// has consumed, which is the file offset of the next record.
+type countingReader struct {
+	reader *bufio.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.reader.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (db *dbFile) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	if db.currentFile != nil {
+		err := db.flush()
+		if cerr := db.currentFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for fileName, data := range db.mapped {
+		err := munmap(data)
+		if err != nil {
+			return err
+		}
+		delete(db.mapped, fileName)
+	}
+	return db.handles.closeAll()
+}
+
 func (db *dbFile) Sync() error {
-	err := db.currentFile.Sync()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.currentFile == nil {
+		return nil
+	}
+	err := db.flush()
+	if err != nil {
+		return err
+	}
+	err = db.currentFile.Sync()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// FileList returns the data files oldest first, which is the order their
+// records were written in.
 func (db *dbFile) FileList() []string {
-	list := make([]string, 0, len(db.fileMap))
-	for s := range db.fileMap {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	list := make([]string, 0, len(db.files))
+	for s := range db.files {
 		list = append(list, s)
 	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := db.naming.fileId(list[i])
+		b, _ := db.naming.fileId(list[j])
+		if a != b {
+			return a < b
+		}
+		return list[i] < list[j]
+	})
 	return list
 }
 
 func (db *dbFile) CurrentFile() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.currentFile == nil {
+		return ""
+	}
 	return db.currentFile.Name()
 }
 
+// Remove closes and deletes a sealed data file. The active file can't be
+// removed.
 func (db *dbFile) Remove(fileName string) error {
-	err := os.Remove(fileName)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.currentFile == nil && !db.replica {
+		return ErrReadOnly
+	}
+	if db.currentFile != nil && fileName == db.currentFile.Name() {
+		return fmt.Errorf("can't remove active file %s", fileName)
+	}
+	if _, ok := db.files[fileName]; !ok {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, fileName)
+	}
+	// readers copy out of the mapping under db.mu, so none can be using it
+	if data, ok := db.mapped[fileName]; ok {
+		err := munmap(data)
+		if err != nil {
+			return err
+		}
+		delete(db.mapped, fileName)
+	}
+	// a ReadAll still holding the handle keeps reading the unlinked file
+	err := db.handles.evict(fileName)
 	if err != nil {
 		return err
 	}
-	delete(db.fileMap, fileName)
+	delete(db.files, fileName)
+	return os.Remove(fileName)
+}
+
+// Replicate writes p at offset to the file called name, a base name such as
+// CurrentFile returns, creating the file if offset is zero. offset must be
+// the size of the file: the original files only ever grow. It returns the
+// absolute name of the file.
+func (db *dbFile) Replicate(name string, offset int64, p []byte) (fileName string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return "", ErrClosed
+	}
+	if !db.replica {
+		return "", ErrNotReplica
+	}
+	if _, ok := db.naming.fileId(name); !ok || filepath.Base(name) != name {
+		return "", fmt.Errorf("replicate: bad file name %q", name)
+	}
+	fileName = filepath.Join(db.dir, name)
+	flags := os.O_WRONLY
+	if offset == 0 {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(fileName, flags, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if stat.Size() != offset {
+		return "", fmt.Errorf("replicate: %s has %d bytes, not %d", name, stat.Size(), offset)
+	}
+	_, err = f.WriteAt(p, offset)
+	if err != nil {
+		return "", err
+	}
+	// what a replica reports as replicated must survive a crash
+	err = f.Sync()
+	if err != nil {
+		return "", err
+	}
+	db.files[fileName] = struct{}{}
+	if id, _ := db.naming.fileId(name); id > db.lastFileId {
+		db.lastFileId = id
+	}
+	return fileName, nil
+}
+
+// Truncate cuts a replicated file back to size, dropping bytes that
+// Replicate will write again, such as an incomplete record at the end.
+func (db *dbFile) Truncate(fileName string, size int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.replica {
+		return ErrNotReplica
+	}
+	if _, ok := db.files[fileName]; !ok {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, fileName)
+	}
+	// reading a mapping past the end of its file faults, so map it anew
+	if data, ok := db.mapped[fileName]; ok {
+		err := munmap(data)
+		if err != nil {
+			return err
+		}
+		delete(db.mapped, fileName)
+	}
+	err := os.Truncate(fileName, size)
+	if err != nil {
+		return err
+	}
+	db.mapFile(fileName)
 	return nil
 }
+
+// OpenFiles returns the number of file handles currently held.
+func (db *dbFile) OpenFiles() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0
+	}
+	n := db.handles.len()
+	if db.currentFile != nil {
+		n++
+	}
+	return n
+}
+
+// Size returns the current size of fileName.
+func (db *dbFile) Size(fileName string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if _, ok := db.files[fileName]; !ok {
+		return 0, fmt.Errorf("%w: %s", ErrFileNotFound, fileName)
+	}
+	if db.currentFile != nil && fileName == db.currentFile.Name() {
+		return db.size, nil
+	}
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
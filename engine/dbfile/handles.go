@@ -0,0 +1,133 @@
+package dbfile
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// handleCache keeps up to max read handles open. Handles are opened on
+// first use and the least recently used idle one is closed to make room for
+// another. A handle is reference counted and never closed while a read or
+// ReadAll holds it; if every handle is busy the cache grows past max until
+// they are released.
+type handleCache struct {
+	mu      sync.Mutex
+	max     int
+	lru     *list.List // of *handle, most recently used at the front
+	handles map[string]*handle
+}
+
+type handle struct {
+	name string
+	file *os.File
+	refs int
+	elem *list.Element
+	// evicted handles are out of the cache and closed on last release.
+	evicted bool
+}
+
+func newHandleCache(max int) *handleCache {
+	return &handleCache{
+		max:     max,
+		lru:     list.New(),
+		handles: make(map[string]*handle),
+	}
+}
+
+// acquire returns an open handle for fileName, which the caller must
+// release.
+func (c *handleCache) acquire(fileName string) (*handle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.handles[fileName]; ok {
+		h.refs++
+		c.lru.MoveToFront(h.elem)
+		return h, nil
+	}
+	f, err := openReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	h := &handle{name: fileName, file: f, refs: 1}
+	h.elem = c.lru.PushFront(h)
+	c.handles[fileName] = h
+	c.shrink()
+	return h, nil
+}
+
+func (c *handleCache) release(h *handle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	if h.evicted {
+		_ = h.file.Close()
+		return
+	}
+	c.shrink()
+}
+
+// shrink closes idle handles, least recently used first, until the cache
+// is within max. The caller holds c.mu.
+func (c *handleCache) shrink() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.max; {
+		h := e.Value.(*handle)
+		e = e.Prev()
+		if h.refs == 0 {
+			c.remove(h)
+			_ = h.file.Close()
+		}
+	}
+}
+
+func (c *handleCache) remove(h *handle) {
+	c.lru.Remove(h.elem)
+	delete(c.handles, h.name)
+}
+
+// evict drops the handle of fileName from the cache, closing it now or, if
+// it is in use, when it is released.
+func (c *handleCache) evict(fileName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.handles[fileName]
+	if !ok {
+		return nil
+	}
+	c.remove(h)
+	if h.refs > 0 {
+		h.evicted = true
+		return nil
+	}
+	return h.file.Close()
+}
+
+func (c *handleCache) closeAll() error {
+	var firstErr error
+	for _, fileName := range c.names() {
+		err := c.evict(fileName)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *handleCache) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.handles))
+	for name := range c.handles {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *handleCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,104 @@
+package dbfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, n int) []string {
+	t.Helper()
+	names := make([]string, n)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("data-%d.db", i+1))
+		if err := os.WriteFile(names[i], []byte(fmt.Sprintf("file %d", i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+func TestHandleCache(t *testing.T) {
+	names := writeFiles(t, t.TempDir(), 3)
+	c := newHandleCache(2)
+	handles := make([]*handle, len(names))
+	for i, name := range names {
+		h, err := c.acquire(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles[i] = h
+	}
+	// every handle is in use, none can be closed
+	if n := c.len(); n != 3 {
+		t.Fatalf("open handles = %d, want 3", n)
+	}
+	c.release(handles[0])
+	if n := c.len(); n != 2 {
+		t.Fatalf("open handles after release = %d, want 2", n)
+	}
+	if _, err := handles[0].file.Stat(); err == nil {
+		t.Error("least recently used handle was not closed")
+	}
+
+	// an evicted handle stays usable until released
+	if err := c.evict(names[1]); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := handles[1].file.ReadAt(buf, 0); err != nil {
+		t.Errorf("read from evicted handle in use: %v", err)
+	}
+	c.release(handles[1])
+	if _, err := handles[1].file.Stat(); err == nil {
+		t.Error("evicted handle was not closed on release")
+	}
+	c.release(handles[2])
+	if err := c.closeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.len(); n != 0 {
+		t.Errorf("open handles after closeAll = %d", n)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, 5)
+	d, err := OpenDBFile(dir, WithMaxOpenFiles(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, fileName := range d.FileList() {
+		err := d.ReadAll(fileName, func(pos int64, r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the write handle of the active file is counted on top
+		if n := d.OpenFiles(); n > 3 {
+			t.Fatalf("open files = %d, want at most 3", n)
+		}
+	}
+
+	// a file removed during ReadAll is read to the end
+	sealed := d.FileList()[0]
+	err = d.ReadAll(sealed, func(pos int64, r io.Reader) error {
+		if err := d.Remove(sealed); err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil || string(data) != "file 0" {
+			t.Errorf("ReadAll() of removed file = %q, %v", data, err)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+package dbfile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSealed creates a data file in dir holding data and returns its name.
+func writeSealed(t testing.TB, dir string, data []byte) string {
+	t.Helper()
+	name := filepath.Join(dir, "data-1.db")
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abs
+}
+
+func TestMmapRead(t *testing.T) {
+	dir := t.TempDir()
+	sealed := writeSealed(t, dir, []byte("0123456789"))
+	d, err := OpenDBFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	db := d.(*dbFile)
+	if _, ok := db.mapped[sealed]; ok != mmapSupported {
+		t.Errorf("sealed file mapped = %v, want %v", ok, mmapSupported)
+	}
+	if _, ok := db.mapped[db.CurrentFile()]; ok {
+		t.Error("active file is mapped")
+	}
+
+	buf := make([]byte, 4)
+	if n, err := d.Read(sealed, 3, buf); err != nil || string(buf[:n]) != "3456" {
+		t.Errorf("Read() = %q, %v", buf[:n], err)
+	}
+	// reads past the mapping are short, like pread
+	if _, err := d.Read(sealed, 8, buf); err == nil {
+		t.Error("Read() past end of file succeeded")
+	}
+
+	active, pos, err := d.Write([]byte("active"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Read(active, pos, buf); err != nil || string(buf[:n]) != "acti" {
+		t.Errorf("Read() of active file = %q, %v", buf[:n], err)
+	}
+
+	if err := d.Remove(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.mapped[sealed]; ok {
+		t.Error("removed file is still mapped")
+	}
+	if _, err := d.Read(sealed, 0, buf); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Read() of removed file error = %v, want %v", err, ErrFileNotFound)
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	dir := b.TempDir()
+	sealed := writeSealed(b, dir, bytes.Repeat([]byte("x"), 1<<20))
+	d, err := OpenDBFile(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+	db := d.(*dbFile)
+	buf := make([]byte, 128)
+	read := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := d.Read(sealed, int64(i*128%(1<<20)), buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("mmap", read)
+	db.mu.Lock()
+	if data, ok := db.mapped[sealed]; ok {
+		_ = munmap(data)
+		delete(db.mapped, sealed)
+	}
+	db.mu.Unlock()
+	b.Run("pread", read)
+}
@@ -0,0 +1,47 @@
+package dbfile
+
+import "time"
+
+const (
+	// DEFAULT_MAX_OPEN_FILES bounds the read handles a DBFile keeps open.
+	DEFAULT_MAX_OPEN_FILES = 128
+	// DEFAULT_FLUSH_DELAY bounds how long a buffered write waits, see
+	// WithWriteBuffer.
+	DEFAULT_FLUSH_DELAY = 10 * time.Millisecond
+)
+
+type options struct {
+	maxOpenFiles int
+	// writeBuffer of zero writes every Write through.
+	writeBuffer int
+	flushDelay  time.Duration
+}
+
+type Option func(*options)
+
+// WithMaxOpenFiles keeps at most n read handles open, closing the least
+// recently used one when another file has to be opened. The active file's
+// write handle is not counted. n <= 0 uses DEFAULT_MAX_OPEN_FILES.
+func WithMaxOpenFiles(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxOpenFiles = n
+		}
+	}
+}
+
+// WithWriteBuffer holds up to size bytes of appends to the active file in
+// memory and writes them with one syscall, when the buffer fills, on Sync,
+// Close or a ReadAll of the active file, and at the latest maxDelay after
+// the first of them. Until then they are lost if the process dies. A
+// maxDelay <= 0 uses DEFAULT_FLUSH_DELAY; size <= 0 writes every Write
+// through, which is the default.
+func WithWriteBuffer(size int, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.writeBuffer = size
+		o.flushDelay = maxDelay
+		if maxDelay <= 0 {
+			o.flushDelay = DEFAULT_FLUSH_DELAY
+		}
+	}
+}
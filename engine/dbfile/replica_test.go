@@ -0,0 +1,96 @@
+package dbfile
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplicate(t *testing.T) {
+	dir := t.TempDir()
+	sealed := writeSealed(t, dir, []byte("0123"))
+	d, err := OpenReplicaDBFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.CurrentFile() != "" {
+		t.Errorf("replica has active file %s", d.CurrentFile())
+	}
+	if _, _, err := d.Write([]byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Write() error = %v, want %v", err, ErrReadOnly)
+	}
+
+	// appending to a mapped file is read back past the mapping
+	if _, err := d.Replicate("data-1.db", 4, []byte("45")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Replicate("data-1.db", 4, []byte("45")); err == nil {
+		t.Error("Replicate() at a stale offset succeeded")
+	}
+	buf := make([]byte, 6)
+	if _, err := d.Read(sealed, 0, buf); err != nil || string(buf) != "012345" {
+		t.Errorf("Read() = %q, %v", buf, err)
+	}
+
+	fileName, err := d.Replicate("data-2.db", 0, []byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileName != filepath.Join(dir, "data-2.db") || len(d.FileList()) != 2 {
+		t.Errorf("Replicate() = %s, files %v", fileName, d.FileList())
+	}
+	if _, err := d.Replicate("../data-3.db", 0, []byte("ab")); err == nil {
+		t.Error("Replicate() outside the directory succeeded")
+	}
+	if err := d.Remove(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if list := d.FileList(); len(list) != 1 || list[0] != fileName {
+		t.Errorf("FileList() after Remove = %v", list)
+	}
+
+	other, err := OpenReadOnlyDBFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.Replicate("data-2.db", 2, []byte("c")); !errors.Is(err, ErrNotReplica) {
+		t.Errorf("Replicate() on read-only error = %v, want %v", err, ErrNotReplica)
+	}
+}
+
+func TestReplicaTruncate(t *testing.T) {
+	dir := t.TempDir()
+	sealed := writeSealed(t, dir, []byte("0123456789"))
+	d, err := OpenReplicaDBFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Truncate(sealed, 4); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Size(sealed); err != nil || n != 4 {
+		t.Errorf("Size() after Truncate() = %d, %v, want 4", n, err)
+	}
+	buf := make([]byte, 6)
+	if _, err := d.Read(sealed, 0, buf); err == nil {
+		t.Error("Read() past the truncated end succeeded")
+	}
+	if _, err := d.Replicate("data-1.db", 4, []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read(sealed, 0, buf); err != nil || string(buf) != "0123ab" {
+		t.Errorf("Read() = %q, %v", buf, err)
+	}
+
+	other, err := OpenDBFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Truncate(sealed, 0); !errors.Is(err, ErrNotReplica) {
+		t.Errorf("Truncate() on a writable DBFile error = %v, want %v", err, ErrNotReplica)
+	}
+}
@@ -0,0 +1,183 @@
+package dbfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// fileSize returns the size of fileName on disk.
+func fileSize(t *testing.T, fileName string) int64 {
+	t.Helper()
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Size()
+}
+
+func TestWriteBuffer(t *testing.T) {
+	d, err := OpenDBFile(t.TempDir(), WithWriteBuffer(16, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for i, s := range []string{"0123", "4567"} {
+		name, pos, err := d.Write([]byte(s))
+		if err != nil || pos != int64(4*i) {
+			t.Fatalf("Write() = %d, %v, want %d", pos, err, 4*i)
+		}
+		if name != d.CurrentFile() {
+			t.Errorf("Write() file = %s, want %s", name, d.CurrentFile())
+		}
+	}
+	active := d.CurrentFile()
+	if n := fileSize(t, active); n != 0 {
+		t.Errorf("file size with a partly full buffer = %d, want 0", n)
+	}
+	if n, err := d.Size(active); err != nil || n != 8 {
+		t.Errorf("Size() = %d, %v, want 8", n, err)
+	}
+
+	// filling the buffer writes it out; reads straddle the file and the
+	// buffer
+	for _, s := range []string{"89abcdef", "ghij"} {
+		if _, _, err := d.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fileSize(t, active); n != 16 {
+		t.Errorf("file size after filling the buffer = %d, want 16", n)
+	}
+	buf := make([]byte, 6)
+	for _, tt := range []struct {
+		offset int64
+		want   string
+	}{{2, "234567"}, {12, "cdefgh"}, {14, "efghij"}} {
+		if n, err := d.Read(active, tt.offset, buf); err != nil || string(buf[:n]) != tt.want {
+			t.Errorf("Read(%d) = %q, %v, want %q", tt.offset, buf[:n], err, tt.want)
+		}
+	}
+	if _, err := d.Read(active, 16, buf); err != io.EOF {
+		t.Errorf("Read() past the buffer error = %v, want %v", err, io.EOF)
+	}
+
+	// ReadAll sees what was buffered
+	var read []byte
+	err = d.ReadAll(active, func(_ int64, r io.Reader) error {
+		p := make([]byte, 4)
+		_, err := io.ReadFull(r, p)
+		read = append(read, p...)
+		return err
+	})
+	if err != nil || string(read) != "0123456789abcdefghij" {
+		t.Errorf("ReadAll() read %q, %v", read, err)
+	}
+
+	if _, _, err := d.Write([]byte("klmn")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, active); n != 24 {
+		t.Errorf("file size after Sync() = %d, want 24", n)
+	}
+	if _, _, err := d.Write([]byte("opqr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, active); n != 28 {
+		t.Errorf("file size after Close() = %d, want 28", n)
+	}
+}
+
+func TestWriteBufferDelay(t *testing.T) {
+	d, err := OpenDBFile(t.TempDir(), WithWriteBuffer(1<<20, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	active, _, err := d.Write([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fileSize(t, active) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("buffered write wasn't flushed after the delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteStreamAfterBuffer(t *testing.T) {
+	d, err := OpenDBFile(t.TempDir(), WithWriteBuffer(1<<20, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, _, err := d.Write([]byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	_, pos, err := d.WriteStream(func(w StreamWriter) error {
+		_, err := w.Write([]byte("stream"))
+		return err
+	})
+	if err != nil || pos != 4 {
+		t.Fatalf("WriteStream() = %d, %v, want 4", pos, err)
+	}
+	active, pos, err := d.Write([]byte("tail"))
+	if err != nil || pos != 10 {
+		t.Fatalf("Write() after WriteStream() = %d, %v, want 10", pos, err)
+	}
+	buf := make([]byte, 14)
+	if n, err := d.Read(active, 0, buf); err != nil || string(buf[:n]) != "headstreamtail" {
+		t.Errorf("Read() = %q, %v", buf[:n], err)
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, size := range []int{64, 512} {
+		for _, bench := range []struct {
+			name string
+			opts []Option
+		}{
+			{"unbuffered", nil},
+			{"buffered", []Option{WithWriteBuffer(64<<10, 0)}},
+		} {
+			record := make([]byte, size)
+			run := func(b *testing.B, parallel bool) {
+				d, err := OpenDBFile(b.TempDir(), bench.opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer d.Close()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				if !parallel {
+					for i := 0; i < b.N; i++ {
+						if _, _, err := d.Write(record); err != nil {
+							b.Fatal(err)
+						}
+					}
+					return
+				}
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, _, err := d.Write(record); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			}
+			b.Run(fmt.Sprintf("%s/%d", bench.name, size), func(b *testing.B) { run(b, false) })
+			b.Run(fmt.Sprintf("%s/%d/parallel", bench.name, size), func(b *testing.B) { run(b, true) })
+		}
+	}
+}
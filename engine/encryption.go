@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"sync"
+)
+
+// KeyProvider supplies the AES keys record values are encrypted with. The
+// key id is stored with every encrypted record, so keys are rotated by
+// changing CurrentKeyId while older keys stay available through Key. Merge
+// re-encrypts the live records it copies with the current key.
+type KeyProvider interface {
+	CurrentKeyId() uint32
+	// Key returns the 16, 24 or 32 byte AES key with the given id.
+	Key(id uint32) ([]byte, error)
+}
+
+// keyring caches an AES-GCM cipher per key id.
+type keyring struct {
+	provider KeyProvider
+
+	mu      sync.Mutex
+	ciphers map[uint32]cipher.AEAD
+}
+
+func newKeyring(provider KeyProvider) *keyring {
+	return &keyring{
+		provider: provider,
+		ciphers:  make(map[uint32]cipher.AEAD),
+	}
+}
+
+func (k *keyring) Cipher(keyId uint32) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead, ok := k.ciphers[keyId]; ok {
+		return aead, nil
+	}
+	key, err := k.provider.Key(keyId)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.ciphers[keyId] = aead
+	return aead, nil
+}
@@ -1,9 +1,13 @@
 package engine
 
 import (
-	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/machinly/bitcask/engine/bloom"
 	"github.com/machinly/bitcask/engine/dbfile"
 	"github.com/machinly/bitcask/engine/index"
 	"github.com/machinly/bitcask/engine/record"
@@ -13,59 +17,389 @@ type Engine interface {
 	Put(key, value string) error
 	Get(key string) (string, error)
 	Delete(key string) error
+	PutReader(key string, value io.Reader, size int64) error
+	GetReader(key string) (io.ReadCloser, error)
+	Has(key string) (bool, error)
+	MultiGet(keys []string) (map[string]string, error)
+	CompareAndSwap(key, old, new string) (bool, error)
+	PutIfAbsent(key, value string) (bool, error)
+	DeleteIfEquals(key, value string) (bool, error)
+	Incr(key string, delta int64) (int64, error)
+	Append(key, suffix string) error
+	Subscribe(fromSeq uint64) (Subscription, error)
 	ListKeys() ([]string, error)
+	Bucket(name string) (Engine, error)
+	DropBucket(name string) error
+	ListBuckets() ([]string, error)
 	Merge() error
+	Stats() (Stats, error)
 	Sync() bool
 	Close() bool
 }
 
 type bitcask struct {
-	index  map[string]index.Set
+	// filterNegatives counts the lookups the filter answered. It is first
+	// so it is 64 bit aligned for atomic access.
+	filterNegatives int64
+
+	mu sync.RWMutex
+	// index is the keydir of the default bucket.
+	index index.Index
+	// keydirs are those of the named buckets and of the catalog, by id.
+	keydirs map[uint32]index.Index
+	// newIndex makes the keydirs of the named buckets unless diskIndex is
+	// set, when each is a disk index of its own, see newKeydir.
+	newIndex      func() index.Index
+	diskIndex     bool
+	diskIndexOpts []index.DiskOption
+	// catalog holds the entries of the bucket catalog, dropped buckets
+	// included, and buckets the ids of the buckets that exist by name.
+	catalog    map[uint32]bucketEntry
+	buckets    map[string]uint32
+	lastBucket uint32
+	// defaultBucket is the handle the Engine methods act on.
+	defaultBucket *bucket
+	// seq is the sequence number of the last record written.
+	seq   uint64
+	files map[string]*fileStats
+	// keyIds are the encryption keys the data files use.
+	keyIds map[uint32]bool
 	dbFile dbfile.DBFile
+	// blobs holds the values of at least blobThreshold bytes. It is
+	// read-only when the threshold is zero.
+	blobs         dbfile.DBFile
+	blobDir       string
+	blobThreshold int64
+	readOnly      bool
+	// replica is set while the engine follows a leader, see OpenFollower.
+	replica bool
+	closed  bool
+	// recordOpts are applied to every record the engine writes.
+	recordOpts []record.Option
+	checksum   record.Checksum
+	// cache is nil unless values are cached.
+	cache *valueCache
+	// filter is nil unless filterRate is set.
+	filter     *bloom.Filter
+	filterRate float64
+	// keys is nil unless values are encrypted.
+	keys         *keyring
+	maxKeySize   int
+	maxValueSize int64
+	// subscribers receive every write, see Subscribe.
+	subscribers      map[*subscription]bool
+	subscriberBuffer int
+
+	// mergeMu serialises merges; it is taken before mu, never after.
+	mergeMu     sync.Mutex
+	mergePolicy MergePolicy
+	mergeErr    error
+	// lastMerge and lastMergeDuration describe the last completed merge.
+	lastMerge         time.Time
+	lastMergeDuration time.Duration
+	stop              chan struct{}
+	stopOnce          sync.Once
+	scheduler         sync.WaitGroup
 }
 
-func OpenBitcaskEngine(dirName string) (Engine, error) {
-	dbFile, err := dbfile.OpenDBFile(dirName)
+func OpenBitcaskEngine(dirName string, opts ...Option) (Engine, error) {
+	o := options{maxKeySize: DEFAULT_MAX_KEY_SIZE, subscriberBuffer: DEFAULT_SUBSCRIBER_BUFFER}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dbFile, blobs, err := o.openFiles(dirName)
+	if err != nil {
+		return nil, err
+	}
+	blobDir, err := filepath.Abs(dirName)
 	if err != nil {
+		_ = dbFile.Close()
+		_ = blobs.Close()
 		return nil, err
 	}
+	var cache *valueCache
+	if o.cacheSize > 0 {
+		cache = newValueCache(o.cacheSize)
+	}
+	var keys *keyring
+	if o.keyProvider != nil {
+		keys = newKeyring(o.keyProvider)
+	}
+	idx, err := o.openIndex(dirName)
+	if err != nil {
+		_ = dbFile.Close()
+		_ = blobs.Close()
+		return nil, err
+	}
+	newIndex := o.newIndex
+	if newIndex == nil {
+		newIndex = index.NewIndex
+	}
 	bc := &bitcask{
-		index:  make(map[string]index.Set),
-		dbFile: dbFile,
+		index:            idx,
+		newIndex:         newIndex,
+		diskIndex:        o.diskIndex && !o.readOnly,
+		diskIndexOpts:    o.diskIndexOpts,
+		files:            make(map[string]*fileStats),
+		keyIds:           make(map[uint32]bool),
+		dbFile:           dbFile,
+		blobs:            blobs,
+		blobDir:          blobDir,
+		blobThreshold:    o.blobThreshold,
+		readOnly:         o.readOnly,
+		replica:          o.replica,
+		recordOpts:       append(o.recordOpts, record.WithChecksum(o.checksum)),
+		checksum:         o.checksum,
+		cache:            cache,
+		filterRate:       o.bloomRate,
+		keys:             keys,
+		maxKeySize:       o.maxKeySize,
+		maxValueSize:     o.maxValueSize,
+		subscribers:      make(map[*subscription]bool),
+		subscriberBuffer: o.subscriberBuffer,
+		mergePolicy:      o.mergePolicy,
+		stop:             make(chan struct{}),
 	}
+	bc.defaultBucket = &bucket{c: bc, name: DEFAULT_BUCKET}
 
-	err = bc.buildIndex()
+	err = bc.loadIndex()
 	if err != nil {
+		_ = bc.closeIndex(false)
+		_ = dbFile.Close()
+		_ = blobs.Close()
 		return nil, err
 	}
 
+	if !o.readOnly && !o.replica && o.mergePolicy.enabled() {
+		bc.scheduler.Add(1)
+		go bc.runMergeScheduler()
+	}
+
 	return bc, nil
 }
 
+// openFiles opens the data and blob files in dirName as the options say.
+func (o options) openFiles(dirName string) (dbFile, blobs dbfile.DBFile, err error) {
+	switch {
+	case o.replica:
+		dbFile, err = dbfile.OpenReplicaDBFile(dirName, o.dbFileOpts...)
+	case o.readOnly:
+		dbFile, err = dbfile.OpenReadOnlyDBFile(dirName, o.dbFileOpts...)
+	default:
+		opts := append(append([]dbfile.Option(nil), o.dbFileOpts...), o.dataFileOpts...)
+		dbFile, err = dbfile.OpenDBFile(dirName, opts...)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case o.replica:
+		blobs, err = dbfile.OpenReplicaBlobFile(dirName, o.dbFileOpts...)
+	case o.readOnly || o.blobThreshold <= 0:
+		blobs, err = dbfile.OpenReadOnlyBlobFile(dirName, o.dbFileOpts...)
+	default:
+		blobs, err = dbfile.OpenBlobFile(dirName, o.dbFileOpts...)
+	}
+	if err != nil {
+		_ = dbFile.Close()
+		return nil, nil, err
+	}
+	return dbFile, blobs, nil
+}
+
+// buildIndex replays the data files into the keydir, which is empty.
 func (c *bitcask) buildIndex() error {
-	index := make(map[string]index.Set)
-	deleteList := make([]string, 0)
-	for _, fileName := range c.dbFile.FileList() {
-		pos := int64(0)
+	c.files = make(map[string]*fileStats)
+	c.keyIds = make(map[uint32]bool)
+	c.seq = 0
+	err := c.resetBuckets()
+	if err != nil {
+		return err
+	}
+	// files are listed oldest first, so replaying them in order leaves the
+	// last record written for each key in the keydir.
+	files := c.dbFile.FileList()
+	for i, fileName := range files {
+		c.fileStats(fileName)
+		err := c.dbFile.ReadAll(fileName, func(pos int64, reader io.Reader) error {
+			r, err := c.scanRecord(reader)
+			if err != nil {
+				return record.WithLocation(err, fileName, pos)
+			}
+			return c.replayRecord(fileName, pos, r)
+		})
+		if pos, ok := truncatedAt(err); ok && c.replica && i == len(files)-1 {
+			// replication stopped inside a record, which the leader sends
+			// again from its start
+			err = c.dbFile.Truncate(fileName, pos)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.dropOrphans()
+	return nil
+}
+
+// scanRecord reads the next record from reader for replayRecord. Values
+// stay on disk unless replaying needs them, see needsValue: they are
+// checked against the checksum as they are skipped, so a large value
+// doesn't have to fit in memory. The caller holds mu.
+func (c *bitcask) scanRecord(reader io.Reader) (record.Record, error) {
+	h, err := record.ParseHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return c.scanValue(h)
+}
 
+// scanValue consumes the value of h for scanRecord. The caller holds mu.
+func (c *bitcask) scanValue(h *record.Header) (record.Record, error) {
+	if c.needsValue(h.Record()) {
+		return h.ReadRecord()
 	}
-	for k, v := range index {
-		if v.ValueSize == 0 {
-			deleteList = append(deleteList, k)
+	return h.Record(), h.Discard()
+}
+
+// needsValue reports whether replaying r reads its value: catalog entries
+// and blob pointers are kept in it, and the first record under an
+// encryption key checks the key. The caller holds mu.
+func (c *bitcask) needsValue(r record.Record) bool {
+	if r.Bucket() == catalogBucket || r.Flags()&record.V2_BLOB != 0 {
+		return true
+	}
+	return r.Flags()&record.V2_ENCRYPTED != 0 && !c.keyIds[r.KeyId()]
+}
+
+// replayRecord applies r, read from fileName at pos, to the keydir and the
+// file stats. Replicas apply the records they receive the same way. The
+// caller holds mu.
+func (c *bitcask) replayRecord(fileName string, pos int64, r record.Record) error {
+	stats := c.fileStats(fileName)
+	stats.totalBytes += r.Len()
+	stats.addSeq(r.Seq())
+	// merges copy records with their sequence number, they aren't news
+	fresh := r.Seq() > c.seq
+	if fresh {
+		c.seq = r.Seq()
+	}
+	// fail early and clearly when a key is missing or wrong, rather than
+	// on the first Get
+	if r.Flags()&record.V2_ENCRYPTED != 0 && !c.keyIds[r.KeyId()] {
+		_, err := r.DecodeValue(c.keyring())
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", fileName, pos, err)
 		}
+		c.keyIds[r.KeyId()] = true
 	}
-	for _, k := range deleteList {
-		delete(index, k)
+	b := r.Bucket()
+	if c.catalog[b].Dropped {
+		stats.deadBytes += r.Len()
+		return nil
 	}
-	c.index = index
-	return nil
+	kd := c.keydir(b)
+	if kd == nil {
+		// the catalog record may come later, after a merge copied it
+		var err error
+		kd, err = c.newKeydir(b)
+		if err != nil {
+			return err
+		}
+		c.keydirs[b] = kd
+	}
+	old, err := c.lookup(b, r.Key())
+	if err != nil {
+		return err
+	}
+	c.cache.remove(cacheKey(b, r.Key()))
+	if record.IsTombstone(r) {
+		stats.deadBytes += r.Len()
+		stats.tombstones++
+		if old != nil {
+			c.markDead(b, r.Key(), *old, nil)
+		}
+		if fresh {
+			c.publish(change{Event: Event{Seq: r.Seq(), Type: EVENT_DELETE, Key: r.Key()}, bucket: b})
+		}
+		return kd.Delete(r.Key())
+	}
+	set, err := c.newSet(fileName, pos, r)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		c.markDead(b, r.Key(), *old, set.Blob)
+	}
+	err = kd.Put(r.Key(), &set)
+	if err != nil {
+		return err
+	}
+	if b == catalogBucket {
+		return c.applyCatalog(r)
+	}
+	if fresh && len(c.subscribers) > 0 {
+		stored := c.valueOf(set)
+		c.publish(change{Event: Event{Seq: r.Seq(), Type: EVENT_PUT, Key: r.Key()}, bucket: b, stored: &stored})
+	}
+	if old != nil || b != 0 {
+		return nil
+	}
+	return c.addToFilter(r.Key())
+}
+
+// lookup returns the keydir entry of key in bucket, nil if there is none.
+// The caller holds mu.
+func (c *bitcask) lookup(bucket uint32, key string) (*index.Set, error) {
+	kd := c.keydir(bucket)
+	if kd == nil {
+		return nil, nil
+	}
+	set, err := kd.Get(key)
+	if err == index.ErrKeyNotFound {
+		return nil, nil
+	}
+	return set, err
+}
+
+func (b *bucket) Put(key string, value string) error {
+	c := b.c
+	err := c.checkSize(key, int64(len(value)))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	return c.put(b.id, key, value)
 }
 
-func (c *bitcask) Put(key string, value string) error {
-	r, err := record.NewRecord(key, value)
+// put writes value under key in bucket. The caller holds mu and has
+// checked the sizes and the bucket.
+func (c *bitcask) put(bucket uint32, key, value string) error {
+	opts, err := c.recordOptions(bucket)
+	if err != nil {
+		return err
+	}
+	r, err := record.NewRecordV2(c.seq+1, key, value, opts...)
+	if err != nil {
+		return err
+	}
+	if c.blobThreshold > 0 && int64(len(value)) >= c.blobThreshold {
+		err = c.putBlob(r)
+	} else {
+		err = c.putRecord(r)
+	}
 	if err != nil {
 		return err
 	}
+	c.publish(change{Event: Event{Seq: r.Seq(), Type: EVENT_PUT, Key: key, Value: value}, bucket: bucket})
+	return nil
+}
+
+// putRecord appends r and points the keydir at it. The caller holds mu.
+func (c *bitcask) putRecord(r record.Record) error {
 	buf, err := r.ToBytes()
 	if err != nil {
 		return err
@@ -74,63 +408,243 @@ func (c *bitcask) Put(key string, value string) error {
 	if err != nil {
 		return err
 	}
-	c.index[key] = index.Set{
-		fileId:        fileName,
-		valuePosition: r.ValueRelativePosition() + ret,
-		valueSize:     r.ValueSize(),
-		tstamp:        time.Now().Unix(),
+	return c.addRecord(fileName, ret, r)
+}
+
+// addRecord accounts for r, just written to fileName at pos, and points the
+// keydir at it. The caller holds mu.
+func (c *bitcask) addRecord(fileName string, pos int64, r record.Record) error {
+	set, err := c.newSet(fileName, pos, r)
+	if err != nil {
+		return err
 	}
-	return nil
+	if r.Seq() > c.seq {
+		c.seq = r.Seq()
+	}
+	if r.Flags()&record.V2_ENCRYPTED != 0 {
+		c.keyIds[r.KeyId()] = true
+	}
+	b := r.Bucket()
+	kd := c.keydir(b)
+	if kd == nil {
+		return fmt.Errorf("%w: id %d", ErrBucketNotFound, b)
+	}
+	old, err := c.lookup(b, r.Key())
+	if err != nil {
+		return err
+	}
+	// covers merges moving the value as well as new values
+	c.cache.remove(cacheKey(b, r.Key()))
+	c.fileStats(fileName).totalBytes += r.Len()
+	c.fileStats(fileName).addSeq(r.Seq())
+	if old != nil {
+		c.markDead(b, r.Key(), *old, set.Blob)
+	}
+	err = kd.Put(r.Key(), &set)
+	if err != nil {
+		return err
+	}
+	if b == catalogBucket {
+		return c.applyCatalog(r)
+	}
+	if old != nil || b != 0 {
+		return nil
+	}
+	return c.addToFilter(r.Key())
+}
+
+// newSet returns the keydir entry for r, written to fileName at pos.
+func (c *bitcask) newSet(fileName string, pos int64, r record.Record) (index.Set, error) {
+	set := *index.NewSetFromRecord(fileName, pos, r)
+	if r.Flags()&record.V2_BLOB == 0 {
+		return set, nil
+	}
+	set, err := c.blobSet(set, r)
+	if err != nil {
+		return index.Set{}, record.WithLocation(err, fileName, pos)
+	}
+	return set, nil
+}
+
+func (b *bucket) Get(key string) (string, error) {
+	c := b.c
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return "", err
+	}
+	set, err := c.find(b.id, key)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := c.cache.get(cacheKey(b.id, key)); ok {
+		return value, nil
+	}
+	return c.readValue(b.id, key, c.valueOf(*set))
+}
+
+// Has reports whether key exists, from the keydir alone.
+func (b *bucket) Has(key string) (bool, error) {
+	c := b.c
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return false, err
+	}
+	_, err := c.find(b.id, key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-func (c *bitcask) Get(key string) (string, error) {
-	vSet, ok := c.index[key]
-	if !ok || vSet.ValueSize == 0 {
-		return "", errors.New("key not found")
+// find returns the keydir entry of key in bucket, or ErrKeyNotFound. The
+// caller holds mu.
+func (c *bitcask) find(bucket uint32, key string) (*index.Set, error) {
+	// the filter only holds the default bucket
+	if bucket == 0 && !c.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+	kd := c.keydir(bucket)
+	if kd == nil {
+		return nil, ErrKeyNotFound
+	}
+	return kd.Get(key)
+}
+
+// readValue reads and decodes the value of key in bucket and caches it.
+// The caller holds mu.
+func (c *bitcask) readValue(bucket uint32, key string, v storedValue) (string, error) {
+	value, err := c.loadValue(key, v)
+	if err != nil {
+		return "", err
+	}
+	c.cache.put(cacheKey(bucket, key), value)
+	return value, nil
+}
+
+// loadValue reads and decodes a value without caching it. The caller holds
+// mu.
+func (c *bitcask) loadValue(key string, v storedValue) (string, error) {
+	buf := make([]byte, v.size)
+	n, err := v.db.Read(v.fileId, v.pos, buf)
+	if err == io.EOF || (err == nil && int64(n) != v.size) {
+		return "", &ErrCorruptRecord{
+			File:   v.fileId,
+			Offset: v.pos,
+			Reason: "value extends past end of file",
+		}
 	}
-	buf := make([]byte, vSet.valueSize)
-	n, err := c.dbFile.Read(vSet.FileId, vSet.ValuePosition, buf)
 	if err != nil {
 		return "", err
 	}
-	if int64(n) != vSet.valueSize {
-		return "", errors.New("read size not equal to value size")
+	value, err := record.DecodeValue(v.flags, v.keyId, key, buf, c.keyring())
+	if err != nil {
+		return "", record.WithLocation(err, v.fileId, v.pos)
+	}
+	return string(value), nil
+}
+
+// storedValue is where the stored bytes of a value are and how they are
+// encoded.
+type storedValue struct {
+	db     dbfile.DBFile
+	fileId string
+	pos    int64
+	size   int64
+	flags  byte
+	keyId  uint32
+}
+
+func (c *bitcask) valueOf(set index.Set) storedValue {
+	if b := set.Blob; b != nil {
+		return storedValue{c.blobs, b.FileId, b.ValuePosition, b.ValueSize, b.Flags, b.KeyId}
+	}
+	return storedValue{c.dbFile, set.FileId, set.ValuePosition, set.ValueSize, set.Flags, set.KeyId}
+}
+
+func (b *bucket) Delete(key string) error {
+	c := b.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	old, err := c.keydir(b.id).Get(key)
+	if err != nil {
+		return err
 	}
-	return string(buf), nil
+	return c.delete(b.id, key, old)
 }
 
-func (c *bitcask) Delete(key string) error {
-	_, ok := c.index[key]
-	if !ok {
-		return errors.New("key not found")
+// delete writes a tombstone for key in bucket, whose keydir entry is old.
+// The caller holds mu.
+func (c *bitcask) delete(bucket uint32, key string, old *index.Set) error {
+	opts, err := c.recordOptions(bucket)
+	if err != nil {
+		return err
 	}
-	delete(c.index, key)
-	r, err := record.NewDeleteRecord(key)
+	r, err := record.NewDeleteRecordV2(c.seq+1, key, opts...)
 	if err != nil {
 		return err
 	}
 	buf, err := r.ToBytes()
-	_, _, err = c.dbFile.Write(buf)
 	if err != nil {
 		return err
 	}
+	fileName, _, err := c.dbFile.Write(buf)
+	if err != nil {
+		return err
+	}
+	c.seq = r.Seq()
+	// a tombstone is garbage from the start: merge drops it together with
+	// the records it shadows.
+	stats := c.fileStats(fileName)
+	stats.totalBytes += int64(len(buf))
+	stats.deadBytes += int64(len(buf))
+	stats.tombstones++
+	stats.addSeq(r.Seq())
+	c.markDead(bucket, key, *old, nil)
+	c.cache.remove(cacheKey(bucket, key))
+	err = c.keydir(bucket).Delete(key)
+	if err != nil {
+		return err
+	}
+	c.publish(change{Event: Event{Seq: r.Seq(), Type: EVENT_DELETE, Key: key}, bucket: bucket})
 	return nil
 }
 
-func (c *bitcask) ListKeys() ([]string, error) {
-	result := make([]string, 0, len(c.index))
-	for k := range c.index {
-		result = append(result, k)
+func (b *bucket) ListKeys() ([]string, error) {
+	c := b.c
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	kd := c.keydir(b.id)
+	result := make([]string, 0, kd.Len())
+	err := kd.Range(func(key string, _ *index.Set) bool {
+		result = append(result, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
-func (c *bitcask) Merge() error {
-	panic("not implemented")
-}
-
 func (c *bitcask) Sync() bool {
-	err := c.dbFile.Sync()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	// blobs first: a durable pointer must not outlive its value
+	err := c.blobs.Sync()
+	if err != nil {
+		return false
+	}
+	err = c.dbFile.Sync()
 	if err != nil {
 		return false
 	}
@@ -138,9 +652,80 @@ func (c *bitcask) Sync() bool {
 }
 
 func (c *bitcask) Close() bool {
+	// stop background merging first: a running merge needs mu to finish.
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.scheduler.Wait()
+	c.mergeMu.Lock()
+	defer c.mergeMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	for s := range c.subscribers {
+		c.unsubscribe(s, ErrClosed)
+	}
+	indexErr := c.closeIndex(true)
+	blobErr := c.blobs.Close()
 	err := c.dbFile.Close()
-	if err != nil {
+	if err != nil || blobErr != nil || indexErr != nil {
 		return false
 	}
 	return true
 }
+
+// checkSize enforces the key and value size limits.
+func (c *bitcask) checkSize(key string, valueSize int64) error {
+	if len(key) > c.maxKeySize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrKeyTooLarge, len(key), c.maxKeySize)
+	}
+	if valueSize < 0 {
+		return fmt.Errorf("%w: negative size %d", ErrValueTooLarge, valueSize)
+	}
+	if c.maxValueSize > 0 && valueSize > c.maxValueSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrValueTooLarge, valueSize, c.maxValueSize)
+	}
+	return nil
+}
+
+func (c *bitcask) checkWritable() error {
+	if c.closed {
+		return ErrClosed
+	}
+	if c.readOnly || c.replica {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// recordOptions returns the options for a new record of bucket, encrypting
+// under the provider's current key if encryption is on.
+func (c *bitcask) recordOptions(bucket uint32) ([]record.Option, error) {
+	if c.keys == nil && bucket == 0 {
+		return c.recordOpts, nil
+	}
+	opts := make([]record.Option, 0, len(c.recordOpts)+2)
+	opts = append(opts, c.recordOpts...)
+	if bucket != 0 {
+		opts = append(opts, record.WithBucket(bucket))
+	}
+	if c.keys == nil {
+		return opts, nil
+	}
+	keyId := c.keys.provider.CurrentKeyId()
+	aead, err := c.keys.Cipher(keyId)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, record.WithEncryption(keyId, aead)), nil
+}
+
+// keyring returns c.keys as a record.Keyring, nil when encryption is off.
+func (c *bitcask) keyring() record.Keyring {
+	if c.keys == nil {
+		return nil
+	}
+	return c.keys
+}
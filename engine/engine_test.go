@@ -0,0 +1,419 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/machinly/bitcask/engine/compress"
+	"github.com/machinly/bitcask/engine/index"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+func openTestEngine(t *testing.T, dir string, opts ...Option) Engine {
+	t.Helper()
+	e, err := OpenBitcaskEngine(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestKeyNotFound(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	if _, err := e.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := e.Delete("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Close() {
+		t.Fatal("Close() = false")
+	}
+	if err := e.Put("a", "2"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Put() error = %v, want %v", err, ErrClosed)
+	}
+	if _, err := e.Get("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get() error = %v, want %v", err, ErrClosed)
+	}
+	if err := e.Delete("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrClosed)
+	}
+	if _, err := e.ListKeys(); !errors.Is(err, ErrClosed) {
+		t.Errorf("ListKeys() error = %v, want %v", err, ErrClosed)
+	}
+	if e.Sync() {
+		t.Error("Sync() after Close() = true")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	ro := openTestEngine(t, dir, WithReadOnly())
+	if v, err := ro.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Get() = %q, %v, want %q", v, err, "1")
+	}
+	if err := ro.Put("b", "2"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := ro.Delete("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestCorruptRecordLocation(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.db"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("data files = %v, %v", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip the last byte, the value of the second record
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(files[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenBitcaskEngine(dir)
+	var corrupt *ErrCorruptRecord
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("OpenBitcaskEngine() error = %v, want *ErrCorruptRecord", err)
+	}
+	abs, _ := filepath.Abs(files[0])
+	if corrupt.File != abs || corrupt.Offset != int64(len(data)/2) {
+		t.Errorf("corrupt record at %s:%d, want %s:%d", corrupt.File, corrupt.Offset, abs, len(data)/2)
+	}
+}
+
+func TestOpenV1Directory(t *testing.T) {
+	dir := t.TempDir()
+	var data []byte
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}} {
+		r, err := record.NewRecord(kv[0], kv[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := r.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, buf...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data-1.db"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := openTestEngine(t, dir)
+	if v, err := e.Get("a"); err != nil || v != "3" {
+		t.Fatalf("Get(a) = %q, %v, want %q", v, err, "3")
+	}
+	if err := e.Put("b", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("c", "5"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	for key, want := range map[string]string{"a": "3", "b": "4", "c": "5"} {
+		if v, err := e.Get(key); err != nil || v != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+	if seq := e.(*bitcask).seq; seq != 2 {
+		t.Errorf("sequence after reopen = %d, want 2", seq)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	value := strings.Repeat(`{"id":1,"name":"bitcask"},`, 200)
+	sizes := map[compress.Codec]int64{}
+	for _, codec := range []compress.Codec{compress.None, compress.Snappy, compress.Deflate} {
+		dir := t.TempDir()
+		e := openTestEngine(t, dir, WithCompression(codec, 0))
+		for i := 0; i < 10; i++ {
+			if err := e.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := e.Put("small", "tiny"); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := e.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[codec] = stats.ActiveFileSize
+		e.Close()
+
+		// reopened without the option, values still decode
+		e = openTestEngine(t, dir)
+		if err := e.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if v, err := e.Get(fmt.Sprintf("key-%d", i)); err != nil || v != value {
+				t.Fatalf("%s: Get(key-%d) = %d bytes, %v", codec, i, len(v), err)
+			}
+		}
+		if v, err := e.Get("small"); err != nil || v != "tiny" {
+			t.Fatalf("%s: Get(small) = %q, %v", codec, v, err)
+		}
+	}
+	if sizes[compress.Snappy]*5 > sizes[compress.None] || sizes[compress.Deflate] > sizes[compress.Snappy] {
+		t.Errorf("data file sizes = %v", sizes)
+	}
+}
+
+type testKeys struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (k *testKeys) CurrentKeyId() uint32 {
+	return k.current
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: key id %d", ErrMissingKey, id)
+	}
+	return key, nil
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: make([]byte, 32)}}
+	e := openTestEngine(t, dir, WithEncryption(keys))
+	if err := e.Put("a", "plaintext-value"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := e.Get("a"); err != nil || v != "plaintext-value" {
+		t.Fatalf("Get() = %q, %v", v, err)
+	}
+	e.Close()
+	for _, file := range dataFiles(t, dir) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "plaintext") {
+			t.Errorf("%s contains the plaintext value", file)
+		}
+	}
+
+	if _, err := OpenBitcaskEngine(dir); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("OpenBitcaskEngine() without keys error = %v, want %v", err, ErrMissingKey)
+	}
+	wrong := &testKeys{current: 1, keys: map[uint32][]byte{1: []byte(strings.Repeat("x", 32))}}
+	if _, err := OpenBitcaskEngine(dir, WithEncryption(wrong)); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("OpenBitcaskEngine() with wrong key error = %v, want %v", err, ErrWrongKey)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	// values written before encryption was turned on
+	e := openTestEngine(t, dir)
+	if err := e.Put("plain", "1"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: make([]byte, 32)}}
+	e = openTestEngine(t, dir, WithEncryption(keys))
+	if err := e.Put("old", "2"); err != nil {
+		t.Fatal(err)
+	}
+	keys.keys[2] = []byte(strings.Repeat("k", 16))
+	keys.current = 2
+	if err := e.Put("new", "3"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir, WithEncryption(keys))
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	e.(*bitcask).index.Range(func(key string, set *index.Set) bool {
+		if set.Flags&record.V2_ENCRYPTED == 0 || set.KeyId != 2 {
+			t.Errorf("%s: flags, key id after merge = %x, %d, want encrypted under 2", key, set.Flags, set.KeyId)
+		}
+		return true
+	})
+	e.Close()
+
+	// the retired key is no longer needed
+	delete(keys.keys, 1)
+	e = openTestEngine(t, dir, WithEncryption(keys))
+	for key, want := range map[string]string{"plain": "1", "old": "2", "new": "3"} {
+		if v, err := e.Get(key); err != nil || v != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir, WithChecksum(record.CRC32C))
+	if err := e.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	// files holding both checksum types are read back without the option
+	e = openTestEngine(t, dir)
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if v, err := e.Get(key); err != nil || v != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
+
+func TestChecksumDelete(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithChecksum(record.CRC32C))
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	active := e.(*bitcask).dbFile.CurrentFile()
+	e.Close()
+
+	f, err := os.Open(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for _, deleted := range []bool{false, true} {
+		r, err := record.ParseRecord(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Flags()&record.V2_DELETE != 0 != deleted {
+			t.Fatalf("record %q delete flag = %v, want %v", r.Key(), !deleted, deleted)
+		}
+		if c := record.Checksum(r.Flags() & record.V2_CHECKSUM_MASK >> record.V2_CHECKSUM_SHIFT); c != record.CRC32C {
+			t.Errorf("checksum of record %q (deleted %v) = %v, want %v", r.Key(), deleted, c, record.CRC32C)
+		}
+	}
+}
+
+func TestHas(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithBloomFilter(0))
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": false} {
+		if ok, err := e.Has(key); err != nil || ok != want {
+			t.Errorf("Has(%s) = %v, %v, want %v", key, ok, err, want)
+		}
+	}
+	e.Close()
+	if _, err := e.Has("a"); err != ErrClosed {
+		t.Errorf("Has() after Close error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithWriteBuffer(1<<20, time.Hour))
+	for i := 0; i < 100; i++ {
+		if err := e.Put(fmt.Sprint(i), fmt.Sprint("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Delete("0"); err != nil {
+		t.Fatal(err)
+	}
+	// buffered records are read back from memory
+	if v, err := e.Get("99"); err != nil || v != "v99" {
+		t.Errorf("Get() of a buffered record = %q, %v", v, err)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	if keys, _ := e.ListKeys(); len(keys) != 99 {
+		t.Errorf("ListKeys() after reopening = %d keys, want 99", len(keys))
+	}
+	if v, err := e.Get("42"); err != nil || v != "v42" {
+		t.Errorf("Get() after reopening = %q, %v", v, err)
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{"unbuffered", nil},
+		{"buffered", []Option{WithWriteBuffer(64<<10, 0)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			e, err := OpenBitcaskEngine(b.TempDir(), bench.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer e.Close()
+			value := strings.Repeat("v", 100)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := e.Put(fmt.Sprint(i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
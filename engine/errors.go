@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"errors"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/index"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+// Errors returned by the engine. They are shared with the lower layers so
+// errors.Is works whichever layer produced the error.
+var (
+	ErrKeyNotFound        = index.ErrKeyNotFound
+	ErrKeyTooLarge        = record.ErrKeyTooLarge
+	ErrValueTooLarge      = record.ErrValueTooLarge
+	ErrUnsupportedVersion = record.ErrUnsupportedVersion
+	ErrClosed             = dbfile.ErrClosed
+	ErrReadOnly           = dbfile.ErrReadOnly
+	ErrMissingKey         = record.ErrMissingKey
+	ErrWrongKey           = record.ErrWrongKey
+)
+
+// Errors of Incr, see its documentation for the counter format.
+var (
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrOverflow   = errors.New("integer overflow")
+)
+
+// ErrCorruptRecord carries the data file and offset of a record that failed
+// its checksum or could not be decoded. Use errors.As to inspect it.
+type ErrCorruptRecord = record.ErrCorruptRecord
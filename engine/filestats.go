@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"github.com/machinly/bitcask/engine/index"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+// fileStats tracks how many bytes of a data file have been written and how
+// many of those are no longer referenced by the keydir. Dead bytes are what
+// a merge reclaims.
+type fileStats struct {
+	totalBytes int64
+	deadBytes  int64
+	tombstones int64
+	// maxSeq is the highest sequence number in the file, zero if unknown.
+	maxSeq uint64
+}
+
+func (s *fileStats) addSeq(seq uint64) {
+	if seq > s.maxSeq {
+		s.maxSeq = seq
+	}
+}
+
+func (s *fileStats) deadRatio() float64 {
+	if s.totalBytes == 0 {
+		return 0
+	}
+	return float64(s.deadBytes) / float64(s.totalBytes)
+}
+
+// fileStats returns the stats for fileName, creating them on first use. The
+// caller holds mu.
+func (c *bitcask) fileStats(fileName string) *fileStats {
+	s, ok := c.files[fileName]
+	if !ok {
+		s = &fileStats{}
+		c.files[fileName] = s
+	}
+	return s
+}
+
+// markDead accounts the record that set points at as garbage, called when a
+// newer record for key in bucket supersedes it. blob is the blob of the new
+// record; a pointer copied by a merge keeps its blob alive.
+func (c *bitcask) markDead(bucket uint32, key string, set index.Set, blob *index.Blob) {
+	c.fileStats(set.FileId).deadBytes += recordSize(bucket, key, set)
+	if set.Blob != nil && (blob == nil || *blob != *set.Blob) {
+		c.fileStats(set.Blob.FileId).deadBytes += blobRecordSize(bucket, key, set)
+	}
+}
+
+// recordSize is the on-disk size of the record a keydir entry points at.
+// Only V2 records have a sequence number.
+func recordSize(bucket uint32, key string, set index.Set) int64 {
+	keySize := int64(len(key))
+	if set.Seq == 0 {
+		return record.V1_RECORD_SIZE + keySize + set.ValueSize
+	}
+	return record.HeaderSizeV2(set.Flags, set.KeyId, bucket, set.Seq, set.Tstamp, keySize, set.ValueSize) + keySize + set.ValueSize
+}
+
+// blobRecordSize is the size of the blob record behind a pointer record,
+// which shares its bucket, sequence number and timestamp.
+func blobRecordSize(bucket uint32, key string, set index.Set) int64 {
+	keySize := int64(len(key))
+	blob := set.Blob
+	return record.HeaderSizeV2(blob.Flags, blob.KeyId, bucket, set.Seq, set.Tstamp, keySize, blob.ValueSize) + keySize + blob.ValueSize
+}
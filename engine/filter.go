@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/machinly/bitcask/engine/bloom"
+	"github.com/machinly/bitcask/engine/index"
+)
+
+const (
+	DEFAULT_BLOOM_RATE = 0.01
+	// BLOOM_FILTER_FILE is where the filter is kept next to a persistent
+	// index.
+	BLOOM_FILTER_FILE = "keys.bloom"
+	// BLOOM_MIN_CAPACITY is the smallest number of keys a filter is sized
+	// for.
+	BLOOM_MIN_CAPACITY = 1 << 16
+)
+
+// mayContain reports false if key is certainly not in the keydir, counting
+// the lookups the filter answers. It is always true without a filter. The
+// caller holds mu.
+func (c *bitcask) mayContain(key string) bool {
+	if c.filter == nil || c.filter.MayContain(key) {
+		return true
+	}
+	atomic.AddInt64(&c.filterNegatives, 1)
+	return false
+}
+
+// addToFilter records a key new to the keydir, rebuilding the filter
+// larger once it's full. The caller holds mu.
+func (c *bitcask) addToFilter(key string) error {
+	if c.filter == nil {
+		return nil
+	}
+	c.filter.Add(key)
+	if c.filter.Full() {
+		return c.buildFilter()
+	}
+	return nil
+}
+
+// buildFilter replaces the filter with one holding the keys of the keydir,
+// sized for twice as many. Deleted keys drop out. The caller holds mu.
+func (c *bitcask) buildFilter() error {
+	if c.filterRate <= 0 {
+		return nil
+	}
+	capacity := uint64(2 * c.index.Len())
+	if capacity < BLOOM_MIN_CAPACITY {
+		capacity = BLOOM_MIN_CAPACITY
+	}
+	f := bloom.New(capacity, c.filterRate)
+	err := c.index.Range(func(key string, _ *index.Set) bool {
+		f.Add(key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	c.filter = f
+	return nil
+}
+
+// loadFilter reads the filter saved along with a persistent index that was
+// restored with stamp, and builds a new one if there is none that matches.
+func (c *bitcask) loadFilter(stamp []byte) error {
+	if c.filterRate <= 0 {
+		return nil
+	}
+	buf, err := os.ReadFile(filepath.Join(c.blobDir, BLOOM_FILTER_FILE))
+	if err != nil {
+		return c.buildFilter()
+	}
+	// | stamp size 4 | stamp | filter |
+	if len(buf) < 4 || uint64(len(buf)-4) < uint64(binary.BigEndian.Uint32(buf)) {
+		return c.buildFilter()
+	}
+	size := binary.BigEndian.Uint32(buf)
+	f := &bloom.Filter{}
+	if string(buf[4:4+size]) != string(stamp) || f.UnmarshalBinary(buf[4+size:]) != nil || f.Rate() != c.filterRate {
+		return c.buildFilter()
+	}
+	c.filter = f
+	return nil
+}
+
+// saveFilter writes the filter for the next open to load along with the
+// persistent index stamped with stamp. The caller holds mu.
+func (c *bitcask) saveFilter(stamp []byte) error {
+	if c.filter == nil {
+		return nil
+	}
+	filter, err := c.filter.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(stamp)+len(filter))
+	binary.BigEndian.PutUint32(buf, uint32(len(stamp)))
+	buf = append(buf, stamp...)
+	buf = append(buf, filter...)
+	fileName := filepath.Join(c.blobDir, BLOOM_FILTER_FILE)
+	err = os.WriteFile(fileName+".tmp", buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
@@ -0,0 +1,365 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+const (
+	FOLLOWER_DIAL_TIMEOUT  = 5 * time.Second
+	FOLLOWER_RETRY_BACKOFF = 100 * time.Millisecond
+)
+
+// Follower is a warm standby: an engine that replicates the files of a
+// Leader into its own directory and applies them to its keydir as they
+// arrive. Reads see the leader's writes once they are replicated; writes
+// fail with ErrReadOnly until the follower is promoted. Merges aren't run,
+// the leader's are replicated.
+type Follower struct {
+	Engine
+	c    *bitcask
+	opts options
+	addr string
+
+	mu sync.Mutex
+	// applied is how much of each data file is applied to the keydir; a
+	// record can arrive in pieces. pending is where the incomplete record
+	// after applied ends, once its header has arrived.
+	applied  map[string]int64
+	pending  map[string]int64
+	position ReplicationPosition
+	err      error
+	conn     net.Conn
+	stopped  bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// OpenFollower opens the engine in dir as a follower of the leader at addr,
+// see Leader.Serve. It replicates in the background, reconnecting when the
+// connection drops, until it is closed or promoted.
+func OpenFollower(dir, addr string, opts ...Option) (*Follower, error) {
+	opts = append(opts[:len(opts):len(opts)], func(o *options) { o.replica = true })
+	e, err := OpenBitcaskEngine(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	f := &Follower{
+		Engine:  e,
+		c:       e.(*bitcask),
+		addr:    addr,
+		applied: make(map[string]int64),
+		pending: make(map[string]int64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&f.opts)
+	}
+	f.opts.replica = false
+	f.position.Seq = f.c.seq
+	// everything on disk was replayed by the open
+	for _, fileName := range f.c.dbFile.FileList() {
+		size, err := f.c.dbFile.Size(fileName)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		f.applied[fileName] = size
+		f.position.File, f.position.Offset = filepath.Base(fileName), size
+	}
+	go f.run()
+	return f, nil
+}
+
+// Position returns how far the follower has replicated.
+func (f *Follower) Position() ReplicationPosition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.position
+}
+
+// Err returns the error that last interrupted replication, nil if none
+// did since the follower last connected.
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Promote stops replicating and makes the follower writable, so it can take
+// over from its leader. The leader should be stopped first: writes it makes
+// afterwards are not replicated.
+func (f *Follower) Promote() error {
+	f.stopReplication()
+	err := f.trim()
+	if err != nil {
+		return err
+	}
+	return f.c.promote(f.opts)
+}
+
+// Close stops replicating and closes the engine.
+func (f *Follower) Close() bool {
+	f.stopReplication()
+	_ = f.trim()
+	return f.Engine.Close()
+}
+
+// trim cuts the data files back to the records applied, dropping the part
+// of a record that arrived before replication stopped. The leader sends
+// the record again from its start.
+func (f *Follower) trim() error {
+	c := f.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for fileName, applied := range f.applied {
+		size, err := c.dbFile.Size(fileName)
+		if err != nil {
+			return err
+		}
+		if size > applied {
+			err = c.dbFile.Truncate(fileName, applied)
+			if err != nil {
+				return err
+			}
+		}
+		delete(f.pending, fileName)
+	}
+	return nil
+}
+
+func (f *Follower) stopReplication() {
+	f.mu.Lock()
+	if !f.stopped {
+		f.stopped = true
+		close(f.stop)
+		if f.conn != nil {
+			_ = f.conn.Close()
+		}
+	}
+	f.mu.Unlock()
+	<-f.done
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		err := f.replicate()
+		f.mu.Lock()
+		if !f.stopped {
+			f.err = err
+		}
+		f.mu.Unlock()
+		if errors.Is(err, ErrReplicaDiverged) || errors.Is(err, ErrClosed) {
+			return
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(FOLLOWER_RETRY_BACKOFF):
+		}
+	}
+}
+
+// replicate follows the leader until the connection fails.
+func (f *Follower) replicate() error {
+	conn, err := net.DialTimeout("tcp", f.addr, FOLLOWER_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.err = nil
+	f.mu.Unlock()
+
+	hello, err := f.hello()
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	err = enc.Encode(&hello)
+	if err != nil {
+		return err
+	}
+	for {
+		var m replicaMessage
+		err := dec.Decode(&m)
+		if err != nil {
+			return err
+		}
+		if m.Err != "" {
+			return fmt.Errorf("%w: %s", ErrReplicaDiverged, m.Err)
+		}
+		pos, err := f.apply(&m)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(&pos)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hello lists the files the follower has.
+func (f *Follower) hello() (replicaHello, error) {
+	var hello replicaHello
+	for _, files := range []struct {
+		kind byte
+		db   dbfile.DBFile
+	}{{replicaData, f.c.dbFile}, {replicaBlob, f.c.blobs}} {
+		for _, fileName := range files.db.FileList() {
+			size, err := files.db.Size(fileName)
+			if err != nil {
+				return replicaHello{}, err
+			}
+			hello.Files = append(hello.Files, replicaFile{Kind: files.kind, Name: filepath.Base(fileName), Size: size})
+		}
+	}
+	return hello, nil
+}
+
+// apply writes a message of the leader to the files and the keydir and
+// returns the new position.
+func (f *Follower) apply(m *replicaMessage) (ReplicationPosition, error) {
+	c := f.c
+	db := c.dbFile
+	if m.Kind == replicaBlob {
+		db = c.blobs
+	}
+	var fileName string
+	if !m.Remove {
+		// outside mu: the bytes aren't referenced by the keydir yet
+		var err error
+		fileName, err = db.Replicate(m.Name, m.Offset, m.Data)
+		if err != nil {
+			return ReplicationPosition{}, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ReplicationPosition{}, ErrClosed
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case m.Remove:
+		fileName = filepath.Join(c.blobDir, m.Name)
+		err := db.Remove(fileName)
+		if err != nil && !errors.Is(err, dbfile.ErrFileNotFound) {
+			return ReplicationPosition{}, err
+		}
+		delete(c.files, fileName)
+		delete(f.applied, fileName)
+		delete(f.pending, fileName)
+	case m.Kind == replicaBlob:
+		c.fileStats(fileName).totalBytes += int64(len(m.Data))
+	default:
+		end := m.Offset + int64(len(m.Data))
+		// a large record arrives in many messages, only read it once whole
+		if end >= f.pending[fileName] {
+			n, next, err := c.replayRange(fileName, f.applied[fileName], end)
+			f.applied[fileName] += n
+			f.pending[fileName] = next
+			if err != nil {
+				return ReplicationPosition{}, err
+			}
+		}
+		f.position.File, f.position.Offset = m.Name, end
+	}
+	f.position.Seq = c.seq
+	return f.position, nil
+}
+
+// replayRange replays the complete records of fileName between from and
+// to and returns how many bytes they take. If the range ends inside a
+// record whose header is there, it also returns where that record ends, so
+// the caller can wait for the rest. The caller holds mu.
+func (c *bitcask) replayRange(fileName string, from, to int64) (n, next int64, err error) {
+	reader := bufio.NewReader(&valueReader{dbFile: c.dbFile, fileName: fileName, offset: from, remaining: to - from})
+	for from+n < to {
+		h, err := record.ParseHeader(reader)
+		if _, ok := truncatedAt(err); ok {
+			// the rest of the header is still to come
+			return n, 0, nil
+		}
+		if err != nil {
+			return n, 0, record.WithLocation(err, fileName, from+n)
+		}
+		end := from + n + h.Record().Len()
+		if end > to {
+			return n, end, nil
+		}
+		r, err := c.scanValue(h)
+		if err != nil {
+			return n, 0, record.WithLocation(err, fileName, from+n)
+		}
+		err = c.replayRecord(fileName, from+n, r)
+		if err != nil {
+			return n, 0, err
+		}
+		n = end - from
+	}
+	return n, 0, nil
+}
+
+// truncatedAt reports whether err is a record cut off by the end of its
+// input, and where the record starts if the error says.
+func truncatedAt(err error) (int64, bool) {
+	var corrupt *ErrCorruptRecord
+	if !errors.As(err, &corrupt) || !corrupt.Truncated {
+		return 0, false
+	}
+	return corrupt.Offset, true
+}
+
+// promote reopens the files of a replica for writing.
+func (c *bitcask) promote(o options) error {
+	c.mergeMu.Lock()
+	defer c.mergeMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if !c.replica {
+		return nil
+	}
+	dbFile, blobs, err := o.openFiles(c.blobDir)
+	if err != nil {
+		return err
+	}
+	// the keydir refers to the files by name, which stay the same
+	_ = c.dbFile.Close()
+	_ = c.blobs.Close()
+	c.dbFile, c.blobs = dbFile, blobs
+	c.replica = false
+	if o.mergePolicy.enabled() {
+		c.scheduler.Add(1)
+		go c.runMergeScheduler()
+	}
+	return nil
+}
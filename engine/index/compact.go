@@ -0,0 +1,266 @@
+package index
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// COMPACT_SLAB_SIZE is the size of the arena slabs entries are packed
+	// into. Larger entries get a slab of their own.
+	COMPACT_SLAB_SIZE = 1 << 20
+	// COMPACT_MIN_SLOTS is the initial size of the hash table.
+	COMPACT_MIN_SLOTS = 1 << 10
+)
+
+// hash table tags: one byte per slot, the top bits of the key's hash for
+// occupied slots so most mismatches are rejected without touching the arena.
+const (
+	tagEmpty   = 0
+	tagDeleted = 1
+	tagUsed    = 0x80
+)
+
+// compactIndex keeps its entries as varint-encoded byte strings in large
+// arena slabs, with the key stored inline, and finds them through an open
+// addressing hash table of packed slab/offset references. File names are
+// replaced by uint32 ids. That takes about half the memory per key of the
+// map index, see BenchmarkIndexMemory, and leaves the collector next to
+// nothing to scan.
+//
+// Overwriting an entry appends the new encoding; the arena is compacted
+// once more than half of it is dead. Get doesn't modify anything, so
+// concurrent Gets are safe as long as no Put or Delete runs.
+type compactIndex struct {
+	slabs [][]byte
+	// slots hold slab<<32 | offset for the entry; tags say which are used.
+	slots   []uint64
+	tags    []byte
+	used    int
+	deleted int
+
+	liveBytes  int64
+	arenaBytes int64
+
+	files fileTable
+
+	scratch []byte
+}
+
+// NewCompactIndex returns an Index that trades some CPU for a much smaller
+// memory footprint than NewIndex.
+func NewCompactIndex() Index {
+	return &compactIndex{
+		slots: make([]uint64, COMPACT_MIN_SLOTS),
+		tags:  make([]byte, COMPACT_MIN_SLOTS),
+		files: newFileTable(),
+	}
+}
+
+// hashKey is 64 bit FNV-1a, inlined to avoid allocating for the key.
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func hashTag(h uint64) byte {
+	return tagUsed | byte(h>>57)
+}
+
+// find returns the slot holding key, or -1.
+func (c *compactIndex) find(key string) int {
+	h := hashKey(key)
+	tag := hashTag(h)
+	mask := uint64(len(c.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		switch c.tags[i] {
+		case tagEmpty:
+			return -1
+		case tag:
+			if c.keyAt(c.slots[i]) == key {
+				return int(i)
+			}
+		}
+	}
+}
+
+func (c *compactIndex) entry(ref uint64) []byte {
+	return c.slabs[ref>>32][uint32(ref):]
+}
+
+func (c *compactIndex) keyAt(ref uint64) string {
+	buf := c.entry(ref)
+	n, size := binary.Uvarint(buf)
+	return string(buf[size : size+int(n)])
+}
+
+func (c *compactIndex) Get(key string) (*Set, error) {
+	i := c.find(key)
+	if i < 0 {
+		return nil, ErrKeyNotFound
+	}
+	set, _ := c.decode(c.entry(c.slots[i]))
+	return set, nil
+}
+
+func (c *compactIndex) Put(key string, value *Set) error {
+	if (c.used+c.deleted+1)*4 > len(c.slots)*3 {
+		c.resize()
+	}
+	ref, size := c.append(key, value)
+	i := c.find(key)
+	if i >= 0 {
+		c.liveBytes -= int64(c.entrySize(c.slots[i]))
+		c.slots[i] = ref
+		c.liveBytes += size
+		c.maybeCompact()
+		return nil
+	}
+	h := hashKey(key)
+	mask := uint64(len(c.slots) - 1)
+	for j := h & mask; ; j = (j + 1) & mask {
+		if c.tags[j] == tagEmpty || c.tags[j] == tagDeleted {
+			if c.tags[j] == tagDeleted {
+				c.deleted--
+			}
+			c.tags[j] = hashTag(h)
+			c.slots[j] = ref
+			c.used++
+			c.liveBytes += size
+			return nil
+		}
+	}
+}
+
+func (c *compactIndex) Delete(key string) error {
+	i := c.find(key)
+	if i < 0 {
+		return nil
+	}
+	c.liveBytes -= int64(c.entrySize(c.slots[i]))
+	c.tags[i] = tagDeleted
+	c.slots[i] = 0
+	c.used--
+	c.deleted++
+	c.maybeCompact()
+	return nil
+}
+
+func (c *compactIndex) Len() int {
+	return c.used
+}
+
+func (c *compactIndex) Range(fn func(key string, value *Set) bool) error {
+	for i, tag := range c.tags {
+		if tag&tagUsed == 0 {
+			continue
+		}
+		set, _ := c.decode(c.entry(c.slots[i]))
+		if !fn(c.keyAt(c.slots[i]), set) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *compactIndex) MemSize() int64 {
+	size := int64(len(c.slots))*8 + int64(len(c.tags)) + int64(cap(c.scratch))
+	for _, slab := range c.slabs {
+		size += int64(cap(slab))
+	}
+	return size + c.files.memSize()
+}
+
+// resize rehashes into a table twice as large, or the same size when most
+// of the load is deleted slots.
+func (c *compactIndex) resize() {
+	n := len(c.slots)
+	if (c.used+1)*2 > n {
+		n *= 2
+	}
+	slots, tags := c.slots, c.tags
+	c.slots = make([]uint64, n)
+	c.tags = make([]byte, n)
+	c.deleted = 0
+	mask := uint64(n - 1)
+	for i, tag := range tags {
+		if tag&tagUsed == 0 {
+			continue
+		}
+		h := hashKey(c.keyAt(slots[i]))
+		j := h & mask
+		for c.tags[j] != tagEmpty {
+			j = (j + 1) & mask
+		}
+		c.tags[j] = tag
+		c.slots[j] = slots[i]
+	}
+}
+
+// maybeCompact rewrites the arena once more than half of it is dead.
+func (c *compactIndex) maybeCompact() {
+	if c.arenaBytes < 4*COMPACT_SLAB_SIZE || c.arenaBytes < 2*c.liveBytes {
+		return
+	}
+	slabs := c.slabs
+	c.slabs = nil
+	c.arenaBytes = 0
+	for i, tag := range c.tags {
+		if tag&tagUsed == 0 {
+			continue
+		}
+		ref := c.slots[i]
+		buf := slabs[ref>>32][uint32(ref):]
+		c.slots[i] = c.appendBytes(buf[:c.entrySizeIn(buf)])
+	}
+}
+
+// append encodes key and value into the arena and returns its reference
+// and size.
+func (c *compactIndex) append(key string, value *Set) (uint64, int64) {
+	c.scratch = c.encode(c.scratch[:0], key, value)
+	return c.appendBytes(c.scratch), int64(len(c.scratch))
+}
+
+func (c *compactIndex) appendBytes(buf []byte) uint64 {
+	last := len(c.slabs) - 1
+	if last < 0 || cap(c.slabs[last])-len(c.slabs[last]) < len(buf) {
+		size := COMPACT_SLAB_SIZE
+		if len(buf) > size {
+			size = len(buf)
+		}
+		c.slabs = append(c.slabs, make([]byte, 0, size))
+		last++
+	}
+	offset := len(c.slabs[last])
+	c.slabs[last] = append(c.slabs[last], buf...)
+	c.arenaBytes += int64(len(buf))
+	return uint64(last)<<32 | uint64(offset)
+}
+
+// | key size uvarint | key | set, see encodeSet |
+func (c *compactIndex) encode(buf []byte, key string, set *Set) []byte {
+	buf = appendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	return encodeSet(buf, &c.files, set)
+}
+
+// decode returns the entry at the start of buf and its encoded size.
+func (c *compactIndex) decode(buf []byte) (*Set, int) {
+	d := decoder{buf: buf}
+	d.bytes()
+	set := decodeSet(&d, &c.files)
+	return set, d.pos
+}
+
+func (c *compactIndex) entrySize(ref uint64) int {
+	return c.entrySizeIn(c.entry(ref))
+}
+
+func (c *compactIndex) entrySizeIn(buf []byte) int {
+	_, n := c.decode(buf)
+	return n
+}
@@ -0,0 +1,680 @@
+package index
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	DISK_PAGE_SIZE           = 4096
+	DEFAULT_DISK_CACHE_PAGES = 1024 // 4MB
+	// DISK_INDEX_FILE is the name of the index file in the data directory.
+	DISK_INDEX_FILE = "keydir.idx"
+	// maxDiskDepth bounds the directory at 2^maxDiskDepth buckets. Buckets
+	// that can't be split further span several pages.
+	maxDiskDepth = 24
+	// bucketHeaderSize is the crc and the room reserved for the entry count.
+	bucketHeaderSize = 4 + binary.MaxVarintLen64
+)
+
+var (
+	diskIndexMagic = []byte("BCKEYDIR")
+
+	ErrCorruptIndex = errors.New("corrupt index file")
+)
+
+// | magic 8 | clean 1 | meta offset 8 | meta size 8 | meta crc 4 |
+const diskHeaderSize = 8 + 1 + 8 + 8 + 4
+
+type diskOptions struct {
+	cachePages int
+}
+
+type DiskOption func(*diskOptions)
+
+// WithCachePages keeps up to n bucket pages in memory, DEFAULT_DISK_CACHE_PAGES
+// by default.
+func WithCachePages(n int) DiskOption {
+	return func(o *diskOptions) {
+		if n > 0 {
+			o.cachePages = n
+		}
+	}
+}
+
+var _ Persistent = (*DiskIndex)(nil)
+
+// DiskIndex is an Index kept in a file, for keydirs that don't fit in
+// memory. It is an extendible hash table: a directory indexed by the low
+// bits of the key's hash points at buckets of one page each, so a Get costs
+// at most one page read. Only the directory and a small LRU cache of
+// buckets are held in memory; modified buckets are written back when they
+// are evicted.
+//
+// The file is only consistent after Close, which marks it clean. A file
+// that wasn't closed cleanly is discarded on open and Clean reports false,
+// the caller is then expected to rebuild the index. DiskIndex is safe for
+// concurrent use.
+type DiskIndex struct {
+	mu    sync.Mutex
+	file  *os.File
+	opts  diskOptions
+	clean bool
+	// unclean is set once the header has been marked unclean on disk,
+	// which must happen before the first write to the file.
+	unclean bool
+	closed  bool
+	stamp   []byte
+	// stampChanged is set when SetStamp changes the stamp.
+	stampChanged bool
+
+	depth   uint8
+	dir     []uint32 // hash low bits to bucket id
+	buckets []extent
+	count   int
+	files   fileTable
+	free    map[uint32][]int64 // extent offsets by size in pages
+	end     int64
+
+	cache map[uint32]*bucket
+	lru   *list.List // of *bucket, most recently used at the front
+	// reads counts bucket reads, for tests.
+	reads int64
+}
+
+// extent is where a bucket is stored. offset is -1 until it is first
+// written.
+type extent struct {
+	offset int64
+	pages  uint32
+	depth  uint8
+}
+
+type bucket struct {
+	id uint32
+	// entries maps keys to encoded sets, see encodeSet.
+	entries map[string][]byte
+	size    int
+	dirty   bool
+	elem    *list.Element
+}
+
+func entrySize(key string, value []byte) int {
+	return uvarintLen(uint64(len(key))) + len(key) + uvarintLen(uint64(len(value))) + len(value)
+}
+
+func uvarintLen(v uint64) int {
+	var tmp [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(tmp[:], v)
+}
+
+// OpenDiskIndex opens the index file at path, creating it if needed.
+func OpenDiskIndex(path string, opts ...DiskOption) (*DiskIndex, error) {
+	o := diskOptions{cachePages: DEFAULT_DISK_CACHE_PAGES}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskIndex{
+		file:  f,
+		opts:  o,
+		free:  make(map[uint32][]int64),
+		cache: make(map[uint32]*bucket),
+		lru:   list.New(),
+	}
+	err = d.load()
+	if err != nil {
+		err = d.reset()
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Clean reports whether the index was loaded from a cleanly closed file.
+// Otherwise it starts out empty.
+func (d *DiskIndex) Clean() bool {
+	return d.clean
+}
+
+// Stamp returns the data stored with SetStamp before the index was last
+// closed, nil unless Clean.
+func (d *DiskIndex) Stamp() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stamp
+}
+
+// SetStamp stores b with the index on Close. Callers use it to tell
+// whether a clean index still matches their data.
+func (d *DiskIndex) SetStamp(b []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !bytes.Equal(d.stamp, b) {
+		d.stamp = append([]byte(nil), b...)
+		d.stampChanged = true
+	}
+}
+
+func (d *DiskIndex) load() error {
+	header := make([]byte, diskHeaderSize)
+	_, err := d.file.ReadAt(header, 0)
+	if err != nil {
+		return err
+	}
+	if string(header[:8]) != string(diskIndexMagic) || header[8] != 1 {
+		return ErrCorruptIndex
+	}
+	metaOffset := int64(binary.BigEndian.Uint64(header[9:]))
+	metaSize := int64(binary.BigEndian.Uint64(header[17:]))
+	stat, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	// the header is trusted only as far as the file backs it up
+	if metaOffset < diskHeaderSize || metaSize < 0 || metaOffset > stat.Size() || metaSize > stat.Size()-metaOffset {
+		return ErrCorruptIndex
+	}
+	buf := make([]byte, metaSize)
+	_, err = d.file.ReadAt(buf, metaOffset)
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(header[25:]) {
+		return ErrCorruptIndex
+	}
+	err = d.decodeMeta(buf)
+	if err != nil {
+		return err
+	}
+	// the metadata is rewritten on close, its pages can be reused
+	meta := extent{offset: metaOffset, pages: pagesFor(int(metaSize))}
+	d.release(meta)
+	d.grow(meta)
+	d.clean = true
+	return nil
+}
+
+// reset empties the index.
+func (d *DiskIndex) reset() error {
+	err := d.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	d.clean = false
+	d.unclean = true
+	d.stamp = nil
+	d.depth = 0
+	d.dir = []uint32{0}
+	d.buckets = []extent{{offset: -1}}
+	d.count = 0
+	d.files = newFileTable()
+	d.free = make(map[uint32][]int64)
+	d.end = DISK_PAGE_SIZE
+	d.add(&bucket{id: 0, entries: make(map[string][]byte), size: bucketHeaderSize, dirty: true})
+	return nil
+}
+
+// | depth 1 | count uvarint | buckets uvarint | [page uvarint | pages uvarint | depth 1] |
+// | directory, bucket id uvarints | files uvarint | [name bytes] |
+// | free extents uvarint | [page uvarint | pages uvarint] | stamp bytes |
+//
+// where bytes are a uvarint length and the data. Offsets are in pages.
+func (d *DiskIndex) encodeMeta() []byte {
+	buf := []byte{d.depth}
+	buf = appendUvarint(buf, uint64(d.count))
+	buf = appendUvarint(buf, uint64(len(d.buckets)))
+	for _, ext := range d.buckets {
+		buf = appendUvarint(buf, uint64(ext.offset/DISK_PAGE_SIZE))
+		buf = appendUvarint(buf, uint64(ext.pages))
+		buf = append(buf, ext.depth)
+	}
+	for _, id := range d.dir {
+		buf = appendUvarint(buf, uint64(id))
+	}
+	buf = appendUvarint(buf, uint64(len(d.files.names)))
+	for _, name := range d.files.names {
+		buf = appendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	free := 0
+	for _, offsets := range d.free {
+		free += len(offsets)
+	}
+	buf = appendUvarint(buf, uint64(free))
+	for pages, offsets := range d.free {
+		for _, offset := range offsets {
+			buf = appendUvarint(buf, uint64(offset/DISK_PAGE_SIZE))
+			buf = appendUvarint(buf, uint64(pages))
+		}
+	}
+	buf = appendUvarint(buf, uint64(len(d.stamp)))
+	return append(buf, d.stamp...)
+}
+
+func (d *DiskIndex) decodeMeta(buf []byte) (err error) {
+	// the checksum matched, anything out of range is a bug in this file
+	defer func() {
+		if recover() != nil {
+			err = ErrCorruptIndex
+		}
+	}()
+	dec := decoder{buf: buf}
+	d.end = DISK_PAGE_SIZE
+	d.depth = dec.byte()
+	if d.depth > maxDiskDepth {
+		return ErrCorruptIndex
+	}
+	d.count = int(dec.uvarint())
+	d.buckets = make([]extent, dec.uvarint())
+	for i := range d.buckets {
+		d.buckets[i] = extent{
+			offset: int64(dec.uvarint()) * DISK_PAGE_SIZE,
+			pages:  uint32(dec.uvarint()),
+			depth:  dec.byte(),
+		}
+		d.grow(d.buckets[i])
+	}
+	d.dir = make([]uint32, 1<<d.depth)
+	for i := range d.dir {
+		d.dir[i] = uint32(dec.uvarint())
+		if int(d.dir[i]) >= len(d.buckets) {
+			return ErrCorruptIndex
+		}
+	}
+	d.files = newFileTable()
+	for i := dec.uvarint(); i > 0; i-- {
+		d.files.id(string(dec.bytes()))
+	}
+	for i := dec.uvarint(); i > 0; i-- {
+		ext := extent{offset: int64(dec.uvarint()) * DISK_PAGE_SIZE, pages: uint32(dec.uvarint())}
+		d.release(ext)
+		d.grow(ext)
+	}
+	d.stamp = append([]byte(nil), dec.bytes()...)
+	return nil
+}
+
+func pagesFor(size int) uint32 {
+	return uint32((size + DISK_PAGE_SIZE - 1) / DISK_PAGE_SIZE)
+}
+
+// markUnclean clears the clean flag on disk before the index is first
+// modified, so that a crash leaves it to be rebuilt even if no bucket was
+// written back yet.
+func (d *DiskIndex) markUnclean() error {
+	if d.unclean {
+		return nil
+	}
+	_, err := d.file.WriteAt([]byte{0}, 8)
+	if err != nil {
+		return err
+	}
+	err = d.file.Sync()
+	if err != nil {
+		return err
+	}
+	d.unclean = true
+	return nil
+}
+
+func (d *DiskIndex) alloc(pages uint32) int64 {
+	if offsets := d.free[pages]; len(offsets) > 0 {
+		offset := offsets[len(offsets)-1]
+		d.free[pages] = offsets[:len(offsets)-1]
+		return offset
+	}
+	offset := d.end
+	d.end += int64(pages) * DISK_PAGE_SIZE
+	return offset
+}
+
+// grow moves the end of the file past ext.
+func (d *DiskIndex) grow(ext extent) {
+	if end := ext.offset + int64(ext.pages)*DISK_PAGE_SIZE; end > d.end {
+		d.end = end
+	}
+}
+
+func (d *DiskIndex) release(ext extent) {
+	if ext.offset < 0 || ext.pages == 0 {
+		return
+	}
+	d.free[ext.pages] = append(d.free[ext.pages], ext.offset)
+}
+
+// bucketFor returns the bucket key hashes to, reading it if needed.
+func (d *DiskIndex) bucketFor(key string) (*bucket, error) {
+	h := hashKey(key)
+	return d.bucket(d.dir[h&(1<<d.depth-1)])
+}
+
+func (d *DiskIndex) bucket(id uint32) (*bucket, error) {
+	if b, ok := d.cache[id]; ok {
+		d.lru.MoveToFront(b.elem)
+		return b, nil
+	}
+	ext := d.buckets[id]
+	buf := make([]byte, int(ext.pages)*DISK_PAGE_SIZE)
+	_, err := d.file.ReadAt(buf, ext.offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	d.reads++
+	b, err := decodeBucket(id, buf)
+	if err != nil {
+		return nil, err
+	}
+	d.add(b)
+	return b, nil
+}
+
+func (d *DiskIndex) add(b *bucket) {
+	b.elem = d.lru.PushFront(b)
+	d.cache[b.id] = b
+}
+
+// shrink evicts buckets until the cache is within its size, writing
+// modified ones back.
+func (d *DiskIndex) shrink() error {
+	for d.lru.Len() > d.opts.cachePages {
+		b := d.lru.Back().Value.(*bucket)
+		if b.dirty {
+			err := d.writeBucket(b)
+			if err != nil {
+				return err
+			}
+		}
+		d.lru.Remove(b.elem)
+		delete(d.cache, b.id)
+	}
+	return nil
+}
+
+// | crc 4 | entries uvarint | [key bytes | set bytes] |
+func (d *DiskIndex) writeBucket(b *bucket) error {
+	err := d.markUnclean()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, b.size)
+	buf = appendUvarint(buf, uint64(len(b.entries)))
+	for key, value := range b.entries {
+		buf = appendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = appendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+
+	ext := &d.buckets[b.id]
+	pages := pagesFor(len(buf))
+	if ext.offset < 0 || ext.pages < pages {
+		d.release(*ext)
+		ext.offset = d.alloc(pages)
+		ext.pages = pages
+	}
+	_, err = d.file.WriteAt(buf, ext.offset)
+	if err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+func decodeBucket(id uint32, buf []byte) (b *bucket, err error) {
+	defer func() {
+		if recover() != nil {
+			b, err = nil, ErrCorruptIndex
+		}
+	}()
+	dec := decoder{buf: buf, pos: 4}
+	n := dec.uvarint()
+	// the crc covers the entries, not the page padding after them
+	b = &bucket{id: id, entries: make(map[string][]byte, n), size: bucketHeaderSize}
+	for ; n > 0; n-- {
+		key := string(dec.bytes())
+		value := append([]byte(nil), dec.bytes()...)
+		b.entries[key] = value
+		b.size += entrySize(key, value)
+	}
+	if crc32.ChecksumIEEE(buf[4:dec.pos]) != binary.BigEndian.Uint32(buf) {
+		return nil, ErrCorruptIndex
+	}
+	return b, nil
+}
+
+func (d *DiskIndex) Get(key string) (*Set, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, os.ErrClosed
+	}
+	b, err := d.bucketFor(key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := b.entries[key]
+	err = d.shrink()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return decodeSet(&decoder{buf: value}, &d.files), nil
+}
+
+func (d *DiskIndex) Put(key string, value *Set) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return os.ErrClosed
+	}
+	err := d.markUnclean()
+	if err != nil {
+		return err
+	}
+	b, err := d.bucketFor(key)
+	if err != nil {
+		return err
+	}
+	encoded := encodeSet(nil, &d.files, value)
+	if old, ok := b.entries[key]; ok {
+		b.size -= entrySize(key, old)
+	} else {
+		d.count++
+	}
+	b.entries[key] = encoded
+	b.size += entrySize(key, encoded)
+	b.dirty = true
+	for b.size > DISK_PAGE_SIZE && len(b.entries) > 1 && d.buckets[b.id].depth < maxDiskDepth {
+		d.split(b)
+		b, err = d.bucketFor(key)
+		if err != nil {
+			return err
+		}
+	}
+	return d.shrink()
+}
+
+// split moves the entries of b whose next hash bit is set to a new bucket,
+// doubling the directory if b is already at full depth.
+func (d *DiskIndex) split(b *bucket) {
+	depth := d.buckets[b.id].depth
+	if depth == d.depth {
+		d.dir = append(d.dir, d.dir...)
+		d.depth++
+	}
+	id := uint32(len(d.buckets))
+	d.buckets[b.id].depth = depth + 1
+	d.buckets = append(d.buckets, extent{offset: -1, depth: depth + 1})
+	nb := &bucket{id: id, entries: make(map[string][]byte), size: bucketHeaderSize, dirty: true}
+	for key, value := range b.entries {
+		if hashKey(key)>>depth&1 == 1 {
+			delete(b.entries, key)
+			b.size -= entrySize(key, value)
+			nb.entries[key] = value
+			nb.size += entrySize(key, value)
+		}
+	}
+	b.dirty = true
+	for i := range d.dir {
+		if d.dir[i] == b.id && i>>depth&1 == 1 {
+			d.dir[i] = id
+		}
+	}
+	d.add(nb)
+}
+
+func (d *DiskIndex) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return os.ErrClosed
+	}
+	err := d.markUnclean()
+	if err != nil {
+		return err
+	}
+	b, err := d.bucketFor(key)
+	if err != nil {
+		return err
+	}
+	if old, ok := b.entries[key]; ok {
+		delete(b.entries, key)
+		b.size -= entrySize(key, old)
+		b.dirty = true
+		d.count--
+	}
+	return d.shrink()
+}
+
+func (d *DiskIndex) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// Range reads the buckets one at a time, through the cache.
+func (d *DiskIndex) Range(fn func(key string, value *Set) bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return os.ErrClosed
+	}
+	for id := range d.buckets {
+		b, err := d.bucket(uint32(id))
+		if err != nil {
+			return err
+		}
+		for key, value := range b.entries {
+			if !fn(key, decodeSet(&decoder{buf: value}, &d.files)) {
+				return d.shrink()
+			}
+		}
+		err = d.shrink()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DISK_ENTRY_OVERHEAD approximates the memory a cached entry takes besides
+// its encoding: the key's string header, the value's slice header and the
+// map's per-entry bookkeeping.
+const DISK_ENTRY_OVERHEAD = 16 + 24 + 16
+
+// MemSize counts the directory, the bucket table and the cached buckets.
+func (d *DiskIndex) MemSize() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size := int64(len(d.dir))*4 + int64(len(d.buckets))*16 + d.files.memSize()
+	for _, b := range d.cache {
+		size += int64(b.size) + int64(len(b.entries))*DISK_ENTRY_OVERHEAD
+	}
+	return size
+}
+
+func (d *DiskIndex) Reset() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return os.ErrClosed
+	}
+	d.cache = make(map[uint32]*bucket)
+	d.lru.Init()
+	return d.reset()
+}
+
+// Close writes back the cached buckets and the directory and marks the
+// file clean. A file that wasn't modified is left as it is.
+func (d *DiskIndex) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	var err error
+	if d.unclean || d.stampChanged {
+		err = d.flush()
+	}
+	closeErr := d.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (d *DiskIndex) flush() error {
+	err := d.markUnclean()
+	if err != nil {
+		return err
+	}
+	for _, b := range d.cache {
+		if b.dirty {
+			err := d.writeBucket(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// encoded again after allocating so the free list doesn't include the
+	// metadata's own pages, which can only make it shorter
+	meta := d.encodeMeta()
+	metaOffset := d.alloc(pagesFor(len(meta)))
+	meta = d.encodeMeta()
+	_, err = d.file.WriteAt(meta, metaOffset)
+	if err != nil {
+		return err
+	}
+	err = d.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, diskHeaderSize)
+	copy(header, diskIndexMagic)
+	header[8] = 1
+	binary.BigEndian.PutUint64(header[9:], uint64(metaOffset))
+	binary.BigEndian.PutUint64(header[17:], uint64(len(meta)))
+	binary.BigEndian.PutUint32(header[25:], crc32.ChecksumIEEE(meta))
+	_, err = d.file.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
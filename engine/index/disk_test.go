@@ -0,0 +1,171 @@
+package index
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDiskIndexReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DISK_INDEX_FILE)
+	d, err := OpenDiskIndex(path, WithCachePages(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Clean() {
+		t.Fatal("new index is clean")
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	want := map[string]*Set{}
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			key := keys[rnd.Intn(len(keys))]
+			set := randomSet(rnd)
+			if err := d.Put(key, set); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = set
+		}
+	}
+	put(20000)
+	d.SetStamp([]byte("stamp"))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = OpenDiskIndex(path, WithCachePages(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Clean() {
+		t.Fatal("index not clean after Close")
+	}
+	if string(d.Stamp()) != "stamp" {
+		t.Fatalf("Stamp() = %q, want %q", d.Stamp(), "stamp")
+	}
+	checkIndex(t, d, want, keys...)
+
+	// keep writing after a reopen, reusing the freed metadata pages
+	put(5000)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, d, want, keys...)
+
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, d, map[string]*Set{}, keys...)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskIndexUncleanClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DISK_INDEX_FILE)
+	d, err := OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Put("a", &Set{FileId: "data-0.db"})
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Put("b", &Set{FileId: "data-0.db"})
+	// crash: the file is dropped without Close
+	d.file.Close()
+
+	d, err = OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Clean() {
+		t.Fatal("index clean after a crash")
+	}
+	if _, err := d.Get("a"); err != ErrKeyNotFound {
+		t.Fatalf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskIndexCorruptHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DISK_INDEX_FILE)
+	d, err := OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Put("a", &Set{FileId: "data-0.db"})
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a metadata size far past the end of the file
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 17); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	d, err = OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Clean() {
+		t.Fatal("index with a corrupt header is clean")
+	}
+	if _, err := d.Get("a"); err != ErrKeyNotFound {
+		t.Fatalf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskIndexReads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DISK_INDEX_FILE)
+	d, err := OpenDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		d.Put("key-"+strconv.Itoa(i), &Set{FileId: "data-0.db", ValuePosition: int64(i)})
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = OpenDiskIndex(path, WithCachePages(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for i := 0; i < 20000; i += 97 {
+		before := d.reads
+		set, err := d.Get("key-" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set.ValuePosition != int64(i) {
+			t.Fatalf("ValuePosition = %d, want %d", set.ValuePosition, i)
+		}
+		if reads := d.reads - before; reads > 1 {
+			t.Fatalf("Get read %d pages", reads)
+		}
+	}
+}
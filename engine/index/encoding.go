@@ -0,0 +1,128 @@
+package index
+
+import (
+	"encoding/binary"
+)
+
+// fileTable replaces file names with small ids in encoded entries.
+type fileTable struct {
+	ids   map[string]uint32
+	names []string
+}
+
+func newFileTable() fileTable {
+	return fileTable{ids: make(map[string]uint32)}
+}
+
+func (t *fileTable) id(name string) uint32 {
+	id, ok := t.ids[name]
+	if !ok {
+		id = uint32(len(t.names))
+		t.ids[name] = id
+		t.names = append(t.names, name)
+	}
+	return id
+}
+
+// memSize estimates the memory held by the table: each name is stored
+// twice, as a map key and in names, and shares the string's bytes.
+func (t *fileTable) memSize() int64 {
+	size := int64(0)
+	for _, name := range t.names {
+		size += int64(len(name)) + 2*16 + 4 + 16
+	}
+	return size
+}
+
+// hasBlob marks an encoded entry with a blob reference.
+const hasBlob = 0x1
+
+// encodeSet appends the encoding of set:
+//
+// | file id uvarint | value position uvarint | value size uvarint |
+// | tstamp varint | seq uvarint | flags 1b | key id uvarint | blob 1b |
+// | [file id | position | size | flags | key id] |
+func encodeSet(buf []byte, files *fileTable, set *Set) []byte {
+	buf = appendUvarint(buf, uint64(files.id(set.FileId)))
+	buf = appendUvarint(buf, uint64(set.ValuePosition))
+	buf = appendUvarint(buf, uint64(set.ValueSize))
+	buf = appendVarint(buf, set.Tstamp)
+	buf = appendUvarint(buf, set.Seq)
+	buf = append(buf, set.Flags)
+	buf = appendUvarint(buf, uint64(set.KeyId))
+	if set.Blob == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, hasBlob)
+	buf = appendUvarint(buf, uint64(files.id(set.Blob.FileId)))
+	buf = appendUvarint(buf, uint64(set.Blob.ValuePosition))
+	buf = appendUvarint(buf, uint64(set.Blob.ValueSize))
+	buf = append(buf, set.Blob.Flags)
+	return appendUvarint(buf, uint64(set.Blob.KeyId))
+}
+
+func decodeSet(d *decoder, files *fileTable) *Set {
+	set := &Set{
+		FileId:        files.names[d.uvarint()],
+		ValuePosition: int64(d.uvarint()),
+		ValueSize:     int64(d.uvarint()),
+		Tstamp:        d.varint(),
+		Seq:           d.uvarint(),
+		Flags:         d.byte(),
+		KeyId:         uint32(d.uvarint()),
+	}
+	if d.byte() == hasBlob {
+		set.Blob = &Blob{
+			FileId:        files.names[d.uvarint()],
+			ValuePosition: int64(d.uvarint()),
+			ValueSize:     int64(d.uvarint()),
+			Flags:         d.byte(),
+			KeyId:         uint32(d.uvarint()),
+		}
+	}
+	return set
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// decoder reads the fields of an entry the index wrote itself.
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	d.pos += n
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf[d.pos:])
+	d.pos += n
+	return v
+}
+
+func (d *decoder) byte() byte {
+	b := d.buf[d.pos]
+	d.pos++
+	return b
+}
+
+// bytes reads a uvarint length followed by that many bytes.
+func (d *decoder) bytes() []byte {
+	n := int(d.uvarint())
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
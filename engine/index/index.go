@@ -2,29 +2,85 @@ package index
 
 import (
 	"errors"
-	"io"
 
 	"github.com/machinly/bitcask/engine/record"
 )
 
+var ErrKeyNotFound = errors.New("key not found")
+
+// MAP_ENTRY_OVERHEAD approximates the memory an entry of the map index takes
+// besides its key bytes: the key's string header, the pointer to the Set,
+// the Set itself and the map's per-entry bookkeeping. File names are shared
+// between entries.
+const MAP_ENTRY_OVERHEAD = 16 + 8 + 64 + 16
+
+// Index is the keydir: it maps each live key to where its latest value is.
+// Implementations need not be safe for concurrent use, except that Get,
+// Len, Range and MemSize may be called concurrently with each other.
 type Index interface {
 	Put(key string, value *Set) error
 	Get(key string) (*Set, error)
 	Delete(key string) error
+	// Len returns the number of keys.
+	Len() int
+	// Range calls fn for every key, in no particular order, until fn
+	// returns false. fn must not use the index.
+	Range(fn func(key string, value *Set) bool) error
+	// MemSize estimates the memory held by the index, in bytes.
+	MemSize() int64
+}
+
+// Persistent is an Index kept on disk across restarts.
+type Persistent interface {
+	Index
+	// Clean reports whether the index was loaded as it was last closed.
+	// Otherwise it is empty and has to be rebuilt.
+	Clean() bool
+	// Stamp returns what was stored with SetStamp before the last Close,
+	// for the caller to check that a clean index matches its data.
+	Stamp() []byte
+	SetStamp(b []byte)
+	// Reset empties the index.
+	Reset() error
+	Close() error
 }
 
 type Set struct {
 	FileId        string
 	ValueSize     int64
 	ValuePosition int64
-	Tstamp        int64
+	// Tstamp is the write time in unix nanoseconds.
+	Tstamp int64
+	// Seq is the sequence number of the record, 0 for V1 records.
+	Seq uint64
+	// Flags are the record's flags. They tell how the ValueSize bytes at
+	// ValuePosition are encoded.
+	Flags byte
+	// KeyId is the encryption key id of an encrypted value.
+	KeyId uint32
+	// Blob locates the value if it is stored in a blob file. The fields
+	// above then describe the pointer record.
+	Blob *Blob
+}
+
+// Blob is where a value stored in a blob file is and how it is encoded.
+type Blob struct {
+	FileId        string
+	ValueSize     int64
+	ValuePosition int64
+	Flags         byte
+	KeyId         uint32
 }
 
 type index struct {
-	index map[string]*Set
+	index    map[string]*Set
+	keyBytes int64
 }
 
 func (i *index) Put(key string, value *Set) error {
+	if _, ok := i.index[key]; !ok {
+		i.keyBytes += int64(len(key))
+	}
 	i.index[key] = value
 	return nil
 }
@@ -34,58 +90,52 @@ func (i *index) Get(key string) (*Set, error) {
 	if ok {
 		return v, nil
 	}
-	return nil, errors.New("key not found")
+	return nil, ErrKeyNotFound
 }
 
 func (i *index) Delete(key string) error {
-	delete(i.index, key)
+	if _, ok := i.index[key]; ok {
+		i.keyBytes -= int64(len(key))
+		delete(i.index, key)
+	}
 	return nil
 }
 
-func (i *index) ReadSetsFromDB() map[string]Set {
-	index := make(map[string]Set)
-	err := c.dbFile.ReadAll(fileName, func(ret int64, reader io.Reader) error {
-		r, err := record.ParseRecord(reader)
-		if err != nil {
-			return err
-		}
-		if v, ok := index[r.Key()]; ok {
-			if v.tstamp < r.Timestamp() {
-				index[r.Key()] = index.
-					NewSet(fileNamer.ValueSize(),
-						pos+r.ValueRelativePosition(),
-						r.Timestamp())
-			}
-		} else {
-			index[r.Key()] = index.
-				NewSet(fileNamer.ValueSize(),
-					pos+r.ValueRelativePosition(),
-					r.Timestamp())
+func (i *index) Len() int {
+	return len(i.index)
+}
+
+func (i *index) Range(fn func(key string, value *Set) bool) error {
+	for key, value := range i.index {
+		if !fn(key, value) {
+			break
 		}
-		pos += r.Len()
-		return nil
-	})
-	if err != nil {
-		return err
 	}
-	return index
+	return nil
+}
+
+func (i *index) MemSize() int64 {
+	return i.keyBytes + int64(len(i.index))*MAP_ENTRY_OVERHEAD
 }
 
 func NewSet(fileName string, valueSize, valuePosition, tstamp int64) *Set {
 	return &Set{
-		fileId:        fileName,
-		valueSize:     valueSize,
-		valuePosition: valuePosition,
-		tstamp:        tstamp,
+		FileId:        fileName,
+		ValueSize:     valueSize,
+		ValuePosition: valuePosition,
+		Tstamp:        tstamp,
 	}
 }
 
 func NewSetFromRecord(fileName string, offset int64, r record.Record) *Set {
 	return &Set{
-		fileId:        fileName,
-		valueSize:     r.ValueSize(),
-		valuePosition: offset + r.ValueRelativePosition(),
-		tstamp:        r.Timestamp(),
+		FileId:        fileName,
+		ValueSize:     r.ValueSize(),
+		ValuePosition: offset + r.ValueRelativePosition(),
+		Tstamp:        r.Time().UnixNano(),
+		Seq:           r.Seq(),
+		Flags:         r.Flags(),
+		KeyId:         r.KeyId(),
 	}
 }
 
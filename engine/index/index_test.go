@@ -0,0 +1,206 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testIndexes are the implementations run through the conformance tests.
+var testIndexes = []struct {
+	name string
+	open func(t *testing.T) Index
+}{
+	{"map", func(t *testing.T) Index { return NewIndex() }},
+	{"compact", func(t *testing.T) Index { return NewCompactIndex() }},
+	{"disk", func(t *testing.T) Index {
+		// a tiny cache so buckets are written back and read again
+		d, err := OpenDiskIndex(filepath.Join(t.TempDir(), DISK_INDEX_FILE), WithCachePages(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}},
+}
+
+func randomSet(rnd *rand.Rand) *Set {
+	set := &Set{
+		FileId:        fmt.Sprintf("/data/data-%d.db", rnd.Intn(8)),
+		ValueSize:     rnd.Int63n(1 << 20),
+		ValuePosition: rnd.Int63(),
+		Tstamp:        rnd.Int63(),
+		Seq:           rnd.Uint64(),
+		Flags:         byte(rnd.Intn(256)),
+		KeyId:         rnd.Uint32(),
+	}
+	if rnd.Intn(4) == 0 {
+		set.Blob = &Blob{
+			FileId:        fmt.Sprintf("/data/blob-%d.blob", rnd.Intn(4)),
+			ValueSize:     rnd.Int63(),
+			ValuePosition: rnd.Int63(),
+			Flags:         byte(rnd.Intn(256)),
+			KeyId:         rnd.Uint32(),
+		}
+	}
+	return set
+}
+
+// checkIndex compares idx against want, through Get, Len and Range.
+func checkIndex(t *testing.T, idx Index, want map[string]*Set, missing ...string) {
+	t.Helper()
+	for key, w := range want {
+		got, err := idx.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q) error = %v", key, err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Fatalf("Get(%q) = %+v, want %+v", key, got, w)
+		}
+	}
+	for _, key := range missing {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if _, err := idx.Get(key); err != ErrKeyNotFound {
+			t.Fatalf("Get(%q) error = %v, want %v", key, err, ErrKeyNotFound)
+		}
+	}
+	if idx.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", idx.Len(), len(want))
+	}
+	got := make(map[string]*Set)
+	err := idx.Range(func(key string, value *Set) bool {
+		if _, ok := got[key]; ok {
+			t.Errorf("Range visited %q twice", key)
+		}
+		got[key] = value
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Range visited %d keys, want %d", len(got), len(want))
+	}
+}
+
+func TestIndex(t *testing.T) {
+	for _, impl := range testIndexes {
+		t.Run(impl.name, func(t *testing.T) {
+			idx := impl.open(t)
+			empty := idx.MemSize()
+			want := map[string]*Set{}
+			checkIndex(t, idx, want, "a", "")
+
+			a := &Set{FileId: "/data/data-0.db", ValueSize: 5, ValuePosition: 10, Tstamp: 1, Seq: 1}
+			b := &Set{FileId: "/data/data-1.db", ValueSize: 7, ValuePosition: 0, Tstamp: 2, Seq: 2,
+				Blob: &Blob{FileId: "/data/blob-0.blob", ValueSize: 1 << 20, ValuePosition: 30}}
+			for key, set := range map[string]*Set{"a": a, "b": b, "": b} {
+				if err := idx.Put(key, set); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = set
+			}
+			checkIndex(t, idx, want, "c")
+			if idx.MemSize() <= empty {
+				t.Errorf("MemSize() = %d, not more than %d when empty", idx.MemSize(), empty)
+			}
+
+			if err := idx.Put("a", b); err != nil {
+				t.Fatal(err)
+			}
+			want["a"] = b
+			for _, key := range []string{"b", "c"} {
+				if err := idx.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, key)
+			}
+			checkIndex(t, idx, want, "b", "c")
+
+			visited := 0
+			err := idx.Range(func(key string, value *Set) bool {
+				visited++
+				return false
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if visited != 1 {
+				t.Errorf("Range visited %d keys after returning false", visited)
+			}
+		})
+	}
+}
+
+func TestIndexRandom(t *testing.T) {
+	for _, impl := range testIndexes {
+		t.Run(impl.name, func(t *testing.T) {
+			idx := impl.open(t)
+			rnd := rand.New(rand.NewSource(1))
+			want := map[string]*Set{}
+			keys := make([]string, 5000)
+			for i := range keys {
+				keys[i] = "key-" + strconv.Itoa(i)
+			}
+			// a few keys too large to share a disk page
+			keys = append(keys, string(make([]byte, DISK_PAGE_SIZE)), string(make([]byte, 3*DISK_PAGE_SIZE)))
+
+			// enough overwrites and deletes to grow hash tables, split
+			// buckets and compact arenas
+			for i := 0; i < 50000; i++ {
+				key := keys[rnd.Intn(len(keys))]
+				if rnd.Intn(5) == 0 {
+					if err := idx.Delete(key); err != nil {
+						t.Fatal(err)
+					}
+					delete(want, key)
+					continue
+				}
+				set := randomSet(rnd)
+				if err := idx.Put(key, set); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = set
+			}
+			checkIndex(t, idx, want, keys...)
+		})
+	}
+}
+
+// BenchmarkIndexMemory reports the heap used per key by the in-memory
+// indexes.
+func BenchmarkIndexMemory(b *testing.B) {
+	const keys = 200000
+	for _, impl := range testIndexes[:2] {
+		b.Run(impl.name, func(b *testing.B) {
+			now := time.Now().UnixNano()
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				idx := impl.open(nil)
+				for i := 0; i < keys; i++ {
+					idx.Put(fmt.Sprintf("user:%012d", i), &Set{
+						FileId:        fmt.Sprintf("/data/data-%d.db", i/50000),
+						ValueSize:     100,
+						ValuePosition: int64(i%50000) * 140,
+						Tstamp:        now + int64(i),
+						Seq:           uint64(i + 1),
+					})
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keys, "B/key")
+				b.ReportMetric(float64(idx.MemSize())/keys, "MemSize/key")
+				runtime.KeepAlive(idx)
+			}
+		})
+	}
+}
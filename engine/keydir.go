@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/machinly/bitcask/engine/index"
+)
+
+// BUCKET_INDEX_PREFIX starts the names of the index files of the named
+// buckets and of the catalog, which are followed by the bucket id.
+const BUCKET_INDEX_PREFIX = "keydir-"
+
+// openIndex returns the keydir selected by the options.
+func (o options) openIndex(dirName string) (index.Index, error) {
+	if o.diskIndex && !o.readOnly {
+		return index.OpenDiskIndex(filepath.Join(dirName, index.DISK_INDEX_FILE), o.diskIndexOpts...)
+	}
+	if o.newIndex != nil {
+		return o.newIndex(), nil
+	}
+	return index.NewIndex(), nil
+}
+
+// loadIndex fills the keydir and the file stats. A persistent index that
+// was closed cleanly over the data files as they are now is used as is,
+// otherwise the data files are replayed.
+func (c *bitcask) loadIndex() error {
+	if p, ok := c.index.(index.Persistent); ok && p.Clean() {
+		restored, err := c.restore(p.Stamp())
+		if err != nil {
+			return err
+		}
+		if restored {
+			return c.loadFilter(p.Stamp())
+		}
+		err = p.Reset()
+		if err != nil {
+			return err
+		}
+	}
+	err := c.buildIndex()
+	if err == nil {
+		err = c.accountBlobs()
+	}
+	if err != nil {
+		return err
+	}
+	return c.buildFilter()
+}
+
+// keydirFile returns the name of the index file of bucket.
+func (c *bitcask) keydirFile(bucket uint32) string {
+	return filepath.Join(c.blobDir, fmt.Sprintf("%s%d.idx", BUCKET_INDEX_PREFIX, bucket))
+}
+
+// newKeydir returns an empty keydir for bucket. With a disk index it is
+// one too, in a file of its own next to that of the default bucket. The
+// caller holds mu.
+func (c *bitcask) newKeydir(bucket uint32) (index.Index, error) {
+	if !c.diskIndex {
+		return c.newIndex(), nil
+	}
+	d, err := index.OpenDiskIndex(c.keydirFile(bucket), c.diskIndexOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if d.Clean() {
+		err = d.Reset()
+		if err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// restoreKeydirs opens the keydirs of the catalog and of the buckets it
+// names, which must all have been closed with stamp. It returns nil if one
+// wasn't. The caller holds mu.
+func (c *bitcask) restoreKeydirs(catalog map[uint32]bucketEntry, stamp []byte) (map[uint32]index.Index, error) {
+	if !c.diskIndex {
+		// only stamped without buckets, see closeIndex
+		return map[uint32]index.Index{catalogBucket: c.newIndex()}, nil
+	}
+	ids := []uint32{catalogBucket}
+	for id, entry := range catalog {
+		if !entry.Dropped {
+			ids = append(ids, id)
+		}
+	}
+	keydirs := make(map[uint32]index.Index)
+	for _, id := range ids {
+		d, err := index.OpenDiskIndex(c.keydirFile(id), c.diskIndexOpts...)
+		if err != nil {
+			_ = closeKeydirs(keydirs, nil)
+			return nil, err
+		}
+		keydirs[id] = d
+		if !d.Clean() || !bytes.Equal(d.Stamp(), stamp) {
+			_ = closeKeydirs(keydirs, nil)
+			return nil, nil
+		}
+	}
+	return keydirs, nil
+}
+
+// closeKeydirs closes the persistent ones of keydirs, stamped with stamp.
+func closeKeydirs(keydirs map[uint32]index.Index, stamp []byte) error {
+	var err error
+	for _, kd := range keydirs {
+		p, ok := kd.(index.Persistent)
+		if !ok {
+			continue
+		}
+		p.SetStamp(stamp)
+		closeErr := p.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// closeIndex closes a persistent index and those of the buckets, stamped
+// with the current state if stamped is true. An index without a valid
+// stamp is rebuilt on open, as is one of a database whose buckets are kept
+// in memory, which only the replay restores. The caller holds mu.
+func (c *bitcask) closeIndex(stamped bool) error {
+	p, ok := c.index.(index.Persistent)
+	if !ok {
+		return nil
+	}
+	var stamp []byte
+	if stamped && (c.diskIndex || len(c.catalog) == 0) {
+		var err error
+		stamp, err = c.stamp()
+		if err == nil {
+			// the filter is optional, the next open builds one if it
+			// can't load it
+			_ = c.saveFilter(stamp)
+		} else {
+			stamp = nil
+		}
+	}
+	p.SetStamp(stamp)
+	err := p.Close()
+	keydirsErr := closeKeydirs(c.keydirs, stamp)
+	if err != nil {
+		return err
+	}
+	return keydirsErr
+}
+
+// keydirStamp is the state a persistent index is closed with: what opening
+// would otherwise derive from replaying the data files, and the size of
+// each file, to tell whether the files changed since.
+type keydirStamp struct {
+	Seq    uint64
+	KeyIds []uint32
+	Files  []stampedFile
+	// Catalog is the bucket catalog, whose keydirs are stamped alike.
+	Catalog map[uint32]bucketEntry `json:",omitempty"`
+}
+
+type stampedFile struct {
+	Name       string
+	Size       int64
+	TotalBytes int64
+	DeadBytes  int64
+	Tombstones int64
+	MaxSeq     uint64
+}
+
+// stamp syncs the data and blob files and describes them. The caller
+// holds mu.
+func (c *bitcask) stamp() ([]byte, error) {
+	err := c.blobs.Sync()
+	if err != nil {
+		return nil, err
+	}
+	err = c.dbFile.Sync()
+	if err != nil {
+		return nil, err
+	}
+	s := keydirStamp{Seq: c.seq, Catalog: c.catalog}
+	for keyId := range c.keyIds {
+		s.KeyIds = append(s.KeyIds, keyId)
+	}
+	files, err := c.stampFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		stats := c.fileStats(f.Name)
+		f.TotalBytes, f.DeadBytes, f.Tombstones = stats.totalBytes, stats.deadBytes, stats.tombstones
+		f.MaxSeq = stats.maxSeq
+		s.Files = append(s.Files, f)
+	}
+	return json.Marshal(s)
+}
+
+// stampFiles lists the data files, then the blob files, with their sizes.
+// Empty files are left out: every open starts a new active file.
+func (c *bitcask) stampFiles() ([]stampedFile, error) {
+	files := make([]stampedFile, 0)
+	for _, db := range []interface {
+		FileList() []string
+		Size(string) (int64, error)
+	}{c.dbFile, c.blobs} {
+		for _, fileName := range db.FileList() {
+			size, err := db.Size(fileName)
+			if err != nil {
+				return nil, err
+			}
+			if size == 0 {
+				continue
+			}
+			files = append(files, stampedFile{Name: fileName, Size: size})
+		}
+	}
+	return files, nil
+}
+
+// restore takes the engine state from stamp if the files it describes are
+// unchanged, and reports whether it did.
+func (c *bitcask) restore(stamp []byte) (bool, error) {
+	var s keydirStamp
+	if json.Unmarshal(stamp, &s) != nil {
+		return false, nil
+	}
+	files, err := c.stampFiles()
+	if err != nil {
+		return false, err
+	}
+	if len(files) != len(s.Files) {
+		return false, nil
+	}
+	for i, f := range files {
+		if s.Files[i].Name != f.Name || s.Files[i].Size != f.Size {
+			return false, nil
+		}
+	}
+	// the records aren't read, so only check the keys are there
+	for _, keyId := range s.KeyIds {
+		if c.keys == nil {
+			return false, fmt.Errorf("%w: key id %d", ErrMissingKey, keyId)
+		}
+		_, err := c.keys.Cipher(keyId)
+		if err != nil {
+			return false, err
+		}
+	}
+	keydirs, err := c.restoreKeydirs(s.Catalog, stamp)
+	if keydirs == nil {
+		return false, err
+	}
+
+	c.seq = s.Seq
+	c.keyIds = make(map[uint32]bool)
+	for _, keyId := range s.KeyIds {
+		c.keyIds[keyId] = true
+	}
+	c.files = make(map[string]*fileStats)
+	for _, f := range s.Files {
+		c.files[f.Name] = &fileStats{totalBytes: f.TotalBytes, deadBytes: f.DeadBytes, tombstones: f.Tombstones, maxSeq: f.MaxSeq}
+	}
+	c.keydirs = keydirs
+	c.catalog = make(map[uint32]bucketEntry)
+	c.buckets = make(map[string]uint32)
+	c.lastBucket = 0
+	for id, entry := range s.Catalog {
+		c.catalog[id] = entry
+		if id > c.lastBucket {
+			c.lastBucket = id
+		}
+		if current, ok := c.buckets[entry.Name]; !entry.Dropped && (!ok || current < id) {
+			c.buckets[entry.Name] = id
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/machinly/bitcask/engine/bloom"
+	"github.com/machinly/bitcask/engine/index"
+)
+
+// writeKeys writes values, overwrites and deletes, some of them blobs, and
+// returns what the engine should hold.
+func writeKeys(t *testing.T, e Engine) map[string]string {
+	t.Helper()
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key, value := fmt.Sprintf("key-%d", i%200), fmt.Sprintf("value-%d", i)
+		if i%50 == 0 {
+			value = largeValue(i)
+		}
+		if err := e.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+		if i%7 == 0 {
+			if err := e.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		}
+	}
+	return want
+}
+
+func checkKeys(t *testing.T, e Engine, want map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		if v, err := e.Get(key); err != nil || v != value {
+			t.Fatalf("Get(%s) = %.20q, %v, want %.20q", key, v, err, value)
+		}
+	}
+	keys, err := e.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("ListKeys() returned %d keys, want %d", len(keys), len(want))
+	}
+}
+
+func TestIndexOptions(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"map":     WithIndex(index.NewIndex),
+		"compact": WithCompactIndex(),
+		"disk":    WithDiskIndex(index.WithCachePages(2)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			e := openTestEngine(t, dir, opt, WithBlobThreshold(1024))
+			want := writeKeys(t, e)
+			checkKeys(t, e, want)
+			if err := e.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			checkKeys(t, e, want)
+			stats, err := e.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Keys != len(want) || stats.KeydirBytes <= 0 {
+				t.Errorf("keys, keydir bytes = %d, %d, want %d keys", stats.Keys, stats.KeydirBytes, len(want))
+			}
+			e.Close()
+
+			e = openTestEngine(t, dir, opt, WithBlobThreshold(1024))
+			checkKeys(t, e, want)
+		})
+	}
+}
+
+func TestDiskIndexReopen(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithDiskIndex(), WithBlobThreshold(1024))
+	want := writeKeys(t, e)
+	e.Close()
+
+	// writes without the index leave its stamp behind the data files
+	e = openTestEngine(t, dir)
+	if err := e.Put("extra", "value"); err != nil {
+		t.Fatal(err)
+	}
+	want["extra"] = "value"
+	e.Close()
+	e = openTestEngine(t, dir, WithDiskIndex(), WithBlobThreshold(1024))
+	checkKeys(t, e, want)
+	before, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	// the first record is long dead; replaying the data files would
+	// report it corrupt, a clean index doesn't read it
+	files := dataFiles(t, dir)
+	f, err := os.OpenFile(files[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	e = openTestEngine(t, dir, WithDiskIndex(), WithBlobThreshold(1024))
+	checkKeys(t, e, want)
+	after, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each open starts a new active file
+	if !reflect.DeepEqual(nonEmpty(after.Files), nonEmpty(before.Files)) || !reflect.DeepEqual(nonEmpty(after.BlobFiles), nonEmpty(before.BlobFiles)) {
+		t.Errorf("file stats after reopen = %+v %+v, want %+v %+v", after.Files, after.BlobFiles, before.Files, before.BlobFiles)
+	}
+}
+
+func TestDiskIndexBuckets(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithDiskIndex())
+	for _, value := range []string{"dead", "live"} {
+		if err := e.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := e.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("alice", "1"); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err := e.Bucket("dropped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dropped.Put("bob", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.DropBucket("dropped"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	files, err := filepath.Glob(filepath.Join(dir, BUCKET_INDEX_PREFIX+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the catalog's and that of users
+	if len(files) != 2 {
+		t.Errorf("bucket index files = %v", files)
+	}
+
+	// as in TestDiskIndexReopen, a clean index doesn't read the dead record
+	f, err := os.OpenFile(dataFiles(t, dir)[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	e = openTestEngine(t, dir, WithDiskIndex())
+	if names, _ := e.ListBuckets(); !reflect.DeepEqual(names, []string{DEFAULT_BUCKET, "users"}) {
+		t.Errorf("ListBuckets() = %v", names)
+	}
+	users, err = e.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := users.Get("alice"); err != nil || v != "1" {
+		t.Errorf("Get(alice) = %q, %v", v, err)
+	}
+	if v, err := e.Get("key"); err != nil || v != "live" {
+		t.Errorf("Get(key) = %q, %v", v, err)
+	}
+	if _, err := e.Bucket("dropped"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := e.ListBuckets(); !reflect.DeepEqual(names, []string{DEFAULT_BUCKET, "dropped", "users"}) {
+		t.Errorf("ListBuckets() after creating a bucket = %v", names)
+	}
+}
+
+func nonEmpty(files []FileStats) []FileStats {
+	var list []FileStats
+	for _, fs := range files {
+		if fs.TotalBytes > 0 {
+			list = append(list, fs)
+		}
+	}
+	return list
+}
+
+func TestBloomFilter(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithDiskIndex(), WithBloomFilter(0))
+	want := writeKeys(t, e)
+	checkKeys(t, e, want)
+	missing := func() int64 {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			if _, err := e.Get(fmt.Sprintf("missing-%d", i)); err != ErrKeyNotFound {
+				t.Fatalf("Get() error = %v, want %v", err, ErrKeyNotFound)
+			}
+		}
+		stats, err := e.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.BloomFilterBytes == 0 {
+			t.Fatal("no bloom filter")
+		}
+		return stats.BloomNegatives
+	}
+	if n := missing(); n < 950 {
+		t.Errorf("filter answered %d of 1000 missing keys", n)
+	}
+	e.Close()
+
+	// saved with the index, so a fresh engine answers from it too
+	if _, err := os.Stat(filepath.Join(dir, BLOOM_FILTER_FILE)); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestEngine(t, dir, WithDiskIndex(), WithBloomFilter(0))
+	checkKeys(t, e, want)
+	if n := missing(); n < 950 {
+		t.Errorf("filter answered %d of 1000 missing keys after reopen", n)
+	}
+
+	// growing past its capacity rebuilds the filter
+	for i := 0; i < BLOOM_MIN_CAPACITY+1; i++ {
+		if err := e.Put(fmt.Sprintf("new-%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.Get("new-0"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BloomFilterBytes <= bloom.New(BLOOM_MIN_CAPACITY, DEFAULT_BLOOM_RATE).Size() {
+		t.Errorf("filter of %d bytes not rebuilt larger", stats.BloomFilterBytes)
+	}
+}
@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+const (
+	DEFAULT_MERGE_CHECK_INTERVAL = time.Minute
+	DEFAULT_BLOB_DEAD_RATIO      = 0.5
+)
+
+var errMergeAborted = errors.New("merge aborted")
+
+// MergePolicy decides when the engine merges on its own. A merge is started
+// when any threshold is crossed and the current time is inside the merge
+// window. The zero value disables automatic merging.
+type MergePolicy struct {
+	// DeadRatio triggers a merge once a sealed data file has at least this
+	// fraction of its bytes superseded or deleted. Zero disables the check.
+	DeadRatio float64
+	// DeadBytes triggers a merge once the sealed data files hold at least
+	// this many dead bytes in total. Zero disables the check.
+	DeadBytes int64
+	// WindowStart and WindowEnd limit merging to a time of day, as offsets
+	// from local midnight. The window may wrap past midnight. When both are
+	// equal merging is allowed at any time.
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+	// CheckInterval is how often the thresholds are evaluated. Defaults to
+	// DEFAULT_MERGE_CHECK_INTERVAL.
+	CheckInterval time.Duration
+	// BytesPerSecond caps how fast a merge reads data files, for manual and
+	// automatic merges alike. Zero means unlimited.
+	BytesPerSecond int64
+	// BlobDeadRatio is the fraction of a sealed blob file that must be dead
+	// before a merge compacts it, manual merges included. Defaults to
+	// DEFAULT_BLOB_DEAD_RATIO.
+	BlobDeadRatio float64
+}
+
+func (p MergePolicy) enabled() bool {
+	return p.DeadRatio > 0 || p.DeadBytes > 0 || p.BlobDeadRatio > 0
+}
+
+func (p MergePolicy) inWindow(now time.Time) bool {
+	if p.WindowStart == p.WindowEnd {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	t := now.Sub(midnight)
+	if p.WindowStart < p.WindowEnd {
+		return t >= p.WindowStart && t < p.WindowEnd
+	}
+	return t >= p.WindowStart || t < p.WindowEnd
+}
+
+func (p MergePolicy) blobDeadRatio() float64 {
+	if p.BlobDeadRatio <= 0 {
+		return DEFAULT_BLOB_DEAD_RATIO
+	}
+	return p.BlobDeadRatio
+}
+
+func (p MergePolicy) checkInterval() time.Duration {
+	if p.CheckInterval <= 0 {
+		return DEFAULT_MERGE_CHECK_INTERVAL
+	}
+	return p.CheckInterval
+}
+
+// Merge rewrites the live records of every sealed data file into the active
+// file and removes the sealed files, reclaiming the space of overwritten and
+// deleted keys. Records are copied one at a time, so reads and writes are
+// only blocked for the duration of a single copy. Blob files are compacted
+// once they cross the policy's BlobDeadRatio.
+func (c *bitcask) Merge() error {
+	return c.merge(true, true)
+}
+
+func (c *bitcask) merge(data, blobs bool) error {
+	c.mergeMu.Lock()
+	defer c.mergeMu.Unlock()
+
+	c.mu.RLock()
+	err := c.checkWritable()
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	limiter := newRateLimiter(c.mergePolicy.BytesPerSecond)
+	if data {
+		err := c.mergeData(limiter)
+		if err != nil {
+			return err
+		}
+	}
+	if blobs {
+		err := c.mergeBlobs(limiter)
+		if err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastMerge = time.Now()
+	c.lastMergeDuration = c.lastMerge.Sub(start)
+	return nil
+}
+
+// mergeData merges the sealed data files. The caller holds mergeMu.
+func (c *bitcask) mergeData(limiter *rateLimiter) error {
+	current := c.dbFile.CurrentFile()
+	sealed := make([]string, 0)
+	for _, fileName := range c.dbFile.FileList() {
+		if fileName != current {
+			sealed = append(sealed, fileName)
+		}
+	}
+	if len(sealed) == 0 {
+		return nil
+	}
+
+	for _, fileName := range sealed {
+		err := c.mergeFile(fileName, limiter)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the copies must be durable before the originals go away
+	err := c.dbFile.Sync()
+	if err != nil {
+		return err
+	}
+	// oldest first: if we crash halfway, a remaining tombstone still shadows
+	// the records removed before it, never the other way round.
+	for _, fileName := range sealed {
+		err := c.dbFile.Remove(fileName)
+		if err != nil {
+			return err
+		}
+		delete(c.files, fileName)
+	}
+	// drop the deleted keys the merge got rid of
+	return c.buildFilter()
+}
+
+// mergeFile copies the records of fileName that the keydir still points at
+// to the active file. Sealed files are immutable, so they are read without
+// holding mu. Values of at least dbfile.STREAM_BUFFER_SIZE are streamed
+// rather than read into memory, unless they have to be re-encrypted.
+func (c *bitcask) mergeFile(fileName string, limiter *rateLimiter) error {
+	return c.dbFile.ReadAll(fileName, func(pos int64, reader io.Reader) error {
+		h, err := record.ParseHeader(reader)
+		if err != nil {
+			return record.WithLocation(err, fileName, pos)
+		}
+		r := h.Record()
+		if !limiter.wait(r.Len(), c.stop) {
+			return errMergeAborted
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			return ErrClosed
+		}
+		set, err := c.lookup(r.Bucket(), r.Key())
+		if err != nil {
+			return err
+		}
+		if set == nil || set.FileId != fileName || set.ValuePosition != pos+r.ValueRelativePosition() {
+			err = h.Skip()
+			if err != nil {
+				return record.WithLocation(err, fileName, pos)
+			}
+			return nil
+		}
+		if r.ValueSize() >= dbfile.STREAM_BUFFER_SIZE && !c.needsValue(r) && !c.needsReencryption(r) {
+			newFile, newPos, err := c.dbFile.WriteStream(func(w dbfile.StreamWriter) error {
+				return h.CopyTo(w)
+			})
+			if err != nil {
+				return record.WithLocation(err, fileName, pos)
+			}
+			return c.addRecord(newFile, newPos, r)
+		}
+		r, err = h.ReadRecord()
+		if err != nil {
+			return record.WithLocation(err, fileName, pos)
+		}
+		if c.needsReencryption(r) {
+			r, err = c.reencrypt(r)
+			if err != nil {
+				return record.WithLocation(err, fileName, pos)
+			}
+		}
+		return c.putRecord(r)
+	})
+}
+
+// needsReencryption reports whether a live record is stored unencrypted or
+// under a key other than the current one. Pointer records are not
+// encrypted, their blob records are.
+func (c *bitcask) needsReencryption(r record.Record) bool {
+	if c.keys == nil || r.Flags()&record.V2_BLOB != 0 {
+		return false
+	}
+	return r.Flags()&record.V2_ENCRYPTED == 0 || r.KeyId() != c.keys.provider.CurrentKeyId()
+}
+
+func (c *bitcask) reencrypt(r record.Record) (record.Record, error) {
+	opts, err := c.recordOptions(r.Bucket())
+	if err != nil {
+		return nil, err
+	}
+	seq := r.Seq()
+	if seq == 0 {
+		seq = c.seq + 1
+	}
+	return record.Rewrite(r, seq, c.keyring(), opts...)
+}
+
+// needsMerge reports whether the sealed data files cross the policy's
+// garbage thresholds.
+func (c *bitcask) needsMerge() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return false
+	}
+	current := c.dbFile.CurrentFile()
+	deadBytes := int64(0)
+	for _, fileName := range c.dbFile.FileList() {
+		stats, ok := c.files[fileName]
+		if fileName == current || !ok {
+			continue
+		}
+		if c.mergePolicy.DeadRatio > 0 && stats.deadRatio() >= c.mergePolicy.DeadRatio {
+			return true
+		}
+		deadBytes += stats.deadBytes
+	}
+	return c.mergePolicy.DeadBytes > 0 && deadBytes >= c.mergePolicy.DeadBytes
+}
+
+func (c *bitcask) runMergeScheduler() {
+	defer c.scheduler.Done()
+	ticker := time.NewTicker(c.mergePolicy.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			if !c.mergePolicy.inWindow(now) {
+				continue
+			}
+			data, blobs := c.needsMerge(), c.needsBlobMerge()
+			if !data && !blobs {
+				continue
+			}
+			err := c.merge(data, blobs)
+			if err == errMergeAborted {
+				return
+			}
+			c.mu.Lock()
+			c.mergeErr = err
+			c.mu.Unlock()
+		}
+	}
+}
+
+// rateLimiter paces merge reads to an average of bytesPerSecond.
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// wait accounts n more bytes and sleeps until they are within the budget.
+// It returns false if stop is closed while waiting.
+func (l *rateLimiter) wait(n int64, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	if l.bytesPerSecond <= 0 {
+		return true
+	}
+	l.bytes += n
+	due := l.start.Add(time.Duration(float64(l.bytes) / float64(l.bytesPerSecond) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
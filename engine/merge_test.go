@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeGarbage fills dir with one sealed data file in which most records
+// have been overwritten or deleted.
+func writeGarbage(t *testing.T, dir string) {
+	t.Helper()
+	e := openTestEngine(t, dir)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 5; j++ {
+			if err := e.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", i, j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 5; i < 10; i++ {
+		if err := e.Delete(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+}
+
+func checkMerged(t *testing.T, e Engine) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		v, err := e.Get(fmt.Sprintf("key-%d", i))
+		if i < 5 && (err != nil || v != fmt.Sprintf("value-%d-4", i)) {
+			t.Errorf("Get(key-%d) = %q, %v", i, v, err)
+		}
+		if i >= 5 && err != ErrKeyNotFound {
+			t.Errorf("Get(key-%d) error = %v, want %v", i, err, ErrKeyNotFound)
+		}
+	}
+}
+
+func dataFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbage(t, dir)
+
+	e := openTestEngine(t, dir)
+	bc := e.(*bitcask)
+	sealed := bc.dbFile.FileList()[0]
+	if ratio := bc.files[sealed].deadRatio(); ratio < 0.8 {
+		t.Fatalf("dead ratio before merge = %v, want >= 0.8", ratio)
+	}
+
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if files := dataFiles(t, dir); len(files) != 1 {
+		t.Fatalf("data files after merge = %v, want only the active file", files)
+	}
+	if _, ok := bc.files[sealed]; ok {
+		t.Error("stats of merged file were not dropped")
+	}
+	if dead := bc.files[bc.dbFile.CurrentFile()].deadBytes; dead != 0 {
+		t.Errorf("dead bytes after merge = %d, want 0", dead)
+	}
+	checkMerged(t, e)
+	e.Close()
+
+	checkMerged(t, openTestEngine(t, dir))
+}
+
+func TestMergeRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbage(t, dir)
+
+	e := openTestEngine(t, dir, WithMergePolicy(MergePolicy{BytesPerSecond: 10 * 1024}))
+	start := time.Now()
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	// the sealed file is a little over 2KB
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("rate limited merge took %v", elapsed)
+	}
+	checkMerged(t, e)
+}
+
+func TestMergeScheduler(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbage(t, dir)
+
+	e := openTestEngine(t, dir, WithMergePolicy(MergePolicy{
+		DeadRatio:     0.5,
+		CheckInterval: 10 * time.Millisecond,
+	}))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dataFiles(t, dir)) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduler did not merge the sealed file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkMerged(t, e)
+}
+
+func TestMergeSchedulerBelowThreshold(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbage(t, dir)
+
+	e := openTestEngine(t, dir, WithMergePolicy(MergePolicy{
+		DeadBytes:     1 << 20,
+		CheckInterval: 10 * time.Millisecond,
+	}))
+	time.Sleep(100 * time.Millisecond)
+	if files := dataFiles(t, dir); len(files) != 2 {
+		t.Errorf("data files = %v, want the sealed file to be kept", files)
+	}
+	checkMerged(t, e)
+}
+
+func TestMergePolicyInWindow(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2022, 7, 11, hour, 30, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name   string
+		policy MergePolicy
+		hour   int
+		want   bool
+	}{
+		{"no window", MergePolicy{}, 12, true},
+		{"inside", MergePolicy{WindowStart: 2 * time.Hour, WindowEnd: 5 * time.Hour}, 3, true},
+		{"before", MergePolicy{WindowStart: 2 * time.Hour, WindowEnd: 5 * time.Hour}, 1, false},
+		{"after", MergePolicy{WindowStart: 2 * time.Hour, WindowEnd: 5 * time.Hour}, 5, false},
+		{"wrapped late", MergePolicy{WindowStart: 22 * time.Hour, WindowEnd: 4 * time.Hour}, 23, true},
+		{"wrapped early", MergePolicy{WindowStart: 22 * time.Hour, WindowEnd: 4 * time.Hour}, 1, true},
+		{"wrapped outside", MergePolicy{WindowStart: 22 * time.Hour, WindowEnd: 4 * time.Hour}, 12, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.inWindow(at(tt.hour)); got != tt.want {
+				t.Errorf("inWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
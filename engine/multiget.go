@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"sort"
+)
+
+type pendingRead struct {
+	key   string
+	value storedValue
+}
+
+// MultiGet returns the values of those keys that exist. Values are read in
+// file and offset order, so fetching many keys takes mostly sequential
+// reads rather than random ones.
+func (b *bucket) MultiGet(keys []string) (map[string]string, error) {
+	c := b.c
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(keys))
+	reads := make([]pendingRead, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		set, err := c.find(b.id, key)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := c.cache.get(cacheKey(b.id, key)); ok {
+			values[key] = value
+			continue
+		}
+		reads = append(reads, pendingRead{key: key, value: c.valueOf(*set)})
+	}
+
+	sort.Slice(reads, func(i, j int) bool {
+		x, y := reads[i].value, reads[j].value
+		if x.fileId != y.fileId {
+			return x.fileId < y.fileId
+		}
+		return x.pos < y.pos
+	})
+	for _, read := range reads {
+		value, err := c.readValue(b.id, read.key, read.value)
+		if err != nil {
+			return nil, err
+		}
+		values[read.key] = value
+	}
+	return values, nil
+}
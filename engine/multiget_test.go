@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMultiGet(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir, WithBlobThreshold(1024), WithValueCache(1<<20))
+	want := writeKeys(t, e)
+	e.Close()
+	// spread the values over several data files
+	e = openTestEngine(t, dir, WithBlobThreshold(1024), WithValueCache(1<<20))
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := e.Put(key, "new"); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = "new"
+	}
+	// some values come from the cache
+	if _, err := e.Get("key-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"missing", "key-1", "key-1"}
+	for key := range want {
+		keys = append(keys, key)
+	}
+	got, err := e.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MultiGet() returned %d values, want %d", len(got), len(want))
+	}
+
+	got, err = e.MultiGet(nil)
+	if err != nil || len(got) != 0 {
+		t.Errorf("MultiGet(nil) = %v, %v, want no values", got, err)
+	}
+}
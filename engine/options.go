@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/machinly/bitcask/engine/compress"
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/index"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+const (
+	DEFAULT_COMPRESSION_MIN_SIZE = 128
+	DEFAULT_MAX_KEY_SIZE         = 64 * 1024 // 64KB
+	// MAX_ENCRYPTED_STREAM_SIZE bounds the values PutReader reads into
+	// memory to encrypt them.
+	MAX_ENCRYPTED_STREAM_SIZE = 64 * 1024 * 1024 // 64MB
+)
+
+type options struct {
+	readOnly    bool
+	replica     bool
+	mergePolicy MergePolicy
+	recordOpts  []record.Option
+	checksum    record.Checksum
+	keyProvider KeyProvider
+	// maxValueSize of zero means no limit.
+	maxKeySize    int
+	maxValueSize  int64
+	blobThreshold int64
+	dbFileOpts    []dbfile.Option
+	// dataFileOpts apply to the data files only.
+	dataFileOpts []dbfile.Option
+	cacheSize    int64
+	// newIndex is nil for the default index.
+	newIndex      func() index.Index
+	diskIndex     bool
+	diskIndexOpts []index.DiskOption
+	bloomRate     float64
+	// subscriberBuffer is the capacity of a subscriber's queue.
+	subscriberBuffer int
+}
+
+type Option func(*options)
+
+// WithReadOnly opens the engine without an active data file. Writes return
+// ErrReadOnly and the directory is left untouched.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithMergePolicy merges sealed data files automatically whenever the
+// policy's garbage thresholds are crossed. See MergePolicy.
+func WithMergePolicy(p MergePolicy) Option {
+	return func(o *options) {
+		o.mergePolicy = p
+	}
+}
+
+// WithCompression compresses values of at least minSize bytes with codec
+// before they are written. Get decompresses them transparently, and files
+// written with and without compression can be mixed freely. A minSize of
+// zero uses DEFAULT_COMPRESSION_MIN_SIZE.
+func WithCompression(codec compress.Codec, minSize int) Option {
+	if minSize <= 0 {
+		minSize = DEFAULT_COMPRESSION_MIN_SIZE
+	}
+	return func(o *options) {
+		o.recordOpts = append(o.recordOpts, record.WithCompression(codec, minSize))
+	}
+}
+
+// WithChecksum selects the checksum of new records. CRC32C is faster than
+// the default CRC32 on CPUs with hardware support. Existing records are
+// verified with whichever checksum they were written with.
+func WithChecksum(c record.Checksum) Option {
+	return func(o *options) {
+		o.checksum = c
+	}
+}
+
+// WithEncryption encrypts values with AES-GCM under the provider's current
+// key. Opening a directory that holds encrypted records without a provider,
+// or with one that lacks the right keys, fails with ErrMissingKey or
+// ErrWrongKey. Record keys are not encrypted, the keydir is rebuilt from
+// them.
+func WithEncryption(provider KeyProvider) Option {
+	return func(o *options) {
+		o.keyProvider = provider
+	}
+}
+
+// WithMaxKeySize limits keys to n bytes, DEFAULT_MAX_KEY_SIZE by default
+// and at most record.V2_MAX_KEY_SIZE. Longer keys are rejected with
+// ErrKeyTooLarge.
+func WithMaxKeySize(n int) Option {
+	if n <= 0 {
+		n = DEFAULT_MAX_KEY_SIZE
+	}
+	if n > record.V2_MAX_KEY_SIZE {
+		n = record.V2_MAX_KEY_SIZE
+	}
+	return func(o *options) {
+		o.maxKeySize = n
+	}
+}
+
+// WithMaxValueSize limits values to n bytes. Larger values are rejected with
+// ErrValueTooLarge. By default values are not limited.
+func WithMaxValueSize(n int64) Option {
+	return func(o *options) {
+		o.maxValueSize = n
+	}
+}
+
+// WithBlobThreshold stores values of at least n bytes in separate blob
+// files, so merging the data files doesn't copy them. Blob files are
+// compacted on their own, see MergePolicy.BlobDeadRatio, and only while a
+// threshold is set. Zero, the default, keeps every value in the data files.
+func WithBlobThreshold(n int64) Option {
+	return func(o *options) {
+		o.blobThreshold = n
+	}
+}
+
+// WithMaxOpenFiles bounds the read handles kept open for data files, and
+// separately for blob files, to n. Files are reopened on demand. Defaults
+// to dbfile.DEFAULT_MAX_OPEN_FILES.
+func WithMaxOpenFiles(n int) Option {
+	return func(o *options) {
+		o.dbFileOpts = append(o.dbFileOpts, dbfile.WithMaxOpenFiles(n))
+	}
+}
+
+// WithWriteBuffer buffers up to size bytes of records in memory and appends
+// them to the active data file with one syscall, which speeds up bulk loads
+// of small records. Buffered records are read back from memory; they reach
+// the file when the buffer fills, on Sync, merge or Close, or at the latest
+// maxDelay after being written, and are lost if the process dies first.
+// Blob files are always written through. See dbfile.WithWriteBuffer.
+func WithWriteBuffer(size int, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.dataFileOpts = append(o.dataFileOpts, dbfile.WithWriteBuffer(size, maxDelay))
+	}
+}
+
+// WithValueCache keeps recently read values in memory, up to about size
+// bytes including per-entry overhead. Values larger than a sixteenth of
+// size are never cached. Hits and misses are reported by Stats.
+func WithValueCache(size int64) Option {
+	return func(o *options) {
+		o.cacheSize = size
+	}
+}
+
+// WithIndex keeps the keydir in the index newIndex returns instead of the
+// default index.NewIndex. The index is filled by replaying the data files
+// on open.
+func WithIndex(newIndex func() index.Index) Option {
+	return func(o *options) {
+		o.newIndex = newIndex
+		o.diskIndex = false
+	}
+}
+
+// WithCompactIndex keeps the keydir in index.NewCompactIndex, which takes
+// about half the memory per key.
+func WithCompactIndex() Option {
+	return WithIndex(index.NewCompactIndex)
+}
+
+// WithDiskIndex keeps the keydir in index.DISK_INDEX_FILE in the data
+// directory, for more keys than fit in memory. Named buckets and their
+// catalog each get an index file starting with BUCKET_INDEX_PREFIX. After a
+// clean Close the engine opens without replaying the data files. A
+// read-only engine keeps its keydirs in memory instead, as it mustn't write
+// the index files.
+func WithDiskIndex(opts ...index.DiskOption) Option {
+	return func(o *options) {
+		o.diskIndex = true
+		o.diskIndexOpts = opts
+	}
+}
+
+// WithBloomFilter keeps a Bloom filter of the keys in memory, so most
+// lookups of absent keys are answered without reading the keydir, at a
+// false positive rate of about rate, DEFAULT_BLOOM_RATE if zero. The filter
+// is rebuilt when it fills up and after merges, and saved next to a disk
+// index on Close.
+func WithBloomFilter(rate float64) Option {
+	if rate <= 0 || rate >= 1 {
+		rate = DEFAULT_BLOOM_RATE
+	}
+	return func(o *options) {
+		o.bloomRate = rate
+	}
+}
+
+// WithSubscriberBuffer lets a subscriber fall up to n writes behind before
+// it is dropped with ErrSubscriberLagged, DEFAULT_SUBSCRIBER_BUFFER if n
+// isn't positive. Buffered events hold their values in memory.
+func WithSubscriberBuffer(n int) Option {
+	if n <= 0 {
+		n = DEFAULT_SUBSCRIBER_BUFFER
+	}
+	return func(o *options) {
+		o.subscriberBuffer = n
+	}
+}
@@ -0,0 +1,86 @@
+package record
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// V2_BLOB marks a pointer record: its value is an encoded BlobRef and the
+// actual value is stored in a blob file.
+const V2_BLOB = byte(0x40) // value in blob file 0100 0000
+
+// BlobRef locates a value that was written to a blob file as a record of its
+// own. Flags and KeyId tell how that record's value is encoded.
+type BlobRef struct {
+	// File is the base name of the blob file.
+	File          string
+	ValuePosition int64
+	ValueSize     int64
+	Flags         byte
+	KeyId         uint32
+}
+
+// NewBlobPointerV2 returns the pointer record for blob, a record that was
+// written to file at offset. The pointer shares the blob record's key,
+// bucket, sequence number and timestamp.
+func NewBlobPointerV2(blob Record, file string, offset int64, opts ...Option) (Record, error) {
+	ref := BlobRef{
+		File:          file,
+		ValuePosition: offset + blob.ValueRelativePosition(),
+		ValueSize:     blob.ValueSize(),
+		Flags:         blob.Flags(),
+		KeyId:         blob.KeyId(),
+	}
+	rec, err := newRecordV2(blob.Seq(), blob.Key(), string(encodeBlobRef(ref)), blob.Time().UnixNano(), false)
+	if err != nil {
+		return nil, err
+	}
+	r := rec.(*record)
+	opts = append([]Option{WithBucket(blob.Bucket())}, opts...)
+	for _, opt := range opts {
+		err := opt(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.flags |= V2_BLOB
+	return r, nil
+}
+
+// | flags 1b | key id uvarint | value position uvarint | value size uvarint | file name |
+func encodeBlobRef(ref BlobRef) []byte {
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(ref.File))
+	buf = append(buf, ref.Flags)
+	buf = appendUvarint(buf, uint64(ref.KeyId))
+	buf = appendUvarint(buf, uint64(ref.ValuePosition))
+	buf = appendUvarint(buf, uint64(ref.ValueSize))
+	return append(buf, ref.File...)
+}
+
+// DecodeBlobRef decodes the value of a pointer record.
+func DecodeBlobRef(value string) (BlobRef, error) {
+	invalid := &ErrCorruptRecord{Reason: "invalid blob reference"}
+	buf := []byte(value)
+	if len(buf) == 0 {
+		return BlobRef{}, invalid
+	}
+	ref := BlobRef{Flags: buf[0]}
+	buf = buf[1:]
+	fields := make([]uint64, 3)
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return BlobRef{}, invalid
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	if fields[0] > math.MaxUint32 || fields[1] > math.MaxInt64 || fields[2] > math.MaxInt64 || len(buf) == 0 {
+		return BlobRef{}, invalid
+	}
+	ref.KeyId = uint32(fields[0])
+	ref.ValuePosition = int64(fields[1])
+	ref.ValueSize = int64(fields[2])
+	ref.File = string(buf)
+	return ref, nil
+}
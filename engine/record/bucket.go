@@ -0,0 +1,19 @@
+package record
+
+// V2_BUCKET marks a record of a bucket other than the default one. Its
+// header then has the bucket id after the key id.
+const V2_BUCKET = byte(0x80) // bucket id in header 1000 0000
+
+// WithBucket puts the record in bucket. Bucket 0 is the default bucket,
+// whose records don't carry an id.
+func WithBucket(bucket uint32) Option {
+	return func(r *record) error {
+		r.bucket = bucket
+		if bucket == 0 {
+			r.flags &^= V2_BUCKET
+		} else {
+			r.flags |= V2_BUCKET
+		}
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package record
+
+import (
+	"hash"
+	"hash/crc32"
+)
+
+// Checksum is the algorithm that protects a V2 record, stored in its flags.
+// Records with different checksums can be mixed in one file.
+type Checksum byte
+
+const (
+	CRC32  Checksum = 0 // IEEE polynomial, the V1 and default V2 checksum
+	CRC32C Checksum = 1 // Castagnoli polynomial, hardware accelerated on most CPUs
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (c Checksum) String() string {
+	switch c {
+	case CRC32:
+		return "crc32"
+	case CRC32C:
+		return "crc32c"
+	}
+	return "unknown"
+}
+
+// WithChecksum selects the checksum of the record.
+func WithChecksum(c Checksum) Option {
+	return func(r *record) error {
+		if c != CRC32 && c != CRC32C {
+			return ErrUnknownChecksum
+		}
+		r.flags = r.flags&^V2_CHECKSUM_MASK | byte(c)<<V2_CHECKSUM_SHIFT
+		return nil
+	}
+}
+
+// newChecksum returns the hash declared by a record's flags.
+func newChecksum(flags byte) (hash.Hash32, error) {
+	switch Checksum(flags & V2_CHECKSUM_MASK >> V2_CHECKSUM_SHIFT) {
+	case CRC32:
+		return crc32.NewIEEE(), nil
+	case CRC32C:
+		return crc32.New(castagnoli), nil
+	}
+	return nil, &ErrCorruptRecord{Reason: "unknown checksum type"}
+}
@@ -0,0 +1,70 @@
+package record
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrMissingKey = errors.New("encryption key not available")
+	ErrWrongKey   = errors.New("value can't be decrypted: wrong encryption key")
+)
+
+// Keyring returns the cipher for a key id, so records written under
+// different keys can be read side by side.
+type Keyring interface {
+	Cipher(keyId uint32) (cipher.AEAD, error)
+}
+
+// WithEncryption seals the value with aead and records keyId in the header.
+// The record key is used as additional data, so a value can't be moved to
+// another key unnoticed. Apply it after WithCompression: encrypted data
+// doesn't compress.
+func WithEncryption(keyId uint32, aead cipher.AEAD) Option {
+	return func(r *record) error {
+		if r.delete {
+			return nil
+		}
+		sealed, err := seal(aead, r.key, []byte(r.value))
+		if err != nil {
+			return err
+		}
+		r.value = string(sealed)
+		r.vSize = int64(len(sealed))
+		r.flags |= V2_ENCRYPTED
+		r.keyId = keyId
+		return nil
+	}
+}
+
+// seal returns nonce | ciphertext | tag.
+func seal(aead cipher.AEAD, key string, value []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, []byte(key)), nil
+}
+
+func open(keys Keyring, keyId uint32, key string, sealed []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("%w: key id %d", ErrMissingKey, keyId)
+	}
+	aead, err := keys.Cipher(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, &ErrCorruptRecord{Reason: "encrypted value too short"}
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key id %d", ErrWrongKey, keyId)
+	}
+	return value, nil
+}
@@ -0,0 +1,55 @@
+package record
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyKey           = errors.New("key is empty")
+	ErrKeyTooLarge        = errors.New("key is too large")
+	ErrValueTooLarge      = errors.New("value is too large")
+	ErrUnsupportedVersion = errors.New("unsupported record version")
+	ErrUnknownChecksum    = errors.New("unknown checksum type")
+)
+
+// ErrCorruptRecord reports a record that can't be decoded. ParseRecord only
+// knows the reason; callers that know where the record lives fill in File
+// and Offset.
+type ErrCorruptRecord struct {
+	File   string
+	Offset int64
+	Reason string
+	// Truncated is set when the input ended inside the record, which is
+	// all that is wrong with a record that is still being written.
+	Truncated bool
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("corrupt record: %s", e.Reason)
+	}
+	return fmt.Sprintf("corrupt record in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// Is makes errors.Is(err, &ErrCorruptRecord{}) match any corrupt record
+// error regardless of its location.
+func (e *ErrCorruptRecord) Is(target error) bool {
+	_, ok := target.(*ErrCorruptRecord)
+	return ok
+}
+
+// WithLocation returns a copy of err with its location set if err is an
+// *ErrCorruptRecord, and err unchanged otherwise.
+func WithLocation(err error, fileName string, offset int64) error {
+	var corrupt *ErrCorruptRecord
+	if !errors.As(err, &corrupt) {
+		return err
+	}
+	return &ErrCorruptRecord{
+		File:      fileName,
+		Offset:    offset,
+		Reason:    corrupt.Reason,
+		Truncated: corrupt.Truncated,
+	}
+}
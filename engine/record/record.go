@@ -2,12 +2,15 @@ package record
 
 import (
 	"bytes"
-	"errors"
+	"encoding/binary"
+	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"math"
 	"time"
 
+	"github.com/machinly/bitcask/engine/compress"
 	"github.com/machinly/bitcask/util"
 )
 
@@ -16,7 +19,23 @@ type Record interface {
 	ValueSize() int64
 	Key() string
 	Value() string
+	// Timestamp is the write time as stored: seconds for V1 records and
+	// nanoseconds for V2 records. Use Time for a comparable value.
 	Timestamp() int64
+	Time() time.Time
+	// Seq is the record's sequence number. V1 records have none and return 0.
+	Seq() uint64
+	Version() byte
+	// Flags returns the V2 flags byte, including the delete flag.
+	Flags() byte
+	// KeyId is the id of the encryption key of an encrypted record.
+	KeyId() uint32
+	// Bucket is the id of the record's bucket, 0 for the default bucket.
+	Bucket() uint32
+	// DecodeValue returns the value as it was written, undoing any
+	// compression and encryption. Value and ValueSize describe the stored
+	// bytes. keys may be nil if the record isn't encrypted.
+	DecodeValue(keys Keyring) (string, error)
 	ToBytes() ([]byte, error)
 	Len() int64
 	SetMeta(fileName string, offset int64)
@@ -37,37 +56,149 @@ const (
 	V1_DELETE  = byte(0x1) // delete flag 0001
 )
 
+// V2 RECORD
+// | version 1b | crc 4b | flags 1b | [key id uvarint] | [bucket uvarint] | seq uvarint | tstamp varint | key size uvarint | value size uvarint | key | value |
+// The key id is only present on encrypted records, the bucket on records
+// outside the default bucket. The timestamp is in
+// nanoseconds and the crc covers everything after it, computed with the
+// checksum the flags declare.
+const (
+	V2_CRC_SIZE   = 4  // CRC Size
+	V2_FLAGS_SIZE = 1  // Flags Size
+	V2_MAX_HEADER = 51 // Largest possible header, with every varint at its maximum length
+	// V2_MAX_KEY_SIZE is the largest key a V2 record holds, 1MB.
+	V2_MAX_KEY_SIZE = 1 << 20
+
+	V2_VERSION = 0x1       // Version 0001
+	V2_DELETE  = V1_DELETE // delete flag 0001
+
+	V2_COMPRESSION_MASK  = byte(0x6) // compression codec 0110, see compress.Codec
+	V2_COMPRESSION_SHIFT = 1
+	V2_ENCRYPTED         = byte(0x8)  // value encrypted 1000
+	V2_CHECKSUM_MASK     = byte(0x30) // checksum type 0011 0000, see Checksum
+	V2_CHECKSUM_SHIFT    = 4
+)
+
 type record struct {
-	tStamp int64
-	kSize  int32
-	vSize  int64
-	key    string
-	value  string
-	delete bool
-	meta   struct {
+	version byte
+	seq     uint64
+	flags   byte
+	keyId   uint32
+	bucket  uint32
+	tStamp  int64
+	kSize   int32
+	vSize   int64
+	key     string
+	value   string
+	delete  bool
+	meta    struct {
 		fileName string
 		offset   int64
 	}
 }
 
+// NewRecord creates a V1 record. New data is written as V2, see NewRecordV2.
 func NewRecord(key string, value string) (Record, error) {
 	return newRecord(key, value, time.Now().Unix(), false)
 }
 
+// NewDeleteRecord creates a V1 tombstone. See NewDeleteRecordV2.
 func NewDeleteRecord(key string) (Record, error) {
 	return newRecord(key, "", time.Now().Unix(), true)
 }
 
+// Option changes how a V2 record stores its value.
+type Option func(r *record) error
+
+// WithCompression compresses values of at least minSize bytes with codec.
+// Values that don't get smaller are stored as they are.
+func WithCompression(codec compress.Codec, minSize int) Option {
+	return func(r *record) error {
+		if codec == compress.None || len(r.value) < minSize {
+			return nil
+		}
+		encoded, err := compress.Encode(codec, []byte(r.value))
+		if err != nil {
+			return err
+		}
+		if len(encoded) >= len(r.value) {
+			return nil
+		}
+		r.value = string(encoded)
+		r.vSize = int64(len(encoded))
+		r.flags = r.flags&^V2_COMPRESSION_MASK | byte(codec)<<V2_COMPRESSION_SHIFT
+		return nil
+	}
+}
+
+// NewRecordV2 creates a V2 record. seq orders it against every other record
+// of the database, so the caller must hand out increasing values.
+func NewRecordV2(seq uint64, key string, value string, opts ...Option) (Record, error) {
+	rec, err := newRecordV2(seq, key, value, time.Now().UnixNano(), false)
+	if err != nil {
+		return nil, err
+	}
+	r := rec.(*record)
+	for _, opt := range opts {
+		err := opt(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// NewDeleteRecordV2 creates a V2 tombstone. It takes the same options as
+// NewRecordV2; those that concern the value leave the missing value alone.
+func NewDeleteRecordV2(seq uint64, key string, opts ...Option) (Record, error) {
+	rec, err := newRecordV2(seq, key, "", time.Now().UnixNano(), true)
+	if err != nil {
+		return nil, err
+	}
+	r := rec.(*record)
+	for _, opt := range opts {
+		err := opt(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// IsTombstone reports whether r deletes its key. V2 tombstones carry
+// V2_DELETE, so a V2 record may hold an empty value; a V1 record without a
+// value counts as deleted, as it always has.
+func IsTombstone(r Record) bool {
+	if r.Flags()&V2_DELETE != 0 {
+		return true
+	}
+	return r.Version() != V2_VERSION && r.ValueSize() == 0
+}
+
+func newRecordV2(seq uint64, key string, value string, timestamp int64, delete bool) (Record, error) {
+	rec, err := newRecord(key, value, timestamp, delete)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > V2_MAX_KEY_SIZE {
+		return nil, ErrKeyTooLarge
+	}
+	r := rec.(*record)
+	r.version = V2_VERSION
+	r.seq = seq
+	return r, nil
+}
+
 func newRecord(key string, value string, timestamp int64, delete bool) (Record, error) {
 	if len(key) == 0 {
-		return nil, errors.New("key is empty")
+		return nil, ErrEmptyKey
 	}
 
 	if len(key) > math.MaxInt32 {
-		return nil, errors.New("key is too long")
+		return nil, ErrKeyTooLarge
 	}
 	if len(value) > math.MaxInt64 {
-		return nil, errors.New("value is too long")
+		return nil, ErrValueTooLarge
 	}
 
 	return &record{
@@ -81,7 +212,31 @@ func newRecord(key string, value string, timestamp int64, delete bool) (Record,
 }
 
 func (r *record) ValueRelativePosition() int64 {
-	return V1_RECORD_SIZE + int64(len(r.key))
+	return r.headerSize() + int64(len(r.key))
+}
+
+func (r *record) headerSize() int64 {
+	if r.version == V2_VERSION {
+		return HeaderSizeV2(r.flags, r.keyId, r.bucket, r.seq, r.tStamp, int64(r.kSize), r.vSize)
+	}
+	return V1_RECORD_SIZE
+}
+
+// HeaderSizeV2 returns the size of a V2 header with the given fields.
+func HeaderSizeV2(flags byte, keyId uint32, bucket uint32, seq uint64, tstamp int64, keySize int64, valueSize int64) int64 {
+	buf := make([]byte, binary.MaxVarintLen64)
+	size := VER_SIZE + V2_CRC_SIZE + V2_FLAGS_SIZE
+	if flags&V2_ENCRYPTED != 0 {
+		size += binary.PutUvarint(buf, uint64(keyId))
+	}
+	if flags&V2_BUCKET != 0 {
+		size += binary.PutUvarint(buf, uint64(bucket))
+	}
+	size += binary.PutUvarint(buf, seq)
+	size += binary.PutVarint(buf, tstamp)
+	size += binary.PutUvarint(buf, uint64(keySize))
+	size += binary.PutUvarint(buf, uint64(valueSize))
+	return int64(size)
 }
 
 func (r *record) ValueSize() int64 {
@@ -100,11 +255,201 @@ func (r *record) Timestamp() int64 {
 	return r.tStamp
 }
 
+func (r *record) Time() time.Time {
+	if r.version == V2_VERSION {
+		return time.Unix(0, r.tStamp)
+	}
+	return time.Unix(r.tStamp, 0)
+}
+
+func (r *record) Seq() uint64 {
+	return r.seq
+}
+
+func (r *record) Version() byte {
+	return r.version
+}
+
+func (r *record) Flags() byte {
+	if r.delete {
+		return r.flags | V2_DELETE
+	}
+	return r.flags
+}
+
+func (r *record) KeyId() uint32 {
+	return r.keyId
+}
+
+func (r *record) Bucket() uint32 {
+	return r.bucket
+}
+
+func (r *record) DecodeValue(keys Keyring) (string, error) {
+	value, err := DecodeValue(r.Flags(), r.keyId, r.key, []byte(r.value), keys)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// DecodeValue turns the stored bytes of a value back into the value that
+// was written, given the flags and key id of its record and its key.
+func DecodeValue(flags byte, keyId uint32, key string, stored []byte, keys Keyring) ([]byte, error) {
+	value := stored
+	if flags&V2_ENCRYPTED != 0 {
+		var err error
+		value, err = open(keys, keyId, key, stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+	codec := compress.Codec(flags & V2_COMPRESSION_MASK >> V2_COMPRESSION_SHIFT)
+	if codec == compress.None {
+		return value, nil
+	}
+	value, err := compress.Decode(codec, value)
+	if err != nil {
+		return nil, &ErrCorruptRecord{Reason: err.Error()}
+	}
+	return value, nil
+}
+
+// Rewrite returns a V2 copy of r with the same key and timestamp whose
+// value is re-encoded with opts, for example to encrypt it under a new key.
+// The record stays in its bucket.
+// keys decodes the current value. seq is normally r.Seq(), but V1 records
+// have none and need a new one.
+func Rewrite(r Record, seq uint64, keys Keyring, opts ...Option) (Record, error) {
+	value, err := r.DecodeValue(keys)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := newRecordV2(seq, r.Key(), value, r.Time().UnixNano(), false)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithBucket(r.Bucket())}, opts...)
+	for _, opt := range opts {
+		err := opt(rec.(*record))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
 func (r *record) Len() int64 {
-	return int64(V1_RECORD_SIZE + len(r.key) + len(r.value))
+	return r.headerSize() + int64(r.kSize) + r.vSize
 }
 
 func (r *record) ToBytes() ([]byte, error) {
+	if r.version == V2_VERSION {
+		return r.toBytesV2()
+	}
+	return r.toBytesV1()
+}
+
+func (r *record) toBytesV2() ([]byte, error) {
+	buf := make([]byte, 0, r.Len())
+	buf = r.appendHeaderV2(buf)
+	buf = append(buf, r.key...)
+	buf = append(buf, r.value...)
+
+	crc, err := newChecksum(buf[VER_SIZE+V2_CRC_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	crc.Write(buf[VER_SIZE+V2_CRC_SIZE:])
+	copy(buf[VER_SIZE:], util.Uint32ToBytes(crc.Sum32()))
+	return buf, nil
+}
+
+// appendHeaderV2 appends the V2 header with a zero crc.
+func (r *record) appendHeaderV2(buf []byte) []byte {
+	// | flags 1b | [key id uvarint] | [bucket uvarint] | seq uvarint | tstamp varint | key size uvarint | value size uvarint |
+	buf = append(buf, V2_VERSION, 0, 0, 0, 0)
+	flags := r.flags
+	if r.delete {
+		flags |= V2_DELETE
+	}
+	buf = append(buf, flags)
+	if flags&V2_ENCRYPTED != 0 {
+		buf = appendUvarint(buf, uint64(r.keyId))
+	}
+	if flags&V2_BUCKET != 0 {
+		buf = appendUvarint(buf, uint64(r.bucket))
+	}
+	buf = appendUvarint(buf, r.seq)
+	buf = appendVarint(buf, r.tStamp)
+	buf = appendUvarint(buf, uint64(r.kSize))
+	return appendUvarint(buf, uint64(r.vSize))
+}
+
+// WriteV2 writes a V2 record whose value is copied from value rather than
+// held in memory. The checksum is computed as the value passes through and
+// patched into the header last, through w's WriteAt. The returned record
+// describes what was written but carries no value. Compression and
+// encryption need the whole value, so they aren't available here; opts
+// may set the bucket.
+func WriteV2(w interface {
+	io.Writer
+	io.WriterAt
+}, seq uint64, key string, value io.Reader, size int64, checksum Checksum, opts ...Option) (Record, error) {
+	if size < 0 {
+		return nil, ErrValueTooLarge
+	}
+	rec, err := newRecordV2(seq, key, "", time.Now().UnixNano(), false)
+	if err != nil {
+		return nil, err
+	}
+	r := rec.(*record)
+	r.vSize = size
+	for _, opt := range append(opts, WithChecksum(checksum)) {
+		err := opt(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	crc, err := newChecksum(r.flags)
+	if err != nil {
+		return nil, err
+	}
+
+	head := r.appendHeaderV2(make([]byte, 0, V2_MAX_HEADER))
+	head = append(head, key...)
+	crc.Write(head[VER_SIZE+V2_CRC_SIZE:])
+	_, err = w.Write(head)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.CopyN(io.MultiWriter(w, crc), value, size)
+	if err == io.EOF {
+		return nil, fmt.Errorf("value ended after %d of %d bytes: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.WriteAt(util.Uint32ToBytes(crc.Sum32()), VER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func (r *record) toBytesV1() ([]byte, error) {
 	// | crc 4b | tstamp 8b | key size 4b | value size 8b | key | value |
 	buf := bytes.NewBuffer([]byte{})
 
@@ -157,21 +502,36 @@ func (r *record) GetMeta() (string, int64) {
 	return r.meta.fileName, r.meta.offset
 }
 
+// ParseRecord reads one record of any supported version from reader.
+// Readers that implement io.ByteReader, such as bufio.Reader, are read
+// without extra buffering; others are wrapped so the V2 varint header can
+// be decoded without consuming bytes past the record.
 func ParseRecord(reader io.Reader) (Record, error) {
-	// | crc 4b | tstamp 8b | key size 4b | value size 8b | del flag 1b | key | value |
-	head := make([]byte, V1_RECORD_SIZE)
-	_, err := reader.Read(head)
+	ver := make([]byte, VER_SIZE)
+	_, err := io.ReadFull(reader, ver)
 	if err != nil {
 		return nil, err
 	}
 
-	offset := 0
-	version := util.BytesToUint32(head[offset : offset+VER_SIZE])
-	offset += VER_SIZE
-	if version != V1_VERSION {
-		return nil, errors.New("version error")
+	switch ver[0] {
+	case V1_VERSION:
+		return parseRecordV1(reader)
+	case V2_VERSION:
+		return parseRecordV2(reader)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, ver[0])
 	}
+}
 
+func parseRecordV1(reader io.Reader) (Record, error) {
+	// | crc 4b | tstamp 8b | key size 4b | value size 8b | del flag 1b | key | value |
+	head := make([]byte, V1_RECORD_SIZE)
+	_, err := io.ReadFull(reader, head[VER_SIZE:])
+	if err != nil {
+		return nil, truncated(err)
+	}
+
+	offset := VER_SIZE
 	crc := util.BytesToUint32(head[offset : offset+V1_CRC_SIZE])
 	offset += V1_CRC_SIZE
 
@@ -190,13 +550,21 @@ func ParseRecord(reader io.Reader) (Record, error) {
 		deleteFlag = true
 	}
 
+	if keySize <= 0 || valueSize < 0 {
+		return nil, &ErrCorruptRecord{Reason: "invalid key or value size"}
+	}
+
 	// get key
-	key := make([]byte, keySize)
-	_, err = reader.Read(key)
+	key, err := readSized(reader, int64(keySize))
+	if err != nil {
+		return nil, err
+	}
 
 	// get value
-	value := make([]byte, valueSize)
-	_, err = reader.Read(value)
+	value, err := readSized(reader, valueSize)
+	if err != nil {
+		return nil, err
+	}
 
 	// check crc
 	buf := bytes.NewBuffer([]byte{})
@@ -205,7 +573,288 @@ func ParseRecord(reader io.Reader) (Record, error) {
 	buf.Write(value)
 	crcSum := crc32.ChecksumIEEE(buf.Bytes())
 	if crcSum != crc {
-		return nil, errors.New("crc check error")
+		return nil, &ErrCorruptRecord{Reason: "crc mismatch"}
 	}
 	return newRecord(string(key), string(value), tstamp, deleteFlag)
 }
+
+func parseRecordV2(reader io.Reader) (Record, error) {
+	h, err := parseHeaderV2(reader)
+	if err != nil {
+		return nil, err
+	}
+	return h.ReadRecord()
+}
+
+// Header is a V2 record read up to the start of its value, which is still
+// in the reader it was parsed from.
+type Header struct {
+	rec    *record
+	head   []byte // version, crc, header fields and key as read
+	crc    uint32
+	sum    hash.Hash32
+	reader io.Reader
+	// whole is set for V1 records, which are read completely up front.
+	whole bool
+}
+
+// ParseHeader reads a record up to the start of its value. Exactly one of
+// ReadRecord, Skip, Discard and CopyTo must be called to consume the rest
+// of the record. V1 records, which only old files hold, are read whole.
+func ParseHeader(reader io.Reader) (*Header, error) {
+	ver := make([]byte, VER_SIZE)
+	_, err := io.ReadFull(reader, ver)
+	if err != nil {
+		return nil, err
+	}
+	switch ver[0] {
+	case V1_VERSION:
+		r, err := parseRecordV1(reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Header{rec: r.(*record), whole: true}, nil
+	case V2_VERSION:
+		return parseHeaderV2(reader)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, ver[0])
+	}
+}
+
+// Record returns the record without its value, unless it is a V1 record.
+func (h *Header) Record() Record {
+	return h.rec
+}
+
+// ReadRecord reads the value into memory and returns the complete record.
+func (h *Header) ReadRecord() (Record, error) {
+	if h.whole {
+		return h.rec, nil
+	}
+	value, err := readSized(h.reader, h.rec.vSize)
+	if err != nil {
+		return nil, err
+	}
+	h.sum.Write(value)
+	if h.sum.Sum32() != h.crc {
+		return nil, &ErrCorruptRecord{Reason: "crc mismatch"}
+	}
+	h.rec.value = string(value)
+	return h.rec, nil
+}
+
+// Skip discards the value without verifying it.
+func (h *Header) Skip() error {
+	if h.whole {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, h.reader, h.rec.vSize)
+	return truncated(err)
+}
+
+// Discard discards the value, verifying the checksum as it streams past.
+func (h *Header) Discard() error {
+	if h.whole {
+		return nil
+	}
+	_, err := io.CopyN(h.sum, h.reader, h.rec.vSize)
+	if err != nil {
+		return truncated(err)
+	}
+	if h.sum.Sum32() != h.crc {
+		return &ErrCorruptRecord{Reason: "crc mismatch"}
+	}
+	return nil
+}
+
+// CopyTo copies the whole record to w, streaming the value and verifying
+// the checksum on the way. On a checksum mismatch the record has already
+// been written, so w must be able to drop it again.
+func (h *Header) CopyTo(w io.Writer) error {
+	if h.whole {
+		buf, err := h.rec.ToBytes()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	}
+	_, err := w.Write(h.head)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.MultiWriter(w, h.sum), h.reader, h.rec.vSize)
+	if err == io.EOF {
+		return truncated(err)
+	}
+	if err != nil {
+		return err
+	}
+	if h.sum.Sum32() != h.crc {
+		return &ErrCorruptRecord{Reason: "crc mismatch"}
+	}
+	return nil
+}
+
+// parseHeaderV2 reads a V2 record after its version byte up to its value.
+func parseHeaderV2(reader io.Reader) (*Header, error) {
+	byteReader, ok := reader.(io.ByteReader)
+	if !ok {
+		byteReader = &singleByteReader{reader: reader}
+	}
+
+	// the header is captured as it is decoded so the crc can cover it
+	crcBuf := make([]byte, V2_CRC_SIZE)
+	_, err := io.ReadFull(reader, crcBuf)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	crc := util.BytesToUint32(crcBuf)
+	head := &captureReader{reader: byteReader, buf: make([]byte, 0, V2_MAX_HEADER)}
+	head.buf = append(head.buf, V2_VERSION)
+	head.buf = append(head.buf, crcBuf...)
+
+	flags, err := head.ReadByte()
+	if err != nil {
+		return nil, head.fail(err)
+	}
+	keyId := uint64(0)
+	if flags&V2_ENCRYPTED != 0 {
+		keyId, err = binary.ReadUvarint(head)
+		if err != nil {
+			return nil, head.fail(err)
+		}
+		if keyId > math.MaxUint32 {
+			return nil, &ErrCorruptRecord{Reason: "invalid key id"}
+		}
+	}
+	bucket := uint64(0)
+	if flags&V2_BUCKET != 0 {
+		bucket, err = binary.ReadUvarint(head)
+		if err != nil {
+			return nil, head.fail(err)
+		}
+		if bucket > math.MaxUint32 {
+			return nil, &ErrCorruptRecord{Reason: "invalid bucket"}
+		}
+	}
+	seq, err := binary.ReadUvarint(head)
+	if err != nil {
+		return nil, head.fail(err)
+	}
+	tstamp, err := binary.ReadVarint(head)
+	if err != nil {
+		return nil, head.fail(err)
+	}
+	keySize, err := binary.ReadUvarint(head)
+	if err != nil {
+		return nil, head.fail(err)
+	}
+	valueSize, err := binary.ReadUvarint(head)
+	if err != nil {
+		return nil, head.fail(err)
+	}
+	if keySize == 0 || keySize > V2_MAX_KEY_SIZE || valueSize > math.MaxInt64 {
+		return nil, &ErrCorruptRecord{Reason: "invalid key or value size"}
+	}
+
+	key := make([]byte, keySize)
+	_, err = io.ReadFull(reader, key)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	sum, err := newChecksum(flags)
+	if err != nil {
+		return nil, err
+	}
+	sum.Write(head.buf[VER_SIZE+V2_CRC_SIZE:])
+	sum.Write(key)
+
+	rec, err := newRecordV2(seq, string(key), "", tstamp, flags&V2_DELETE == V2_DELETE)
+	if err != nil {
+		return nil, err
+	}
+	r := rec.(*record)
+	r.flags = flags &^ V2_DELETE
+	r.keyId = uint32(keyId)
+	r.bucket = uint32(bucket)
+	r.vSize = int64(valueSize)
+	return &Header{
+		rec:    r,
+		head:   append(head.buf, key...),
+		crc:    crc,
+		sum:    sum,
+		reader: reader,
+	}, nil
+}
+
+// captureReader keeps a copy of every byte read through it.
+type captureReader struct {
+	reader io.ByteReader
+	buf    []byte
+	err    error
+}
+
+func (c *captureReader) ReadByte() (byte, error) {
+	b, err := c.reader.ReadByte()
+	if err != nil {
+		c.err = err
+		return 0, err
+	}
+	c.buf = append(c.buf, b)
+	return b, nil
+}
+
+// fail maps an error from decoding the header: read errors are passed on,
+// anything else means the varints themselves are malformed.
+func (c *captureReader) fail(err error) error {
+	if c.err != nil {
+		return truncated(c.err)
+	}
+	return &ErrCorruptRecord{Reason: "malformed header"}
+}
+
+// singleByteReader adapts an io.Reader to io.ByteReader without reading
+// ahead.
+type singleByteReader struct {
+	reader io.Reader
+	buf    [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(s.reader, s.buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return s.buf[0], nil
+}
+
+// truncated turns an unexpected end of input inside a record into a corrupt
+// record error.
+// readChunkSize is how much readSized allocates before any bytes arrive.
+const readChunkSize = 64 * 1024
+
+// readSized reads the size bytes a header announced. The buffer grows as
+// they arrive rather than being allocated up front, so a corrupt size fails
+// as a truncated record instead of asking for more memory than the reader
+// holds.
+func readSized(reader io.Reader, size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if size < readChunkSize {
+		buf.Grow(int(size))
+	} else {
+		buf.Grow(readChunkSize)
+	}
+	_, err := io.CopyN(&buf, reader, size)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ErrCorruptRecord{Reason: "truncated record", Truncated: true}
+	}
+	return err
+}
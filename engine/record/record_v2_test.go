@@ -0,0 +1,493 @@
+package record
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/machinly/bitcask/engine/compress"
+)
+
+func TestRecordV2RoundTrip(t *testing.T) {
+	ts := time.Date(2022, 7, 11, 8, 11, 7, 123456789, time.UTC).UnixNano()
+	normal, _ := newRecordV2(1, "test", "test", ts, false)
+	deleted, _ := newRecordV2(2, "test", "", ts, true)
+	bigSeq, _ := newRecordV2(1<<40, bigTestString, bigTestString, ts, false)
+	v1, _ := newRecord("test", "test", testTs, false)
+
+	var stream bytes.Buffer
+	for _, r := range []Record{normal, deleted, v1, bigSeq} {
+		buf, err := r.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(buf)) != r.Len() {
+			t.Errorf("len(ToBytes()) = %d, Len() = %d", len(buf), r.Len())
+		}
+		stream.Write(buf)
+	}
+
+	readers := map[string]io.Reader{
+		"byte reader":     bytes.NewReader(stream.Bytes()),
+		"non byte reader": iotest.OneByteReader(bytes.NewReader(stream.Bytes())),
+	}
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			for _, want := range []Record{normal, deleted, v1, bigSeq} {
+				got, err := ParseRecord(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("ParseRecord() got = %+v, want %+v", got, want)
+				}
+			}
+			if _, err := ParseRecord(reader); err != io.EOF {
+				t.Errorf("ParseRecord() at end of stream error = %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestRecordV2Layout(t *testing.T) {
+	ts := int64(1657527067000000000)
+	r, err := newRecordV2(300, "key", "value", ts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := r.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version, crc, flags, seq 300 takes 2 bytes, the timestamp 9, sizes 1 each
+	wantHeader := int64(VER_SIZE + V2_CRC_SIZE + V2_FLAGS_SIZE + 2 + 9 + 1 + 1)
+	if got := r.ValueRelativePosition(); got != wantHeader+3 {
+		t.Errorf("ValueRelativePosition() = %d, want %d", got, wantHeader+3)
+	}
+	if got := string(buf[r.ValueRelativePosition():]); got != "value" {
+		t.Errorf("value at ValueRelativePosition() = %q, want %q", got, "value")
+	}
+	if buf[0] != V2_VERSION {
+		t.Errorf("version = %d, want %d", buf[0], V2_VERSION)
+	}
+	if !r.Time().Equal(time.Unix(0, ts)) || r.Seq() != 300 {
+		t.Errorf("Time(), Seq() = %v, %d", r.Time(), r.Seq())
+	}
+}
+
+func TestParseRecordV2Errors(t *testing.T) {
+	r, _ := newRecordV2(7, "test", "test", 1657527067000000000, false)
+	good, _ := r.ToBytes()
+	badCrc := append([]byte{}, good...)
+	badCrc[len(badCrc)-1] ^= 0xFF
+	badVarint := append([]byte{V2_VERSION, 0, 0, 0, 0, 0}, bytes.Repeat([]byte{0xFF}, 11)...)
+	// sized is a record whose header announces the given sizes but that
+	// holds a one byte key and value
+	sized := func(keySize, valueSize uint64) []byte {
+		buf := make([]byte, 2*binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, keySize)
+		n += binary.PutUvarint(buf[n:], valueSize)
+		head := []byte{V2_VERSION, 0, 0, 0, 0, 0, 1, 0}
+		return append(append(head, buf[:n]...), 'k', 'v')
+	}
+	v1Sized := make([]byte, V1_RECORD_SIZE, V1_RECORD_SIZE+2)
+	binary.LittleEndian.PutUint32(v1Sized[VER_SIZE+V1_CRC_SIZE+V1_TS_SIZE:], 1)
+	binary.LittleEndian.PutUint64(v1Sized[VER_SIZE+V1_CRC_SIZE+V1_TS_SIZE+V1_KS_SIZE:], 1<<62)
+	v1Sized = append(v1Sized, 'k', 'v')
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"crc mismatch", badCrc},
+		{"truncated header", good[:8]},
+		{"truncated value", good[:len(good)-2]},
+		{"malformed varint", badVarint},
+		// corrupt sizes fail without allocating what they announce
+		{"huge key size", sized(1<<40, 1)},
+		{"key size over the limit", sized(V2_MAX_KEY_SIZE+1, 1)},
+		{"huge value size", sized(1, 1<<62)},
+		{"largest value size", sized(1, math.MaxInt64)},
+		{"v1 huge value size", v1Sized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRecord(bytes.NewReader(tt.data))
+			if !errors.Is(err, &ErrCorruptRecord{}) {
+				t.Errorf("ParseRecord() error = %v, want corrupt record", err)
+			}
+		})
+	}
+}
+
+func TestRecordV2Compression(t *testing.T) {
+	value := strings.Repeat(`{"name":"bitcask","tags":["kv","log"]},`, 100)
+	tests := []struct {
+		name       string
+		value      string
+		opt        Option
+		compressed bool
+	}{
+		{"snappy", value, WithCompression(compress.Snappy, 64), true},
+		{"deflate", value, WithCompression(compress.Deflate, 64), true},
+		{"below threshold", value[:32], WithCompression(compress.Snappy, 64), false},
+		{"incompressible", "0123456789abcdefghijklmnopqrstuvwxyz", WithCompression(compress.Snappy, 8), false},
+		{"none", value, WithCompression(compress.None, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRecordV2(1, "key", tt.value, tt.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := r.Flags()&V2_COMPRESSION_MASK != 0; compressed != tt.compressed {
+				t.Fatalf("compressed = %v, want %v", compressed, tt.compressed)
+			}
+			if tt.compressed && r.ValueSize() >= int64(len(tt.value)) {
+				t.Errorf("ValueSize() = %d, want less than %d", r.ValueSize(), len(tt.value))
+			}
+			buf, err := r.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseRecord(bytes.NewReader(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Flags() != r.Flags() || parsed.ValueSize() != r.ValueSize() {
+				t.Errorf("parsed flags, size = %x, %d, want %x, %d", parsed.Flags(), parsed.ValueSize(), r.Flags(), r.ValueSize())
+			}
+			got, err := parsed.DecodeValue(nil)
+			if err != nil || got != tt.value {
+				t.Errorf("DecodeValue() = %q, %v", got, err)
+			}
+			stored := buf[r.ValueRelativePosition():]
+			if decoded, err := DecodeValue(r.Flags(), 0, "key", stored, nil); err != nil || string(decoded) != tt.value {
+				t.Errorf("DecodeValue() of stored bytes = %q, %v", decoded, err)
+			}
+		})
+	}
+}
+
+type testKeyring map[uint32]cipher.AEAD
+
+func (k testKeyring) Cipher(keyId uint32) (cipher.AEAD, error) {
+	aead, ok := k[keyId]
+	if !ok {
+		return nil, ErrMissingKey
+	}
+	return aead, nil
+}
+
+func newTestAEAD(t *testing.T, seed byte) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestRecordV2Encryption(t *testing.T) {
+	value := strings.Repeat("secret ", 50)
+	keys := testKeyring{7: newTestAEAD(t, 1), 8: newTestAEAD(t, 2)}
+	r, err := NewRecordV2(1, "key", value, WithCompression(compress.Snappy, 0), WithEncryption(7, keys[7]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Flags()&V2_ENCRYPTED == 0 || r.Flags()&V2_COMPRESSION_MASK == 0 || r.KeyId() != 7 {
+		t.Fatalf("Flags(), KeyId() = %x, %d", r.Flags(), r.KeyId())
+	}
+	buf, err := r.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, []byte("secret")) {
+		t.Error("encoded record contains the plaintext value")
+	}
+	parsed, err := ParseRecord(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.KeyId() != 7 || parsed.Len() != int64(len(buf)) {
+		t.Errorf("parsed KeyId(), Len() = %d, %d, want 7, %d", parsed.KeyId(), parsed.Len(), len(buf))
+	}
+	if got, err := parsed.DecodeValue(keys); err != nil || got != value {
+		t.Errorf("DecodeValue() = %q, %v", got, err)
+	}
+	if _, err := parsed.DecodeValue(nil); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("DecodeValue(nil) error = %v, want %v", err, ErrMissingKey)
+	}
+	if _, err := parsed.DecodeValue(testKeyring{7: keys[8]}); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("DecodeValue() with wrong key error = %v, want %v", err, ErrWrongKey)
+	}
+	// the key is authenticated along with the value
+	stored := buf[r.ValueRelativePosition():]
+	if _, err := DecodeValue(r.Flags(), 7, "other", stored, keys); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("DecodeValue() under another key error = %v, want %v", err, ErrWrongKey)
+	}
+
+	rotated, err := Rewrite(parsed, parsed.Seq(), keys, WithEncryption(8, keys[8]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.KeyId() != 8 || rotated.Seq() != 1 || !rotated.Time().Equal(r.Time()) {
+		t.Errorf("rewritten KeyId(), Seq(), Time() = %d, %d, %v", rotated.KeyId(), rotated.Seq(), rotated.Time())
+	}
+	if got, err := rotated.DecodeValue(keys); err != nil || got != value {
+		t.Errorf("rewritten DecodeValue() = %q, %v", got, err)
+	}
+}
+
+func TestRecordV2Checksum(t *testing.T) {
+	for _, c := range []Checksum{CRC32, CRC32C} {
+		t.Run(c.String(), func(t *testing.T) {
+			r, err := NewRecordV2(1, "key", "value", WithChecksum(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := r.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseRecord(bytes.NewReader(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Checksum(parsed.Flags() & V2_CHECKSUM_MASK >> V2_CHECKSUM_SHIFT); got != c {
+				t.Errorf("parsed checksum = %v, want %v", got, c)
+			}
+			if parsed.Value() != "value" {
+				t.Errorf("Value() = %q", parsed.Value())
+			}
+			buf[len(buf)-1] ^= 0xFF
+			var corrupt *ErrCorruptRecord
+			if _, err := ParseRecord(bytes.NewReader(buf)); !errors.As(err, &corrupt) {
+				t.Errorf("ParseRecord() of flipped byte error = %v, want *ErrCorruptRecord", err)
+			}
+		})
+	}
+
+	r, err := NewRecordV2(1, "key", "value", WithChecksum(CRC32C))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := r.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// declaring the other checksum type invalidates the record
+	buf[VER_SIZE+V2_CRC_SIZE] &^= V2_CHECKSUM_MASK
+	if _, err := ParseRecord(bytes.NewReader(buf)); !errors.Is(err, &ErrCorruptRecord{}) {
+		t.Errorf("ParseRecord() with changed checksum type error = %v, want *ErrCorruptRecord", err)
+	}
+	buf[VER_SIZE+V2_CRC_SIZE] |= V2_CHECKSUM_MASK
+	if _, err := ParseRecord(bytes.NewReader(buf)); !errors.Is(err, &ErrCorruptRecord{}) {
+		t.Errorf("ParseRecord() with unknown checksum type error = %v, want *ErrCorruptRecord", err)
+	}
+	if _, err := NewRecordV2(1, "key", "value", WithChecksum(Checksum(3))); !errors.Is(err, ErrUnknownChecksum) {
+		t.Errorf("WithChecksum(3) error = %v, want %v", err, ErrUnknownChecksum)
+	}
+}
+
+func BenchmarkParseRecordV2(b *testing.B) {
+	value := strings.Repeat("v", 4096)
+	for _, c := range []Checksum{CRC32, CRC32C} {
+		b.Run(c.String(), func(b *testing.B) {
+			r, err := NewRecordV2(1, "key", value, WithChecksum(c))
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf, err := r.ToBytes()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseRecord(bytes.NewReader(buf)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// bufferWriterAt is an in-memory io.Writer and io.WriterAt.
+type bufferWriterAt struct {
+	buf []byte
+}
+
+func (b *bufferWriterAt) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *bufferWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b.buf[off:], p), nil
+}
+
+func TestRecordV2Bucket(t *testing.T) {
+	put, err := NewRecordV2(3, "key", "value", WithBucket(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	del, err := NewDeleteRecordV2(4, "key", WithBucket(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := NewRecordV2(3, "key", "value")
+	// the id 300 takes 2 bytes
+	if put.Len() != plain.Len()+2 {
+		t.Errorf("Len() with a bucket = %d, without %d", put.Len(), plain.Len())
+	}
+	pointer, err := NewBlobPointerV2(put, "blob-1.blob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := Rewrite(put, put.Seq(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Record{put, del, pointer, rewritten} {
+		buf, err := r.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseRecord(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bucket() != 300 || got.Flags()&V2_BUCKET == 0 || got.Key() != "key" {
+			t.Errorf("ParseRecord() Bucket(), Flags(), Key() = %d, %x, %q", got.Bucket(), got.Flags(), got.Key())
+		}
+	}
+	if plain.Bucket() != 0 || plain.Flags()&V2_BUCKET != 0 {
+		t.Errorf("default bucket Bucket(), Flags() = %d, %x", plain.Bucket(), plain.Flags())
+	}
+}
+
+func TestWriteV2(t *testing.T) {
+	value := strings.Repeat("streamed value ", 1000)
+	for _, c := range []Checksum{CRC32, CRC32C} {
+		t.Run(c.String(), func(t *testing.T) {
+			w := &bufferWriterAt{}
+			r, err := WriteV2(w, 9, "key", strings.NewReader(value), int64(len(value)), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Len() != int64(len(w.buf)) || r.ValueSize() != int64(len(value)) {
+				t.Errorf("Len(), ValueSize() = %d, %d, want %d, %d", r.Len(), r.ValueSize(), len(w.buf), len(value))
+			}
+			parsed, err := ParseRecord(bytes.NewReader(w.buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Seq() != 9 || parsed.Key() != "key" || parsed.Value() != value {
+				t.Errorf("parsed Seq(), Key() = %d, %q", parsed.Seq(), parsed.Key())
+			}
+			if parsed.ValueRelativePosition() != r.ValueRelativePosition() {
+				t.Errorf("ValueRelativePosition() = %d, want %d", r.ValueRelativePosition(), parsed.ValueRelativePosition())
+			}
+		})
+	}
+	if _, err := WriteV2(&bufferWriterAt{}, 1, "key", strings.NewReader("abc"), 4, CRC32); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("WriteV2() of short value error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestBlobPointer(t *testing.T) {
+	blob, err := NewRecordV2(5, "key", strings.Repeat("v", 300), WithCompression(compress.Snappy, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewBlobPointerV2(blob, "blob-1.blob", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Flags()&V2_BLOB == 0 || p.Seq() != blob.Seq() || !p.Time().Equal(blob.Time()) {
+		t.Fatalf("pointer Flags(), Seq(), Time() = %x, %d, %v", p.Flags(), p.Seq(), p.Time())
+	}
+	buf, err := p.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseRecord(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := DecodeBlobRef(parsed.Value())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BlobRef{
+		File:          "blob-1.blob",
+		ValuePosition: 1000 + blob.ValueRelativePosition(),
+		ValueSize:     blob.ValueSize(),
+		Flags:         blob.Flags(),
+	}
+	if ref != want {
+		t.Errorf("DecodeBlobRef() = %+v, want %+v", ref, want)
+	}
+	if _, err := DecodeBlobRef("\x00\xff"); !errors.Is(err, &ErrCorruptRecord{}) {
+		t.Errorf("DecodeBlobRef() of garbage error = %v, want *ErrCorruptRecord", err)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	var stream []byte
+	for _, kv := range [][2]string{{"a", "first"}, {"b", "second"}} {
+		r, err := NewRecordV2(1, kv[0], kv[1], WithChecksum(CRC32C))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := r.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, buf...)
+	}
+	reader := bytes.NewReader(stream)
+	h, err := ParseHeader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Record().Key() != "a" || h.Record().ValueSize() != 5 {
+		t.Errorf("header Key(), ValueSize() = %q, %d", h.Record().Key(), h.Record().ValueSize())
+	}
+	if err := h.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	h, err = ParseHeader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied bytes.Buffer
+	if err := h.CopyTo(&copied); err != nil {
+		t.Fatal(err)
+	}
+	if first := len(stream) - copied.Len(); !bytes.Equal(copied.Bytes(), stream[first:]) {
+		t.Errorf("CopyTo() = %x, want %x", copied.Bytes(), stream[first:])
+	}
+
+	stream[len(stream)-1] ^= 0xFF
+	h, err = ParseHeader(bytes.NewReader(stream[len(stream)-copied.Len():]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CopyTo(io.Discard); !errors.Is(err, &ErrCorruptRecord{}) {
+		t.Errorf("CopyTo() of corrupt record error = %v, want *ErrCorruptRecord", err)
+	}
+}
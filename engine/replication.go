@@ -0,0 +1,365 @@
+package engine
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+)
+
+const (
+	// REPLICATION_CHUNK_SIZE bounds the bytes shipped in one message.
+	REPLICATION_CHUNK_SIZE = 1024 * 1024 // 1MB
+	// REPLICATION_POLL_INTERVAL is how often a leader with nothing to ship
+	// looks for new writes.
+	REPLICATION_POLL_INTERVAL = 20 * time.Millisecond
+)
+
+// ErrReplicaDiverged is reported when a follower's files aren't a prefix of
+// the leader's, for instance because it was promoted and written to.
+var ErrReplicaDiverged = errors.New("replica diverged from leader")
+
+// The replication protocol ships the data and blob files as they are: the
+// follower says which files it has and how large, and the leader sends what
+// it is missing, then the bytes appended and the files removed since. The
+// files only ever grow until a merge removes them, so a file name and a
+// size are a position. Messages are gob encoded.
+
+// file kinds
+const (
+	replicaData byte = iota + 1
+	replicaBlob
+)
+
+type replicaFile struct {
+	Kind byte
+	// Name is the base name, the same on both sides.
+	Name string
+	Size int64
+}
+
+// replicaHello opens a connection, from the follower.
+type replicaHello struct {
+	Files []replicaFile
+}
+
+// replicaMessage is sent by the leader: either bytes to append at Offset
+// of the file, or its removal.
+type replicaMessage struct {
+	Kind   byte
+	Name   string
+	Offset int64
+	Data   []byte
+	Remove bool
+	// Err ends the connection with ErrReplicaDiverged.
+	Err string
+}
+
+// ReplicationPosition is how far a follower has replicated.
+type ReplicationPosition struct {
+	// Seq is the sequence number of the last write applied.
+	Seq uint64
+	// File and Offset are the data file last appended to and its size.
+	File   string
+	Offset int64
+}
+
+// FollowerStatus is a connected follower as the leader sees it.
+type FollowerStatus struct {
+	Addr     string
+	Position ReplicationPosition
+}
+
+// Leader ships the files of an engine to followers, see OpenFollower.
+type Leader struct {
+	c *bitcask
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	followers map[net.Conn]*FollowerStatus
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewLeader returns a Leader for e, which must be an engine opened by this
+// package.
+func NewLeader(e Engine) (*Leader, error) {
+	c, ok := e.(*bitcask)
+	if !ok {
+		return nil, fmt.Errorf("can't replicate %T", e)
+	}
+	return &Leader{
+		c:         c,
+		listeners: make(map[net.Listener]bool),
+		followers: make(map[net.Conn]*FollowerStatus),
+	}, nil
+}
+
+// Serve accepts followers on l until l fails or the leader is closed.
+func (l *Leader) Serve(ln net.Listener) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.listeners[ln] = true
+	l.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.listeners, ln)
+			if l.closed {
+				return nil
+			}
+			return err
+		}
+		if !l.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer l.untrack(conn)
+			_ = l.serve(conn)
+		}()
+	}
+}
+
+func (l *Leader) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.followers[conn] = &FollowerStatus{Addr: conn.RemoteAddr().String()}
+	return true
+}
+
+func (l *Leader) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.followers, conn)
+	_ = conn.Close()
+}
+
+// Followers returns the connected followers and the positions they last
+// reported.
+func (l *Leader) Followers() []FollowerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	followers := make([]FollowerStatus, 0, len(l.followers))
+	for _, f := range l.followers {
+		followers = append(followers, *f)
+	}
+	return followers
+}
+
+// Close stops the listeners and disconnects the followers. The engine
+// stays open.
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	var firstErr error
+	for ln := range l.listeners {
+		err := ln.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for conn := range l.followers {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return firstErr
+}
+
+// serve ships files to the follower on conn until either side goes away.
+func (l *Leader) serve(conn net.Conn) error {
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	var hello replicaHello
+	err := dec.Decode(&hello)
+	if err != nil {
+		return err
+	}
+	// the follower reports its position after each message it applied;
+	// gone is closed with the connection
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			var pos ReplicationPosition
+			if dec.Decode(&pos) != nil {
+				_ = conn.Close()
+				return
+			}
+			l.mu.Lock()
+			if f, ok := l.followers[conn]; ok {
+				f.Position = pos
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	s := newShipper(l.c, hello.Files)
+	for {
+		shipped, err := s.round(enc)
+		if err != nil {
+			if errors.Is(err, ErrReplicaDiverged) {
+				detail := strings.TrimPrefix(err.Error(), ErrReplicaDiverged.Error()+": ")
+				_ = enc.Encode(&replicaMessage{Err: detail})
+			}
+			return err
+		}
+		if shipped {
+			continue
+		}
+		select {
+		case <-gone:
+			return nil
+		case <-time.After(REPLICATION_POLL_INTERVAL):
+		}
+	}
+}
+
+// shipper tracks what a follower has of the leader's files.
+type shipper struct {
+	c *bitcask
+	// sent is the size of each file on the follower, by kind and name.
+	sent map[replicaFile]int64
+	// done are the files that are sealed and shipped in full.
+	done map[replicaFile]bool
+}
+
+func newShipper(c *bitcask, files []replicaFile) *shipper {
+	s := &shipper{c: c, sent: make(map[replicaFile]int64), done: make(map[replicaFile]bool)}
+	for _, f := range files {
+		s.sent[replicaFile{Kind: f.Kind, Name: f.Name}] = f.Size
+	}
+	return s
+}
+
+// round ships what was written and removed since the last round, and
+// reports whether there was anything.
+func (s *shipper) round(enc *gob.Encoder) (bool, error) {
+	// the data files first: a pointer record listed in them has its blob
+	// in the blob files listed after, and the blobs are shipped first
+	data := s.list(replicaData, s.c.dbFile)
+	blobs := s.list(replicaBlob, s.c.blobs)
+	shipped := false
+	for _, files := range []struct {
+		db    dbfile.DBFile
+		files []replicaFile
+	}{{s.c.blobs, blobs}, {s.c.dbFile, data}} {
+		for _, f := range files.files {
+			n, err := s.ship(enc, files.db, f)
+			if err != nil {
+				return false, err
+			}
+			shipped = shipped || n
+		}
+	}
+
+	listed := make(map[replicaFile]bool)
+	newest := make(map[byte]int64)
+	for _, f := range append(data, blobs...) {
+		listed[replicaFile{Kind: f.Kind, Name: f.Name}] = true
+		if id, _ := dbfile.FileId(f.Name); id > newest[f.Kind] {
+			newest[f.Kind] = id
+		}
+	}
+	for f := range s.sent {
+		if listed[f] {
+			continue
+		}
+		// merges only remove older files than the ones they write
+		if id, _ := dbfile.FileId(f.Name); id > newest[f.Kind] {
+			return false, fmt.Errorf("%w: %s is newer than the leader's files", ErrReplicaDiverged, f.Name)
+		}
+		err := enc.Encode(&replicaMessage{Kind: f.Kind, Name: f.Name, Remove: true})
+		if err != nil {
+			return false, err
+		}
+		delete(s.sent, f)
+		delete(s.done, f)
+		shipped = true
+	}
+	return shipped, nil
+}
+
+// list returns the files of db with their sizes. A file that is gone by
+// the time its size is read is left out, which removes it.
+func (s *shipper) list(kind byte, db dbfile.DBFile) []replicaFile {
+	// read before the sizes: a file other than current is sealed and has
+	// its final size
+	current := db.CurrentFile()
+	var files []replicaFile
+	for _, fileName := range db.FileList() {
+		f := replicaFile{Kind: kind, Name: filepath.Base(fileName)}
+		if s.done[f] {
+			files = append(files, f)
+			continue
+		}
+		size, err := db.Size(fileName)
+		if err != nil {
+			continue
+		}
+		if fileName != current && s.sent[f] == size {
+			s.done[f] = true
+		}
+		f.Size = size
+		files = append(files, f)
+	}
+	return files
+}
+
+// ship sends the bytes of f the follower doesn't have yet.
+func (s *shipper) ship(enc *gob.Encoder, db dbfile.DBFile, f replicaFile) (bool, error) {
+	key := replicaFile{Kind: f.Kind, Name: f.Name}
+	if s.done[key] {
+		return false, nil
+	}
+	offset := s.sent[key]
+	if offset > f.Size {
+		return false, fmt.Errorf("%w: %s has %d bytes, the leader %d", ErrReplicaDiverged, f.Name, offset, f.Size)
+	}
+	fileName := filepath.Join(s.c.blobDir, f.Name)
+	shipped := false
+	for offset < f.Size {
+		n := f.Size - offset
+		if n > REPLICATION_CHUNK_SIZE {
+			n = REPLICATION_CHUNK_SIZE
+		}
+		buf := make([]byte, n)
+		_, err := db.Read(fileName, offset, buf)
+		if errors.Is(err, dbfile.ErrFileNotFound) {
+			// merged away meanwhile; its live records were copied
+			return shipped, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		err = enc.Encode(&replicaMessage{Kind: f.Kind, Name: f.Name, Offset: offset, Data: buf})
+		if err != nil {
+			return false, err
+		}
+		offset += n
+		s.sent[key] = offset
+		shipped = true
+	}
+	return shipped, nil
+}
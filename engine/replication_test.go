@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startLeader(t *testing.T, e Engine, addr string) (*Leader, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLeader(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	t.Cleanup(func() { l.Close() })
+	return l, ln.Addr().String()
+}
+
+func openTestFollower(t *testing.T, dir, addr string, opts ...Option) *Follower {
+	t.Helper()
+	f, err := OpenFollower(dir, addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitReplicated(t *testing.T, f *Follower, seq uint64) {
+	t.Helper()
+	waitFor(t, "replication", func() bool { return f.Position().Seq >= seq })
+}
+
+func TestReplication(t *testing.T) {
+	leaderDir := t.TempDir()
+	e := openTestEngine(t, leaderDir, WithBlobThreshold(64))
+	blob := strings.Repeat("b", 100)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"blob", blob}} {
+		if err := e.Put(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, addr := startLeader(t, e, "127.0.0.1:0")
+
+	f := openTestFollower(t, t.TempDir(), addr)
+	waitReplicated(t, f, 3)
+	for key, want := range map[string]string{"a": "1", "b": "2", "blob": blob} {
+		if v, err := f.Get(key); err != nil || v != want {
+			t.Errorf("follower Get(%q) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+	if err := f.Put("x", "1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("follower Put() error = %v, want %v", err, ErrReadOnly)
+	}
+
+	// live writes, followed by a subscriber on the follower
+	s, err := f.Subscribe(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := e.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{{4, EVENT_DELETE, "a", ""}, {5, EVENT_PUT, "c", "3"}}
+	if got := nextEvents(t, s, 2); got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("follower events = %v, want %v", got, want)
+	}
+	if _, err := f.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("follower Get() of deleted key error = %v", err)
+	}
+	waitFor(t, "acknowledgement", func() bool {
+		followers := l.Followers()
+		return len(followers) == 1 && followers[0].Position == f.Position()
+	})
+}
+
+func TestReplicationMergeAndPromote(t *testing.T) {
+	leaderDir, followerDir := t.TempDir(), t.TempDir()
+	e := openTestEngine(t, leaderDir)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+		if err := e.Put(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, addr := startLeader(t, e, "127.0.0.1:0")
+	f := openTestFollower(t, followerDir, addr)
+	waitReplicated(t, f, 3)
+
+	// a restarted leader, which the follower reconnects to, with a sealed
+	// file to merge
+	l.Close()
+	e.Close()
+	e = openTestEngine(t, leaderDir)
+	l, _ = startLeader(t, e, addr)
+	if err := e.Put("c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, f, 4)
+	waitFor(t, "merge replication", func() bool {
+		return nonEmptyFiles(t, leaderDir) == nonEmptyFiles(t, followerDir)
+	})
+
+	l.Close()
+	e.Close()
+	if err := f.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put("d", "1"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "2", "b": "1", "c": "1", "d": "1"} {
+		if v, err := f.Get(key); err != nil || v != want {
+			t.Errorf("promoted Get(%q) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+	f.Close()
+
+	// the promoted follower has writes its old leader doesn't
+	e = openTestEngine(t, leaderDir)
+	_, addr = startLeader(t, e, "127.0.0.1:0")
+	again := openTestFollower(t, followerDir, addr)
+	waitFor(t, "divergence", func() bool { return errors.Is(again.Err(), ErrReplicaDiverged) })
+	if v, err := again.Get("d"); err != nil || v != "1" {
+		t.Errorf("diverged follower Get() = %q, %v", v, err)
+	}
+}
+
+// nonEmptyFiles returns the base names of the data files in dir that
+// aren't empty; an empty active file isn't replicated.
+func nonEmptyFiles(t *testing.T, dir string) string {
+	t.Helper()
+	var names []string
+	for _, fileName := range dataFiles(t, dir) {
+		stat, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() > 0 {
+			names = append(names, filepath.Base(fileName))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// copyPartial copies the first n bytes of fileName into dir.
+func copyPartial(t *testing.T, fileName, dir string, n int64) {
+	t.Helper()
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, filepath.Base(fileName)), data[:n], 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowerPartialRecord(t *testing.T) {
+	leaderDir := t.TempDir()
+	e := openTestEngine(t, leaderDir)
+	large := strings.Repeat("x", 3<<20)
+	for _, kv := range [][2]string{{"a", "1"}, {"large", large}, {"b", "2"}} {
+		if err := e.Put(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaderFile := e.(*bitcask).dbFile.CurrentFile()
+	e.Close()
+
+	// a follower stopped after the first chunk reopens and catches up
+	followerDir := t.TempDir()
+	copyPartial(t, leaderFile, followerDir, 1<<20)
+	e = openTestEngine(t, leaderDir)
+	_, addr := startLeader(t, e, "127.0.0.1:0")
+	f := openTestFollower(t, followerDir, addr)
+	waitReplicated(t, f, 3)
+	for key, want := range map[string]string{"a": "1", "large": large, "b": "2"} {
+		if v, err := f.Get(key); err != nil || v != want {
+			t.Errorf("follower Get(%q) = %d bytes, %v, want %d", key, len(v), err, len(want))
+		}
+	}
+
+	// one promoted without its leader keeps the complete records only
+	promotedDir := t.TempDir()
+	copyPartial(t, leaderFile, promotedDir, 1<<20)
+	p := openTestFollower(t, promotedDir, "127.0.0.1:1")
+	// and so does one that stops while a record arrives
+	data, err := os.ReadFile(leaderFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := p.Position().Offset
+	m := replicaMessage{Kind: replicaData, Name: filepath.Base(leaderFile), Offset: applied, Data: data[applied : applied+1<<20]}
+	if _, err := p.apply(&m); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	p2 := openTestEngine(t, promotedDir)
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if v, err := p2.Get(key); err != nil || v != want {
+			t.Errorf("promoted Get(%q) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+	if _, err := p2.Get("large"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("promoted Get() of the partial record error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,209 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/machinly/bitcask/engine"
+	"github.com/machinly/bitcask/engine/dbfile"
+)
+
+const (
+	// RESHARD_DIR is where Reshard writes the new shards.
+	RESHARD_DIR = "reshard.tmp"
+	// RESHARD_NEW_DIR holds the new shards once they are completely
+	// written, until they are moved into place.
+	RESHARD_NEW_DIR = "reshard.new"
+	// RESHARD_OLD_DIR holds the previous shards while the new ones are
+	// moved into place.
+	RESHARD_OLD_DIR = "reshard.old"
+)
+
+// Reshard rewrites the database in dir into n shards. It must not be open
+// meanwhile. Only the live keys are copied, so the new shards start out
+// merged.
+//
+// The new shards are written next to the old ones first, then swapped in.
+// The manifest records the swap before it starts, so if it is interrupted
+// the next Open or Reshard finishes it.
+func Reshard(dir string, n int, opts ...engine.Option) error {
+	if n <= 0 {
+		return fmt.Errorf("%w: %d", ErrShardCount, n)
+	}
+	err := finishReshard(dir)
+	if err != nil {
+		return err
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, RESHARD_DIR)
+	// left over from an interrupted copy
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	err = copyShards(dir, tmp, n, opts)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(dir, RESHARD_NEW_DIR))
+	if err != nil {
+		return err
+	}
+	err = writeManifest(dir, manifest{Shards: m.Shards, Next: n})
+	if err != nil {
+		return err
+	}
+	return finishReshard(dir)
+}
+
+// finishReshard completes a swap of shards the manifest records: it moves
+// the old shards out of the way and the new ones in, then commits the new
+// count. Every step can be repeated, so an interrupted swap is finished by
+// running it again. Directories a committed swap left are removed.
+func finishReshard(dir string) error {
+	m, err := readManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	old := filepath.Join(dir, RESHARD_OLD_DIR)
+	next := filepath.Join(dir, RESHARD_NEW_DIR)
+	if m.Next == 0 {
+		err = os.RemoveAll(old)
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(next)
+	}
+	if !exists(next) {
+		return fmt.Errorf("%w: %s is missing", ErrReshardIncomplete, RESHARD_NEW_DIR)
+	}
+	err = os.MkdirAll(old, 0755)
+	if err != nil {
+		return err
+	}
+	// the old shards all leave before the first new one arrives, so a
+	// shard already in old/ means the one in dir/ is new
+	for i := 0; i < m.Shards; i++ {
+		if exists(shardDir(dir, i)) && !exists(shardDir(old, i)) {
+			err = os.Rename(shardDir(dir, i), shardDir(old, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i := 0; i < m.Next; i++ {
+		if exists(shardDir(next, i)) {
+			err = os.Rename(shardDir(next, i), shardDir(dir, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = writeManifest(dir, manifest{Shards: m.Next})
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(old)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(next)
+}
+
+func exists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// copyShards copies the live keys of every bucket of the database in dir
+// to a new one with n shards in to.
+func copyShards(dir, to string, n int, opts []engine.Option) error {
+	src, err := Open(dir, 0, opts...)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := Open(to, n, opts...)
+	if err != nil {
+		return err
+	}
+	err = copyBuckets(src, dst)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if !dst.Sync() || !dst.Close() {
+		return fmt.Errorf("reshard: closing %s failed", to)
+	}
+	return nil
+}
+
+func copyBuckets(src, dst engine.Engine) error {
+	names, err := src.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		from, err := src.Bucket(name)
+		if err != nil {
+			return err
+		}
+		to, err := dst.Bucket(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range from.(*sharded).shards {
+			keys, err := e.ListKeys()
+			if err == nil {
+				err = copyKeys(e, to, keys)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyKeys copies the values of keys from src to dst. Values of at least
+// dbfile.STREAM_BUFFER_SIZE are streamed, so they don't have to fit in
+// memory; smaller ones are written with Put, which compresses them if dst
+// does.
+func copyKeys(src, dst engine.Engine, keys []string) error {
+	for _, key := range keys {
+		err := copyValue(src, dst, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyValue(src, dst engine.Engine, key string) error {
+	r, err := src.GetReader(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	sized, ok := r.(interface{ Size() int64 })
+	if !ok {
+		return fmt.Errorf("reshard: the value of %q has no size", key)
+	}
+	if sized.Size() >= dbfile.STREAM_BUFFER_SIZE {
+		return dst.PutReader(key, r, sized.Size())
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return dst.Put(key, string(value))
+}
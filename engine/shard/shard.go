@@ -0,0 +1,344 @@
+// Package shard spreads the keys of a database over several independent
+// engines, so writes to different shards don't wait for each other.
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+const (
+	// MANIFEST_FILE records the shard count in the database directory.
+	MANIFEST_FILE = "shards.json"
+	// SHARD_DIR_FORMAT names the subdirectory of each shard.
+	SHARD_DIR_FORMAT = "shard-%03d"
+)
+
+var (
+	ErrShardCount        = errors.New("wrong shard count")
+	ErrReshardIncomplete = errors.New("incomplete reshard")
+)
+
+type manifest struct {
+	Shards int
+	// Next is the shard count a Reshard is switching to, zero otherwise.
+	Next int `json:",omitempty"`
+}
+
+type sharded struct {
+	shards []engine.Engine
+}
+
+var _ engine.Engine = (*sharded)(nil)
+
+// Open opens the database in dir, split into n shards, and creates it if
+// dir doesn't hold one. n must be the database's shard count, or zero to
+// take it from the database; Reshard changes it. The options apply to each
+// shard: a value cache of size bytes, for instance, is one per shard.
+func Open(dir string, n int, opts ...engine.Option) (engine.Engine, error) {
+	err := finishReshard(dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: %d", ErrShardCount, n)
+		}
+		m = manifest{Shards: n}
+		err = writeManifest(dir, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n != 0 && n != m.Shards {
+		return nil, fmt.Errorf("%w: %d, the database has %d", ErrShardCount, n, m.Shards)
+	}
+
+	s := &sharded{}
+	for i := 0; i < m.Shards; i++ {
+		e, err := engine.OpenBitcaskEngine(shardDir(dir, i), opts...)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, e)
+	}
+	return s, nil
+}
+
+// Exists reports whether dir holds a sharded database.
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, MANIFEST_FILE))
+	return err == nil
+}
+
+func shardDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf(SHARD_DIR_FORMAT, i))
+}
+
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, MANIFEST_FILE))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	if err != nil || m.Shards <= 0 {
+		return m, fmt.Errorf("bad %s: %s", MANIFEST_FILE, data)
+	}
+	return m, nil
+}
+
+// writeManifest replaces the manifest atomically.
+func writeManifest(dir string, m manifest) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, MANIFEST_FILE+".tmp")
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, MANIFEST_FILE))
+}
+
+// shardOf returns the index of the shard holding key, by 64 bit FNV-1a.
+func shardOf(key string, n int) int {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return int(h % uint64(n))
+}
+
+func (s *sharded) shard(key string) engine.Engine {
+	return s.shards[shardOf(key, len(s.shards))]
+}
+
+func (s *sharded) Put(key, value string) error {
+	return s.shard(key).Put(key, value)
+}
+
+func (s *sharded) Get(key string) (string, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *sharded) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+func (s *sharded) PutReader(key string, value io.Reader, size int64) error {
+	return s.shard(key).PutReader(key, value, size)
+}
+
+func (s *sharded) GetReader(key string) (io.ReadCloser, error) {
+	return s.shard(key).GetReader(key)
+}
+
+func (s *sharded) Has(key string) (bool, error) {
+	return s.shard(key).Has(key)
+}
+
+// MultiGet asks each shard for its share of keys.
+func (s *sharded) MultiGet(keys []string) (map[string]string, error) {
+	byShard := make(map[int][]string)
+	for _, key := range keys {
+		i := shardOf(key, len(s.shards))
+		byShard[i] = append(byShard[i], key)
+	}
+	values := make(map[string]string, len(keys))
+	for i, keys := range byShard {
+		found, err := s.shards[i].MultiGet(keys)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range found {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func (s *sharded) CompareAndSwap(key, old, new string) (bool, error) {
+	return s.shard(key).CompareAndSwap(key, old, new)
+}
+
+func (s *sharded) PutIfAbsent(key, value string) (bool, error) {
+	return s.shard(key).PutIfAbsent(key, value)
+}
+
+func (s *sharded) DeleteIfEquals(key, value string) (bool, error) {
+	return s.shard(key).DeleteIfEquals(key, value)
+}
+
+func (s *sharded) Incr(key string, delta int64) (int64, error) {
+	return s.shard(key).Incr(key, delta)
+}
+
+func (s *sharded) Append(key, suffix string) error {
+	return s.shard(key).Append(key, suffix)
+}
+
+func (s *sharded) ListKeys() ([]string, error) {
+	var keys []string
+	for _, e := range s.shards {
+		shardKeys, err := e.ListKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+	return keys, nil
+}
+
+// Bucket returns the bucket called name of every shard, as one engine. A
+// bucket's keys are spread the same way as those of the default bucket.
+func (s *sharded) Bucket(name string) (engine.Engine, error) {
+	b := &sharded{}
+	for _, e := range s.shards {
+		shard, err := e.Bucket(name)
+		if err != nil {
+			return nil, err
+		}
+		b.shards = append(b.shards, shard)
+	}
+	return b, nil
+}
+
+// DropBucket drops the bucket from every shard. A bucket missing from some
+// shards, after a failed Bucket or DropBucket, is dropped from the others.
+func (s *sharded) DropBucket(name string) error {
+	found := false
+	for _, e := range s.shards {
+		err := e.DropBucket(name)
+		if errors.Is(err, engine.ErrBucketNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", engine.ErrBucketNotFound, name)
+	}
+	return nil
+}
+
+// ListBuckets returns the buckets of any shard.
+func (s *sharded) ListBuckets() ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range s.shards {
+		shardNames, err := e.ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range shardNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	// the default bucket first, as the shards list it
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+// Merge merges the shards concurrently and returns the first error.
+func (s *sharded) Merge() error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, e := range s.shards {
+		wg.Add(1)
+		go func(i int, e engine.Engine) {
+			defer wg.Done()
+			errs[i] = e.Merge()
+		}(i, e)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats adds up the stats of the shards. File names are prefixed with the
+// shard's directory, and the active file is that of the fullest shard.
+// The last merge is the most recent one of any shard.
+func (s *sharded) Stats() (engine.Stats, error) {
+	var total engine.Stats
+	for i, e := range s.shards {
+		stats, err := e.Stats()
+		if err != nil {
+			return engine.Stats{}, err
+		}
+		name := fmt.Sprintf(SHARD_DIR_FORMAT, i)
+		prefix := name + string(filepath.Separator)
+		total.Keys += stats.Keys
+		total.Tombstones += stats.Tombstones
+		for _, f := range stats.Files {
+			f.Name = prefix + f.Name
+			total.Files = append(total.Files, f)
+		}
+		for _, f := range stats.BlobFiles {
+			f.Name = prefix + f.Name
+			total.BlobFiles = append(total.BlobFiles, f)
+		}
+		if total.ActiveFile == "" || stats.ActiveFileSize > total.ActiveFileSize {
+			total.ActiveFile = prefix + stats.ActiveFile
+			total.ActiveFileSize = stats.ActiveFileSize
+		}
+		total.MaxFileSize = stats.MaxFileSize
+		total.KeydirBytes += stats.KeydirBytes
+		if stats.LastMerge.After(total.LastMerge) {
+			total.LastMerge = stats.LastMerge
+			total.LastMergeDuration = stats.LastMergeDuration
+		}
+		if total.LastMergeError == "" && stats.LastMergeError != "" {
+			total.LastMergeError = name + ": " + stats.LastMergeError
+		}
+		total.OpenFiles += stats.OpenFiles
+		total.CacheCapacity += stats.CacheCapacity
+		total.CacheBytes += stats.CacheBytes
+		total.CacheHits += stats.CacheHits
+		total.CacheMisses += stats.CacheMisses
+		total.BloomFilterBytes += stats.BloomFilterBytes
+		total.BloomNegatives += stats.BloomNegatives
+	}
+	return total, nil
+}
+
+func (s *sharded) Sync() bool {
+	ok := true
+	for _, e := range s.shards {
+		ok = e.Sync() && ok
+	}
+	return ok
+}
+
+func (s *sharded) Close() bool {
+	ok := true
+	for _, e := range s.shards {
+		ok = e.Close() && ok
+	}
+	return ok
+}
@@ -0,0 +1,305 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/machinly/bitcask/engine"
+	"github.com/machinly/bitcask/engine/compress"
+)
+
+func openTestShards(t *testing.T, dir string, n int) engine.Engine {
+	t.Helper()
+	e, err := Open(dir, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// writeKeys puts n keys, deletes every third and returns what is left.
+func writeKeys(t *testing.T, e engine.Engine, n int) map[string]string {
+	t.Helper()
+	want := make(map[string]string)
+	for i := 0; i < n; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprint(i)
+		if err := e.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	for i := 0; i < n; i += 3 {
+		key := fmt.Sprintf("key-%d", i)
+		if err := e.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	return want
+}
+
+func checkKeys(t *testing.T, e engine.Engine, want map[string]string) {
+	t.Helper()
+	keys, err := e.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Errorf("ListKeys() has %d keys, want %d", len(keys), len(want))
+	}
+	for key, value := range want {
+		if v, err := e.Get(key); err != nil || v != value {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, v, err, value)
+		}
+	}
+}
+
+func TestSharded(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestShards(t, dir, 4)
+	want := writeKeys(t, e, 200)
+	checkKeys(t, e, want)
+
+	for i := 0; i < 4; i++ {
+		e, err := engine.OpenBitcaskEngine(shardDir(dir, i), engine.WithReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, _ := e.ListKeys()
+		e.Close()
+		if len(keys) == 0 || len(keys) == len(want) {
+			t.Errorf("shard %d has %d of %d keys", i, len(keys), len(want))
+		}
+	}
+
+	values, err := e.MultiGet([]string{"key-1", "key-2", "key-3"})
+	if err != nil || len(values) != 2 || values["key-1"] != "1" || values["key-2"] != "2" {
+		t.Errorf("MultiGet() = %v, %v", values, err)
+	}
+	if n, err := e.Incr("counter", 2); err != nil || n != 2 {
+		t.Errorf("Incr() = %d, %v", n, err)
+	}
+	want["counter"] = "2"
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != len(want) || len(stats.Files) < 4 {
+		t.Errorf("Stats() keys = %d, files %v", stats.Keys, stats.Files)
+	}
+	e.Close()
+
+	if _, err := Open(dir, 3); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Open() with 3 shards error = %v, want %v", err, ErrShardCount)
+	}
+	if _, err := Open(t.TempDir(), 0); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Open() of a new database without a count error = %v, want %v", err, ErrShardCount)
+	}
+	checkKeys(t, openTestShards(t, dir, 0), want)
+}
+
+func TestReshard(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestShards(t, dir, 4)
+	want := writeKeys(t, e, 200)
+	e.Close()
+
+	if err := Reshard(dir, 3); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestShards(t, dir, 3)
+	checkKeys(t, e, want)
+	e.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[shard-000 shard-001 shard-002 shards.json]" {
+		t.Errorf("directory after Reshard = %v", names)
+	}
+
+	// a swap interrupted after one old shard left and one new shard arrived
+	if err := copyShards(dir, filepath.Join(dir, RESHARD_NEW_DIR), 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(dir, manifest{Shards: 3, Next: 2}); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(dir, RESHARD_OLD_DIR)
+	if err := os.Mkdir(old, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(shardDir(dir, 0), shardDir(old, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(shardDir(filepath.Join(dir, RESHARD_NEW_DIR), 0), shardDir(dir, 0)); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestShards(t, dir, 2)
+	checkKeys(t, e, want)
+	e.Close()
+	for _, name := range []string{RESHARD_OLD_DIR, RESHARD_NEW_DIR, "shard-002"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s after finishing the swap: %v", name, err)
+		}
+	}
+
+	// the new shards went missing before the swap finished
+	if err := writeManifest(dir, manifest{Shards: 2, Next: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 0); !errors.Is(err, ErrReshardIncomplete) {
+		t.Errorf("Open() without the new shards error = %v, want %v", err, ErrReshardIncomplete)
+	}
+}
+
+func TestReshardLargeValue(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestShards(t, dir, 2)
+	want := writeKeys(t, e, 10)
+	want["large"] = strings.Repeat("v", 1<<20)
+	if err := e.Put("large", want["large"]); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	if err := Reshard(dir, 3); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestShards(t, dir, 3)
+	defer e.Close()
+	checkKeys(t, e, want)
+}
+
+// dataSize returns the total size of the data files under dir.
+func dataSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".db" {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+func TestReshardCompressed(t *testing.T) {
+	dir := t.TempDir()
+	opt := engine.WithCompression(compress.Snappy, 0)
+	e, err := Open(dir, 2, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key-", i)
+		want[key] = strings.Repeat(key, 100)
+		if err := e.Put(key, want[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	before := dataSize(t, dir)
+
+	if err := Reshard(dir, 3, opt); err != nil {
+		t.Fatal(err)
+	}
+	if after := dataSize(t, dir); after > before {
+		t.Errorf("data files after Reshard = %d bytes, before %d", after, before)
+	}
+	e, err = Open(dir, 0, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	checkKeys(t, e, want)
+}
+
+func TestShardedSubscribe(t *testing.T) {
+	e := openTestShards(t, t.TempDir(), 3)
+	s, err := e.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := e.Put(fmt.Sprint(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]bool)
+	for len(seen) < 30 {
+		select {
+		case ev := <-s.Events():
+			seen[ev.Key] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events", len(seen))
+		}
+	}
+	s.Close()
+	for range s.Events() {
+	}
+	if s.Err() != nil {
+		t.Errorf("Err() after Close = %v", s.Err())
+	}
+}
+
+func TestShardedBuckets(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestShards(t, dir, 3)
+	users, err := e.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := writeKeys(t, users, 30)
+	if err := e.Put("key-1", "default"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, users, want)
+	e.Close()
+
+	if err := Reshard(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	e = openTestShards(t, dir, 2)
+	if names, err := e.ListBuckets(); err != nil || fmt.Sprint(names) != "[default users]" {
+		t.Errorf("ListBuckets() after Reshard = %v, %v", names, err)
+	}
+	users, err = e.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, users, want)
+	checkKeys(t, e, map[string]string{"key-1": "default"})
+
+	if err := e.DropBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("key-1"); !errors.Is(err, engine.ErrBucketNotFound) {
+		t.Errorf("Get() from a dropped bucket error = %v, want %v", err, engine.ErrBucketNotFound)
+	}
+	if err := e.DropBucket("users"); !errors.Is(err, engine.ErrBucketNotFound) {
+		t.Errorf("DropBucket() again error = %v, want %v", err, engine.ErrBucketNotFound)
+	}
+}
@@ -0,0 +1,91 @@
+package shard
+
+import (
+	"sync"
+
+	"github.com/machinly/bitcask/engine"
+)
+
+// Subscribe subscribes to every shard from fromSeq. Sequence numbers are
+// per shard: events of different shards are interleaved, and fromSeq
+// applies to each shard, so resuming where an earlier subscription stopped
+// is only exact with a single shard.
+func (s *sharded) Subscribe(fromSeq uint64) (engine.Subscription, error) {
+	sub := &subscription{
+		events: make(chan engine.Event),
+		done:   make(chan struct{}),
+	}
+	for _, e := range s.shards {
+		shardSub, err := e.Subscribe(fromSeq)
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		sub.subs = append(sub.subs, shardSub)
+	}
+	sub.wg.Add(len(sub.subs))
+	for _, shardSub := range sub.subs {
+		go sub.forward(shardSub)
+	}
+	go func() {
+		sub.wg.Wait()
+		close(sub.events)
+	}()
+	return sub, nil
+}
+
+type subscription struct {
+	subs   []engine.Subscription
+	events chan engine.Event
+	wg     sync.WaitGroup
+	done   chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// forward passes on the events of one shard. When one shard's subscription
+// ends with an error, they all end.
+func (s *subscription) forward(sub engine.Subscription) {
+	defer s.wg.Done()
+	for ev := range sub.Events() {
+		select {
+		case s.events <- ev:
+		case <-s.done:
+			return
+		}
+	}
+	if err := sub.Err(); err != nil {
+		s.mu.Lock()
+		if s.err == nil && !s.closed {
+			s.err = err
+		}
+		s.mu.Unlock()
+		s.Close()
+	}
+}
+
+func (s *subscription) Events() <-chan engine.Event {
+	return s.events
+}
+
+func (s *subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *subscription) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+	for _, sub := range s.subs {
+		sub.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/index"
+)
+
+// KEYDIR_ENTRY_OVERHEAD approximates the memory an entry of the default
+// keydir takes besides its key bytes.
+const KEYDIR_ENTRY_OVERHEAD = index.MAP_ENTRY_OVERHEAD
+
+type FileStats struct {
+	Name       string
+	TotalBytes int64
+	LiveBytes  int64
+	DeadBytes  int64
+	Tombstones int64
+}
+
+type Stats struct {
+	Keys           int
+	Tombstones     int64
+	Files          []FileStats
+	BlobFiles      []FileStats
+	ActiveFile     string
+	ActiveFileSize int64
+	MaxFileSize    int64
+	// KeydirBytes is an estimate of the memory held by the keydir.
+	KeydirBytes       int64
+	LastMerge         time.Time
+	LastMergeDuration time.Duration
+	// LastMergeError is the error of the last automatic merge, if any.
+	LastMergeError string
+	OpenFiles      int
+	// CacheCapacity is zero when the value cache is off.
+	CacheCapacity int64
+	CacheBytes    int64
+	CacheHits     int64
+	CacheMisses   int64
+	// BloomFilterBytes is zero when the Bloom filter is off.
+	BloomFilterBytes int64
+	// BloomNegatives counts the lookups the Bloom filter answered.
+	BloomNegatives int64
+}
+
+// Stats reports the state of the keydir and data files. File names are
+// relative to the data directory and listed oldest first. The files are
+// shared by the buckets, Keys and KeydirBytes describe the bucket's own
+// keydir.
+func (b *bucket) Stats() (Stats, error) {
+	c := b.c
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := b.checkOpen(); err != nil {
+		return Stats{}, err
+	}
+	kd := c.keydir(b.id)
+	current := c.dbFile.CurrentFile()
+	stats := Stats{
+		Keys:              kd.Len(),
+		MaxFileSize:       dbfile.MAX_FILE_SIZE,
+		KeydirBytes:       kd.MemSize(),
+		LastMerge:         c.lastMerge,
+		LastMergeDuration: c.lastMergeDuration,
+		OpenFiles:         c.dbFile.OpenFiles() + c.blobs.OpenFiles(),
+	}
+	stats.CacheCapacity, stats.CacheBytes, stats.CacheHits, stats.CacheMisses = c.cache.stats()
+	if c.filter != nil {
+		stats.BloomFilterBytes = c.filter.Size()
+	}
+	stats.BloomNegatives = atomic.LoadInt64(&c.filterNegatives)
+	if current != "" {
+		stats.ActiveFile = filepath.Base(current)
+	}
+	if c.mergeErr != nil {
+		stats.LastMergeError = c.mergeErr.Error()
+	}
+	stats.Files = c.listFileStats(c.dbFile)
+	for _, fs := range stats.Files {
+		stats.Tombstones += fs.Tombstones
+		if fs.Name == stats.ActiveFile {
+			stats.ActiveFileSize = fs.TotalBytes
+		}
+	}
+	stats.BlobFiles = c.listFileStats(c.blobs)
+	return stats, nil
+}
+
+// listFileStats returns the stats of the files of db. The caller holds mu.
+func (c *bitcask) listFileStats(db dbfile.DBFile) []FileStats {
+	var list []FileStats
+	for _, fileName := range db.FileList() {
+		fs, ok := c.files[fileName]
+		if !ok {
+			fs = &fileStats{}
+		}
+		list = append(list, FileStats{
+			Name:       filepath.Base(fileName),
+			TotalBytes: fs.totalBytes,
+			LiveBytes:  fs.totalBytes - fs.deadBytes,
+			DeadBytes:  fs.deadBytes,
+			Tombstones: fs.tombstones,
+		})
+	}
+	return list
+}
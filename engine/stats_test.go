@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/index"
+)
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbage(t, dir)
+	e := openTestEngine(t, dir)
+
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 5 || stats.Tombstones != 5 {
+		t.Errorf("keys, tombstones = %d, %d, want 5, 5", stats.Keys, stats.Tombstones)
+	}
+	if len(stats.Files) != 2 || stats.Files[1].Name != stats.ActiveFile {
+		t.Fatalf("files = %+v, want the sealed file and the active file %s", stats.Files, stats.ActiveFile)
+	}
+	sealed := stats.Files[0]
+	live := int64(0)
+	e.(*bitcask).index.Range(func(key string, set *index.Set) bool {
+		live += recordSize(0, key, *set)
+		return true
+	})
+	if sealed.LiveBytes != live || sealed.LiveBytes+sealed.DeadBytes != sealed.TotalBytes {
+		t.Errorf("sealed file = %+v, want %d live bytes", sealed, live)
+	}
+	if stats.ActiveFileSize != 0 || stats.MaxFileSize != dbfile.MAX_FILE_SIZE {
+		t.Errorf("active file size = %d/%d", stats.ActiveFileSize, stats.MaxFileSize)
+	}
+	if stats.OpenFiles != 3 {
+		t.Errorf("open files = %d, want 3", stats.OpenFiles)
+	}
+	if stats.KeydirBytes != 5*(int64(len("key-0"))+KEYDIR_ENTRY_OVERHEAD) {
+		t.Errorf("keydir bytes = %d", stats.KeydirBytes)
+	}
+	if !stats.LastMerge.IsZero() {
+		t.Errorf("last merge = %v, want never", stats.LastMerge)
+	}
+
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LastMerge.IsZero() || stats.Tombstones != 0 || len(stats.Files) != 1 {
+		t.Errorf("stats after merge = %+v", stats)
+	}
+	if stats.ActiveFileSize != live || stats.Files[0].DeadBytes != 0 {
+		t.Errorf("active file after merge = %+v, want %d live bytes", stats.Files[0], live)
+	}
+}
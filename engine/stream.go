@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+// PutReader stores the size bytes read from value under key without holding
+// the value in memory. Writes are serialised, so value should be quick to
+// read: a local file rather than a network connection. Streamed values are
+// stored uncompressed. With encryption enabled the value is read into memory
+// first, because it is sealed in one piece, so it can't be larger than
+// MAX_ENCRYPTED_STREAM_SIZE.
+func (b *bucket) PutReader(key string, value io.Reader, size int64) error {
+	c := b.c
+	err := c.checkSize(key, size)
+	if err != nil {
+		return err
+	}
+	if c.keys != nil {
+		if size > MAX_ENCRYPTED_STREAM_SIZE {
+			return fmt.Errorf("%w: %d bytes, limit %d for an encrypted stream", ErrValueTooLarge, size, MAX_ENCRYPTED_STREAM_SIZE)
+		}
+		buf := make([]byte, size)
+		_, err := io.ReadFull(value, buf)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, string(buf))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	blob := c.blobThreshold > 0 && size >= c.blobThreshold
+	db := c.dbFile
+	if blob {
+		db = c.blobs
+	}
+	var r record.Record
+	fileName, pos, err := db.WriteStream(func(w dbfile.StreamWriter) error {
+		var err error
+		r, err = record.WriteV2(w, c.seq+1, key, value, size, c.checksum, record.WithBucket(b.id))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if blob {
+		c.fileStats(fileName).totalBytes += r.Len()
+		err = c.putPointer(r, fileName, pos)
+	} else {
+		err = c.addRecord(fileName, pos, r)
+	}
+	if err != nil || len(c.subscribers) == 0 {
+		return err
+	}
+	set, err := c.keydir(b.id).Get(key)
+	if err != nil {
+		return err
+	}
+	// the value isn't in memory, subscribers read it back
+	stored := c.valueOf(*set)
+	c.publish(change{Event: Event{Seq: r.Seq(), Type: EVENT_PUT, Key: key}, bucket: b.id, stored: &stored})
+	return nil
+}
+
+// GetReader returns a reader over the value of key that reads it from the
+// data file as it is consumed. Compressed and encrypted values are decoded
+// in memory. The value stays readable while it is overwritten or deleted,
+// but not once a merge has removed its data file. The reader's Size method
+// returns the length of the value.
+func (b *bucket) GetReader(key string) (io.ReadCloser, error) {
+	c := b.c
+	c.mu.RLock()
+	if err := b.checkOpen(); err != nil {
+		c.mu.RUnlock()
+		return nil, err
+	}
+	vSet, err := c.find(b.id, key)
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	v := c.valueOf(*vSet)
+	if v.flags&(record.V2_COMPRESSION_MASK|record.V2_ENCRYPTED) != 0 {
+		value, err := b.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return stringReader{strings.NewReader(value)}, nil
+	}
+	return &valueReader{
+		dbFile:    v.db,
+		fileName:  v.fileId,
+		offset:    v.pos,
+		remaining: v.size,
+		size:      v.size,
+	}, nil
+}
+
+// stringReader is a GetReader result decoded in memory.
+type stringReader struct {
+	*strings.Reader
+}
+
+func (stringReader) Close() error {
+	return nil
+}
+
+// valueReader reads a stored value straight from its data file.
+type valueReader struct {
+	dbFile    dbfile.DBFile
+	fileName  string
+	offset    int64
+	remaining int64
+	size      int64
+	closed    bool
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrClosed
+	}
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.dbFile.Read(r.fileName, r.offset, p)
+	if err == io.EOF {
+		return 0, &ErrCorruptRecord{
+			File:   r.fileName,
+			Offset: r.offset,
+			Reason: "value extends past end of file",
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// Size returns the length of the whole value.
+func (r *valueReader) Size() int64 {
+	return r.size
+}
+
+func (r *valueReader) Close() error {
+	r.closed = true
+	return nil
+}
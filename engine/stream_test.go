@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPutReader(t *testing.T) {
+	dir := t.TempDir()
+	value := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	e := openTestEngine(t, dir)
+	if err := e.Put("before", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PutReader("large", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put("after", "2"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(e Engine) {
+		t.Helper()
+		r, err := e.GetReader("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("GetReader() read %d bytes, %v", len(got), err)
+		}
+		if v, err := e.Get("after"); err != nil || v != "2" {
+			t.Errorf("Get(after) = %q, %v", v, err)
+		}
+	}
+	check(e)
+	e.Close()
+
+	// reopening verifies the checksum computed while streaming
+	check(openTestEngine(t, dir))
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// allocated returns the bytes f allocates.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestLargeValueMemory(t *testing.T) {
+	const size = 32 << 20
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.PutReader("large", io.LimitReader(zeros{}, size), size); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	// replaying and merging the file leave the value on disk
+	if n := allocated(func() { e = openTestEngine(t, dir) }); n > size/4 {
+		t.Errorf("reopening allocated %d bytes for a %d byte value", n, size)
+	}
+	var err error
+	if n := allocated(func() { err = e.Merge() }); n > size/4 {
+		t.Errorf("merging allocated %d bytes for a %d byte value", n, size)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	r, err := e.GetReader("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n, err := io.Copy(io.Discard, r); err != nil || n != size {
+		t.Errorf("GetReader() after merge read %d bytes, %v, want %d", n, err, size)
+	}
+}
+
+func TestPutReaderShortValue(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	err := e.PutReader("short", strings.NewReader("abc"), 10)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("PutReader() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if err := e.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	// the partial record was cut off
+	e = openTestEngine(t, dir)
+	if _, err := e.Get("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(short) error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if v, err := e.Get("a"); err != nil || v != "1" {
+		t.Errorf("Get(a) = %q, %v", v, err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithMaxKeySize(4), WithMaxValueSize(8))
+	if err := e.Put("long-key", "v"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Put() of long key error = %v, want %v", err, ErrKeyTooLarge)
+	}
+	if err := e.Put("k", "too large value"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Put() of large value error = %v, want %v", err, ErrValueTooLarge)
+	}
+	if err := e.PutReader("k", strings.NewReader("too large value"), 15); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutReader() of large value error = %v, want %v", err, ErrValueTooLarge)
+	}
+	if err := e.Put("k", "12345678"); err != nil {
+		t.Errorf("Put() at the limits error = %v", err)
+	}
+}
+
+func TestPutReaderSizes(t *testing.T) {
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{1: make([]byte, 32)}}
+	for name, opts := range map[string][]Option{
+		"plain":     nil,
+		"encrypted": {WithEncryption(keys)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := openTestEngine(t, t.TempDir(), opts...)
+			if err := e.PutReader("k", strings.NewReader("v"), -1); !errors.Is(err, ErrValueTooLarge) {
+				t.Errorf("PutReader() of a negative size error = %v, want %v", err, ErrValueTooLarge)
+			}
+		})
+	}
+
+	// encrypted values are read into memory, so a huge size is refused
+	// before anything is allocated
+	e := openTestEngine(t, t.TempDir(), WithEncryption(keys))
+	err := e.PutReader("k", strings.NewReader("v"), MAX_ENCRYPTED_STREAM_SIZE+1)
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutReader() of an encrypted value over the limit error = %v, want %v", err, ErrValueTooLarge)
+	}
+}
@@ -0,0 +1,389 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/machinly/bitcask/engine/dbfile"
+	"github.com/machinly/bitcask/engine/record"
+)
+
+// DEFAULT_SUBSCRIBER_BUFFER is how many new writes a subscriber may fall
+// behind by before it is dropped, see WithSubscriberBuffer.
+const DEFAULT_SUBSCRIBER_BUFFER = 1024
+
+// ErrSubscriberLagged ends a subscription that fell too far behind the
+// writes, or whose history was merged away before it was read. Subscribe
+// again from the sequence number after the last event received.
+var ErrSubscriberLagged = errors.New("subscriber fell behind")
+
+type EventType byte
+
+const (
+	EVENT_PUT EventType = iota + 1
+	EVENT_DELETE
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EVENT_PUT:
+		return "put"
+	case EVENT_DELETE:
+		return "delete"
+	default:
+		return fmt.Sprintf("EventType(%d)", byte(t))
+	}
+}
+
+// Event is a committed Put or Delete. Every write that changes a key, from
+// Put to Incr and DeleteIfEquals, is one event; records a merge moves are
+// not. Records written by versions without sequence numbers have Seq 0.
+type Event struct {
+	Seq  uint64
+	Type EventType
+	Key  string
+	// Value is empty for deletes.
+	Value string
+}
+
+// Subscription delivers the events of Engine.Subscribe in sequence order.
+type Subscription interface {
+	// Events is closed when the subscription ends, Err then tells why.
+	Events() <-chan Event
+	// Err is nil until Events is closed, and if it was closed by Close.
+	Err() error
+	// Close ends the subscription. Events may still deliver a few events
+	// that were already under way.
+	Close()
+}
+
+// Subscribe streams the committed writes to the bucket with a sequence
+// number of at least fromSeq: first those still in the data files, then
+// new writes as they are made. The buckets share the sequence numbers, so a
+// bucket's events have gaps. History that a merge has dropped, overwritten values and
+// deleted keys, is skipped.
+//
+// Writers never wait for subscribers. A subscriber that falls more than the
+// subscriber buffer behind the writes is dropped with ErrSubscriberLagged,
+// and catches up by subscribing again.
+func (b *bucket) Subscribe(fromSeq uint64) (Subscription, error) {
+	c := b.c
+	// no merge may remove the files while they are scanned
+	c.mergeMu.Lock()
+	defer c.mergeMu.Unlock()
+
+	c.mu.Lock()
+	if err := b.checkOpen(); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	s := &subscription{
+		c:       c,
+		bucket:  b.id,
+		fromSeq: fromSeq,
+		events:  make(chan Event),
+		live:    make(chan change, c.subscriberBuffer),
+		done:    make(chan struct{}),
+	}
+	c.subscribers[s] = true
+	// the history ends where the live writes start
+	liveFrom := c.seq + 1
+	files, err := c.historyFiles(fromSeq)
+	c.mu.Unlock()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if fromSeq < liveFrom {
+		s.history, err = c.scanHistory(files, b.id, fromSeq, liveFrom)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// historyFile is a data file to scan for events, up to size, its size when
+// the subscription started.
+type historyFile struct {
+	name string
+	size int64
+}
+
+// historyFiles lists the data files that may hold records from fromSeq on.
+// The caller holds mu.
+func (c *bitcask) historyFiles(fromSeq uint64) ([]historyFile, error) {
+	var files []historyFile
+	for _, fileName := range c.dbFile.FileList() {
+		// zero is unknown as well as only records without a sequence number
+		if s, ok := c.files[fileName]; ok && s.maxSeq != 0 && s.maxSeq < fromSeq {
+			continue
+		}
+		size, err := c.dbFile.Size(fileName)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, historyFile{fileName, size})
+	}
+	return files, nil
+}
+
+// historyRef is where a record of the history is.
+type historyRef struct {
+	seq      uint64
+	fileName string
+	pos      int64
+	size     int64
+}
+
+var errScanDone = errors.New("scan done")
+
+// scanHistory finds the records of bucket in files with a sequence number
+// from fromSeq up to but excluding liveFrom, in sequence order. Merges copy
+// records into newer files, so file order isn't sequence order. The caller
+// holds mergeMu.
+func (c *bitcask) scanHistory(files []historyFile, bucket uint32, fromSeq, liveFrom uint64) ([]historyRef, error) {
+	var refs []historyRef
+	for _, f := range files {
+		err := c.dbFile.ReadAll(f.name, func(pos int64, reader io.Reader) error {
+			// records after size may not be written completely yet
+			if pos >= f.size {
+				return errScanDone
+			}
+			h, err := record.ParseHeader(reader)
+			if err == nil {
+				err = h.Discard()
+			}
+			if err != nil {
+				return record.WithLocation(err, f.name, pos)
+			}
+			r := h.Record()
+			if r.Bucket() == bucket && r.Seq() >= fromSeq && r.Seq() < liveFrom {
+				refs = append(refs, historyRef{r.Seq(), f.name, pos, r.Len()})
+			}
+			return nil
+		})
+		if err != nil && err != errScanDone {
+			return nil, err
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].seq < refs[j].seq
+	})
+	// a merge interrupted by a crash can leave a record and its copy
+	unique := refs[:0]
+	for i, ref := range refs {
+		if i > 0 && ref.seq != 0 && ref.seq == refs[i-1].seq {
+			continue
+		}
+		unique = append(unique, ref)
+	}
+	return unique, nil
+}
+
+// readHistory reads the event of a record of the history.
+func (c *bitcask) readHistory(ref historyRef) (Event, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return Event{}, ErrClosed
+	}
+	buf := make([]byte, ref.size)
+	_, err := c.dbFile.Read(ref.fileName, ref.pos, buf)
+	if err != nil {
+		return Event{}, lagged(err)
+	}
+	r, err := record.ParseRecord(bytes.NewReader(buf))
+	if err != nil {
+		return Event{}, record.WithLocation(err, ref.fileName, ref.pos)
+	}
+	ev := Event{Seq: ref.seq, Type: EVENT_DELETE, Key: r.Key()}
+	if record.IsTombstone(r) {
+		return ev, nil
+	}
+	ev.Type = EVENT_PUT
+	if r.Flags()&record.V2_BLOB == 0 {
+		ev.Value, err = r.DecodeValue(c.keyring())
+		if err != nil {
+			return Event{}, record.WithLocation(err, ref.fileName, ref.pos)
+		}
+		return ev, nil
+	}
+	set, err := c.newSet(ref.fileName, ref.pos, r)
+	if err != nil {
+		return Event{}, err
+	}
+	ev.Value, err = c.loadValue(r.Key(), c.valueOf(set))
+	return ev, lagged(err)
+}
+
+// lagged reports a file removed by a merge as ErrSubscriberLagged.
+func lagged(err error) error {
+	if errors.Is(err, dbfile.ErrFileNotFound) {
+		return fmt.Errorf("%w: %v", ErrSubscriberLagged, err)
+	}
+	return err
+}
+
+// change is a write as it is published to the subscribers.
+type change struct {
+	Event
+	bucket uint32
+	// stored is where the value of a streamed Put is, which is read when
+	// the event is delivered.
+	stored *storedValue
+}
+
+// publish hands a write to the subscribers of its bucket, dropping those
+// whose buffer is full. The caller holds mu.
+func (c *bitcask) publish(ch change) {
+	for s := range c.subscribers {
+		if s.bucket != ch.bucket {
+			continue
+		}
+		select {
+		case s.live <- ch:
+		default:
+			c.unsubscribe(s, ErrSubscriberLagged)
+		}
+	}
+}
+
+// unsubscribe stops publishing to s; it ends with err once it has
+// delivered what is buffered. The caller holds mu.
+func (c *bitcask) unsubscribe(s *subscription, err error) {
+	if !c.subscribers[s] {
+		return
+	}
+	delete(c.subscribers, s)
+	s.liveErr = err
+	close(s.live)
+}
+
+type subscription struct {
+	c       *bitcask
+	bucket  uint32
+	fromSeq uint64
+	history []historyRef
+	events  chan Event
+	// live is filled by the writers and closed by unsubscribe, after
+	// setting liveErr.
+	live      chan change
+	liveErr   error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *subscription) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.c.mu.Lock()
+		s.c.unsubscribe(s, nil)
+		s.c.mu.Unlock()
+	})
+}
+
+func (s *subscription) run() {
+	err := s.replay()
+	if err == nil {
+		err = s.tail()
+	}
+	if err != nil {
+		// ending on our own, not through Close
+		s.c.mu.Lock()
+		s.c.unsubscribe(s, err)
+		s.c.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	close(s.events)
+}
+
+// replay delivers the history. It returns nil once it is delivered or the
+// subscription is closed.
+func (s *subscription) replay() error {
+	for len(s.history) > 0 {
+		ev, err := s.c.readHistory(s.history[0])
+		if err != nil {
+			return err
+		}
+		if !s.send(ev) {
+			return nil
+		}
+		s.history = s.history[1:]
+	}
+	return nil
+}
+
+// tail delivers the live writes until the subscription ends.
+func (s *subscription) tail() error {
+	for {
+		select {
+		case ch, ok := <-s.live:
+			if !ok {
+				return s.liveErr
+			}
+			if ch.Seq < s.fromSeq {
+				continue
+			}
+			ev, err := s.c.resolve(ch)
+			if err != nil {
+				return err
+			}
+			if !s.send(ev) {
+				return nil
+			}
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// send delivers ev, and reports false if the subscription is closed first.
+func (s *subscription) send(ev Event) bool {
+	select {
+	case s.events <- ev:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// resolve reads the value of a streamed Put.
+func (c *bitcask) resolve(ch change) (Event, error) {
+	if ch.stored == nil {
+		return ch.Event, nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return Event{}, ErrClosed
+	}
+	value, err := c.loadValue(ch.Key, *ch.stored)
+	if err != nil {
+		return Event{}, lagged(err)
+	}
+	ch.Value = value
+	return ch.Event, nil
+}
@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvents receives n events from s, failing the test if they don't come.
+func nextEvents(t *testing.T, s Subscription, n int) []Event {
+	t.Helper()
+	var events []Event
+	for len(events) < n {
+		select {
+		case ev, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("subscription ended after %d events: %v", len(events), s.Err())
+			}
+			events = append(events, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events", len(events))
+		}
+	}
+	return events
+}
+
+func TestSubscribe(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	for _, err := range []error{e.Put("a", "1"), e.Put("b", "2"), e.Delete("a")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+
+	// the history comes from the data files of a previous run
+	e = openTestEngine(t, dir)
+	s, err := e.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := e.Put("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Incr("n", 5); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{1, EVENT_PUT, "a", "1"},
+		{2, EVENT_PUT, "b", "2"},
+		{3, EVENT_DELETE, "a", ""},
+		{4, EVENT_PUT, "c", "3"},
+		{5, EVENT_PUT, "n", "5"},
+	}
+	if got := nextEvents(t, s, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	from, err := e.Subscribe(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	if got := nextEvents(t, from, 3); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("events from 3 = %v, want %v", got, want[2:])
+	}
+
+	ahead, err := e.Subscribe(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ahead.Close()
+	for i := 0; i < 2; i++ {
+		if err := e.Put("d", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := nextEvents(t, ahead, 1); got[0].Seq != 7 {
+		t.Errorf("first event from 7 = %v", got[0])
+	}
+}
+
+func TestSubscribeAfterMerge(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+		if err := e.Put(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+
+	e = openTestEngine(t, dir)
+	if err := e.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := e.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := e.Put("c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// the overwritten a=1 is merged away, the rest keeps its order
+	want := []Event{
+		{2, EVENT_PUT, "b", "1"},
+		{3, EVENT_PUT, "a", "2"},
+		{4, EVENT_PUT, "c", "1"},
+	}
+	if got := nextEvents(t, s, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestSubscribeStreamedValues(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithBlobThreshold(64))
+	s, err := e.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	blob := strings.Repeat("b", 100)
+	if err := e.PutReader("blob", strings.NewReader(blob), int64(len(blob))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PutReader("small", strings.NewReader("s"), 1); err != nil {
+		t.Fatal(err)
+	}
+	got := nextEvents(t, s, 2)
+	if got[0].Value != blob || got[1].Value != "s" {
+		t.Errorf("events = %v", got)
+	}
+
+	replay, err := e.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	if got := nextEvents(t, replay, 1); got[0].Value != blob {
+		t.Errorf("replayed blob = %q", got[0].Value)
+	}
+}
+
+func TestSubscribeLagged(t *testing.T) {
+	e := openTestEngine(t, t.TempDir(), WithSubscriberBuffer(4))
+	s, err := e.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// nobody reads, and the writes go through regardless
+	for i := 0; i < 20; i++ {
+		if err := e.Put("k", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var last uint64
+	for ev := range s.Events() {
+		if ev.Seq != last+1 {
+			t.Fatalf("event %d after %d", ev.Seq, last)
+		}
+		last = ev.Seq
+	}
+	if !errors.Is(s.Err(), ErrSubscriberLagged) {
+		t.Fatalf("Err() = %v, want %v", s.Err(), ErrSubscriberLagged)
+	}
+
+	// catching up from the data files
+	again, err := e.Subscribe(last + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	got := nextEvents(t, again, int(20-last))
+	if got[len(got)-1].Value != "19" {
+		t.Errorf("last event = %v", got[len(got)-1])
+	}
+}
+
+func TestSubscriptionEnd(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	closed, err := e.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	for range closed.Events() {
+	}
+	if closed.Err() != nil {
+		t.Errorf("Err() after Close = %v", closed.Err())
+	}
+
+	s, err := e.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	for range s.Events() {
+	}
+	if !errors.Is(s.Err(), ErrClosed) {
+		t.Errorf("Err() after engine Close = %v, want %v", s.Err(), ErrClosed)
+	}
+	if _, err := e.Subscribe(0); !errors.Is(err, ErrClosed) {
+		t.Errorf("Subscribe() after Close error = %v, want %v", err, ErrClosed)
+	}
+}
@@ -2,7 +2,9 @@ package parser
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/machinly/bitcask/engine"
 )
@@ -12,6 +14,7 @@ type Parser interface {
 }
 
 type parser struct {
+	// engine is the bucket the commands act on, see "use".
 	engine engine.Engine
 }
 
@@ -54,6 +57,85 @@ func (p *parser) Parse(cmdStr string) ([]string, error) {
 			return nil, err
 		}
 		return []string{value}, nil
+	case "exists":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("exists command requires 1 argument")
+		}
+		ok, err := p.engine.Has(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatBool(ok)}, nil
+	case "mget":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("mget command requires at least 1 argument")
+		}
+		values, err := p.engine.MultiGet(args)
+		if err != nil {
+			return nil, err
+		}
+		lines := make([]string, 0, len(args))
+		for _, key := range args {
+			value, ok := values[key]
+			if !ok {
+				value = "(not found)"
+			}
+			lines = append(lines, value)
+		}
+		return lines, nil
+	case "cas":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("cas command requires 3 arguments")
+		}
+		ok, err := p.engine.CompareAndSwap(args[0], args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatBool(ok)}, nil
+	case "putifabsent":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("putifabsent command requires 2 arguments")
+		}
+		ok, err := p.engine.PutIfAbsent(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatBool(ok)}, nil
+	case "deleteifequals":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("deleteifequals command requires 2 arguments")
+		}
+		ok, err := p.engine.DeleteIfEquals(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatBool(ok)}, nil
+	case "incr":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, fmt.Errorf("incr command requires 1 or 2 arguments")
+		}
+		delta := int64(1)
+		if len(args) == 2 {
+			var err error
+			delta, err = strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("incr delta must be an integer: %s", args[1])
+			}
+		}
+		n, err := p.engine.Incr(args[0], delta)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatInt(n, 10)}, nil
+	case "append":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("append command requires 2 arguments")
+		}
+		err := p.engine.Append(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		return []string{"ok"}, nil
 	case "delete":
 		if len(args) != 1 {
 			return nil, fmt.Errorf("delete command requires 1 argument")
@@ -69,11 +151,80 @@ func (p *parser) Parse(cmdStr string) ([]string, error) {
 		}
 		keys, err := p.engine.ListKeys()
 		return keys, err
+	case "stats":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("stats command requires 0 arguments")
+		}
+		stats, err := p.engine.Stats()
+		if err != nil {
+			return nil, err
+		}
+		return formatStats(stats), nil
+	case "use":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("use command requires 1 argument")
+		}
+		bucket, err := p.engine.Bucket(args[0])
+		if err != nil {
+			return nil, err
+		}
+		p.engine = bucket
+		return []string{"ok"}, nil
+	case "buckets":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("buckets command requires 0 arguments")
+		}
+		return p.engine.ListBuckets()
+	case "dropbucket":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("dropbucket command requires 1 argument")
+		}
+		err := p.engine.DropBucket(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return []string{"ok"}, nil
 	default:
 		return nil, fmt.Errorf("unknown command: %s", method)
 	}
 }
 
+func formatStats(stats engine.Stats) []string {
+	lines := []string{
+		fmt.Sprintf("keys: %d", stats.Keys),
+		fmt.Sprintf("tombstones: %d", stats.Tombstones),
+		fmt.Sprintf("keydir bytes: %d", stats.KeydirBytes),
+		fmt.Sprintf("active file: %s (%d/%d bytes)", stats.ActiveFile, stats.ActiveFileSize, stats.MaxFileSize),
+		fmt.Sprintf("open files: %d", stats.OpenFiles),
+	}
+	if stats.CacheCapacity > 0 {
+		lines = append(lines, fmt.Sprintf("value cache: %d/%d bytes, %d hits, %d misses",
+			stats.CacheBytes, stats.CacheCapacity, stats.CacheHits, stats.CacheMisses))
+	}
+	if stats.BloomFilterBytes > 0 {
+		lines = append(lines, fmt.Sprintf("bloom filter: %d bytes, %d negatives",
+			stats.BloomFilterBytes, stats.BloomNegatives))
+	}
+	if stats.LastMerge.IsZero() {
+		lines = append(lines, "last merge: never")
+	} else {
+		lines = append(lines, fmt.Sprintf("last merge: %s (took %s)",
+			stats.LastMerge.Format(time.RFC3339), stats.LastMergeDuration))
+	}
+	if stats.LastMergeError != "" {
+		lines = append(lines, fmt.Sprintf("last merge error: %s", stats.LastMergeError))
+	}
+	for _, f := range stats.Files {
+		lines = append(lines, fmt.Sprintf("%s: total %d, live %d, dead %d, tombstones %d",
+			f.Name, f.TotalBytes, f.LiveBytes, f.DeadBytes, f.Tombstones))
+	}
+	for _, f := range stats.BlobFiles {
+		lines = append(lines, fmt.Sprintf("%s: total %d, live %d, dead %d",
+			f.Name, f.TotalBytes, f.LiveBytes, f.DeadBytes))
+	}
+	return lines
+}
+
 func NewParser(engine engine.Engine) Parser {
 	return &parser{engine: engine}
 }